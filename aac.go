@@ -0,0 +1,1096 @@
+package raopd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// aacDecoder decodes AAC-LC, ISO/IEC 14496-3 subpart 4, streamed as
+// mpeg4-generic, RFC 3640. The payload is either a bare access unit, as
+// sent by AirPlay sources, or access units with AU headers if the fmtp has
+// a sizelength. Main profile prediction, gain control, coupling channels
+// and the SBR and PS extensions of HE-AAC are not supported.
+type aacDecoder struct {
+	rate     int
+	channels int
+	sfIndex  int // The sampling frequency index
+
+	// The sizes of the fields of the AU headers in bits, the AU headers
+	// are not present if sizeLength is 0
+	sizeLength, indexLength, indexDeltaLength int
+
+	ch    []*aacChannel
+	lfe   *aacChannel // Decoded and dropped
+	noise uint32      // The state of the random noise of PNS
+	pcm   [][]float64 // The output of the channels of a frame
+	buf   []byte
+}
+
+// Syntactic elements of the raw data block
+const (
+	aacElementSCE = iota
+	aacElementCPE
+	aacElementCCE
+	aacElementLFE
+	aacElementDSE
+	aacElementPCE
+	aacElementFIL
+	aacElementEND
+)
+
+// Window sequences
+const (
+	aacOnlyLongSequence = iota
+	aacLongStartSequence
+	aacEightShortSequence
+	aacLongStopSequence
+)
+
+// Codebooks of the sections which are not Huffman codebooks
+const (
+	aacZeroHcb       = 0
+	aacNoiseHcb      = 13
+	aacIntensityHcb2 = 14 // Out of phase
+	aacIntensityHcb  = 15 // In phase
+)
+
+// Samples per frame
+const aacFrameLength = 1024
+
+// Init takes the sample rate and channels from the rtpmap and the
+// AudioSpecificConfig from the config parameter of the fmtp if it has one.
+func (d *aacDecoder) Init(rtpmap, fmtp string) error {
+	rm, err := parseSdpRtpmap(rtpmap)
+	if err != nil {
+		return err
+	}
+	d.rate, d.channels = rm.clockRate, rm.channels
+	if d.rate == 0 {
+		d.rate = outputSampleRate
+	}
+	if d.channels == 0 {
+		d.channels = outputChannels
+	}
+	d.sizeLength, d.indexLength, d.indexDeltaLength = 0, 0, 0
+	if fmtp != "" {
+		f, err := parseSdpFmtp(fmtp)
+		if err != nil {
+			return err
+		}
+		if config, ok := f.parameter("config"); ok {
+			if err = d.parseAudioSpecificConfig(config); err != nil {
+				return err
+			}
+		}
+		for _, p := range []struct {
+			name string
+			v    *int
+		}{
+			{"sizelength", &d.sizeLength},
+			{"indexlength", &d.indexLength},
+			{"indexdeltalength", &d.indexDeltaLength},
+		} {
+			if s, ok := f.parameter(p.name); ok {
+				if *p.v, err = strconv.Atoi(s); err != nil || *p.v < 0 || *p.v > 32 {
+					return fmt.Errorf("Malformed AAC %s '%s'", p.name, s)
+				}
+			}
+		}
+	}
+	d.sfIndex = -1
+	for ii, rate := range aacSampleRates {
+		if rate == d.rate {
+			d.sfIndex = ii
+		}
+	}
+	switch {
+	case d.sfIndex < 0:
+		return fmt.Errorf("Unsupported AAC sample rate %d", d.rate)
+	case rm.clockRate != 0 && rm.clockRate != d.rate:
+		return fmt.Errorf("AAC sample rate %d is not the RTP clock rate %d", d.rate, rm.clockRate)
+	case d.channels != 1 && d.channels != 2:
+		return fmt.Errorf("Unsupported AAC channel count %d", d.channels)
+	}
+	d.ch = make([]*aacChannel, d.channels)
+	d.pcm = make([][]float64, d.channels)
+	for ii := range d.ch {
+		d.ch[ii] = &aacChannel{}
+		d.pcm[ii] = make([]float64, aacFrameLength)
+	}
+	d.lfe = &aacChannel{}
+	d.noise = 1
+	return nil
+}
+
+// Parse the AudioSpecificConfig in hex, which must be AAC-LC.
+func (d *aacDecoder) parseAudioSpecificConfig(config string) error {
+	b, err := hex.DecodeString(config)
+	if err != nil {
+		return fmt.Errorf("Malformed AAC config '%s'", config)
+	}
+	r := &aacBitReader{b: b}
+	objectType := int(r.read(5))
+	if objectType == 31 {
+		objectType = 32 + int(r.read(6))
+	}
+	sfIndex := int(r.read(4))
+	if sfIndex == 15 {
+		d.rate = int(r.read(24))
+	} else if sfIndex < len(aacSampleRates) {
+		d.rate = aacSampleRates[sfIndex]
+	} else {
+		return fmt.Errorf("Malformed AAC config '%s'", config)
+	}
+	d.channels = int(r.read(4))
+	// GASpecificConfig
+	frameLengthFlag := r.bit()
+	if r.bit() { // dependsOnCoreCoder
+		r.read(14)
+	}
+	r.bit() // extensionFlag
+	switch {
+	case r.overrun():
+		return fmt.Errorf("Malformed AAC config '%s'", config)
+	case objectType != 2:
+		return fmt.Errorf("Unsupported AAC object type %d", objectType)
+	case frameLengthFlag:
+		return errors.New("Unsupported AAC frame length 960")
+	}
+	return nil
+}
+
+// Decode the access units of the payload, the access units are decoded
+// to 16 bit PCM.
+func (d *aacDecoder) Decode(frame []byte) ([]byte, error) {
+	d.buf = d.buf[:0]
+	if d.sizeLength == 0 {
+		if err := d.decodeAccessUnit(frame); err != nil {
+			return nil, err
+		}
+		return d.buf, nil
+	}
+	if len(frame) < 2 {
+		return nil, errors.New("AAC payload without AU headers")
+	}
+	headersLength := int(frame[0])<<8 | int(frame[1])
+	if 2+(headersLength+7)/8 > len(frame) {
+		return nil, errors.New("Malformed AAC AU headers")
+	}
+	headers := &aacBitReader{b: frame[2:]}
+	data := frame[2+(headersLength+7)/8:]
+	for first := true; headers.pos < headersLength; first = false {
+		size := int(headers.read(d.sizeLength))
+		if first {
+			headers.read(d.indexLength)
+		} else {
+			headers.read(d.indexDeltaLength)
+		}
+		if headers.overrun() || size > len(data) {
+			return nil, errors.New("Malformed AAC AU headers")
+		}
+		if err := d.decodeAccessUnit(data[:size]); err != nil {
+			return nil, err
+		}
+		data = data[size:]
+	}
+	return d.buf, nil
+}
+
+func (d *aacDecoder) SampleRate() int {
+	return d.rate
+}
+
+func (d *aacDecoder) Channels() int {
+	return d.channels
+}
+
+func (d *aacDecoder) BitDepth() int {
+	return 16
+}
+
+// Decode a raw_data_block and append the PCM to buf.
+func (d *aacDecoder) decodeAccessUnit(au []byte) error {
+	r := &aacBitReader{b: au}
+	next := 0 // The next output channel
+	for {
+		id := r.read(3)
+		if r.overrun() {
+			return errors.New("AAC frame without END")
+		}
+		switch id {
+		case aacElementSCE, aacElementLFE:
+			r.read(4) // element_instance_tag
+			c := d.lfe
+			if id == aacElementSCE {
+				if next >= len(d.ch) {
+					return errors.New("AAC frame has too many channels")
+				}
+				c = d.ch[next]
+				next++
+			}
+			if err := d.decodeIcs(r, c, false); err != nil {
+				return err
+			}
+			d.reconstruct(c)
+		case aacElementCPE:
+			r.read(4)
+			if next+2 > len(d.ch) {
+				return errors.New("AAC frame has too many channels")
+			}
+			if err := d.decodeCpe(r, d.ch[next], d.ch[next+1]); err != nil {
+				return err
+			}
+			next += 2
+		case aacElementDSE:
+			r.read(4)
+			align := r.bit()
+			count := int(r.read(8))
+			if count == 255 {
+				count += int(r.read(8))
+			}
+			if align {
+				r.align()
+			}
+			r.skip(8 * count)
+		case aacElementFIL:
+			count := int(r.read(4))
+			if count == 15 {
+				count += int(r.read(8)) - 1
+			}
+			r.skip(8 * count)
+		case aacElementEND:
+			if next != len(d.ch) {
+				return fmt.Errorf("AAC frame has %d channels, expected %d", next, len(d.ch))
+			}
+			d.output()
+			return nil
+		default:
+			return fmt.Errorf("Unsupported AAC element %d", id)
+		}
+		if r.overrun() {
+			return errors.New("AAC frame too short")
+		}
+	}
+}
+
+// Filter the spectra of the channels to PCM, and append it to buf.
+func (d *aacDecoder) output() {
+	for ii, c := range d.ch {
+		c.synthesize(d.pcm[ii])
+	}
+	for n := 0; n < aacFrameLength; n++ {
+		for _, pcm := range d.pcm {
+			v := math.Floor(pcm[n] + 0.5)
+			if v > math.MaxInt16 {
+				v = math.MaxInt16
+			} else if v < math.MinInt16 {
+				v = math.MinInt16
+			}
+			s := int16(v)
+			d.buf = append(d.buf, byte(s), byte(s>>8))
+		}
+	}
+}
+
+// -------------------------- Channel stream ----------------------------------------------------
+
+// The ics_info of a channel, shared by the channels of a CPE with a
+// common window.
+type aacIcsInfo struct {
+	windowSequence int
+	windowShape    int
+	maxSfb         int
+	numWindows     int
+	numGroups      int
+	groupLength    [8]int
+	swbOffset      []int // Of the window length
+	numSwb         int
+	tnsMaxBands    int
+}
+
+type aacTnsFilter struct {
+	length    int
+	order     int
+	direction bool
+	lpc       [13]float64 // a[1..order] of the all pole filter
+}
+
+// A pulse of the pulse data, added to the magnitude of a quantized value
+type aacPulse struct {
+	k, amp int
+}
+
+// The state of the decoding of a channel.
+type aacChannel struct {
+	info      aacIcsInfo
+	cb        [8][64]int // The codebook by group and scalefactor band
+	sf        [8][64]int // The scalefactor, intensity position or noise energy
+	quant     [aacFrameLength]int
+	pulses    []aacPulse
+	spec      [aacFrameLength]float64
+	tnsFilter [8][]aacTnsFilter // By window
+
+	overlap   [aacFrameLength]float64
+	prevShape int
+}
+
+func (d *aacDecoder) decodeIcsInfo(r *aacBitReader, info *aacIcsInfo) error {
+	r.bit() // ics_reserved_bit
+	info.windowSequence = int(r.read(2))
+	info.windowShape = int(r.read(1))
+	if info.windowSequence == aacEightShortSequence {
+		info.maxSfb = int(r.read(4))
+		grouping := r.read(7)
+		info.numWindows = 8
+		info.numGroups = 1
+		info.groupLength = [8]int{1}
+		for w := 1; w < 8; w++ {
+			if grouping&(1<<uint(7-w)) != 0 {
+				info.groupLength[info.numGroups-1]++
+			} else {
+				info.numGroups++
+				info.groupLength[info.numGroups-1] = 1
+			}
+		}
+		info.swbOffset = aacSwbOffsetShort[d.sfIndex]
+		info.tnsMaxBands = aacTnsMaxBandsShort[d.sfIndex]
+	} else {
+		info.maxSfb = int(r.read(6))
+		if r.bit() {
+			return errors.New("Unsupported AAC prediction")
+		}
+		info.numWindows = 1
+		info.numGroups = 1
+		info.groupLength = [8]int{1}
+		info.swbOffset = aacSwbOffsetLong[d.sfIndex]
+		info.tnsMaxBands = aacTnsMaxBandsLong[d.sfIndex]
+	}
+	info.numSwb = len(info.swbOffset) - 1
+	if info.maxSfb > info.numSwb {
+		return fmt.Errorf("AAC max_sfb %d exceeds %d bands", info.maxSfb, info.numSwb)
+	}
+	return nil
+}
+
+// Decode an individual_channel_stream to the quantized spectrum.
+func (d *aacDecoder) decodeIcs(r *aacBitReader, c *aacChannel, commonWindow bool) error {
+	globalGain := int(r.read(8))
+	if !commonWindow {
+		if err := d.decodeIcsInfo(r, &c.info); err != nil {
+			return err
+		}
+	}
+	info := &c.info
+	if err := c.decodeSections(r); err != nil {
+		return err
+	}
+	if err := c.decodeScalefactors(r, globalGain); err != nil {
+		return err
+	}
+	if r.bit() {
+		if info.windowSequence == aacEightShortSequence {
+			return errors.New("AAC pulse data in short windows")
+		}
+		c.decodePulses(r)
+	} else {
+		c.pulses = c.pulses[:0]
+	}
+	for w := range c.tnsFilter {
+		c.tnsFilter[w] = c.tnsFilter[w][:0]
+	}
+	if r.bit() {
+		if err := c.decodeTns(r); err != nil {
+			return err
+		}
+	}
+	if r.bit() {
+		return errors.New("Unsupported AAC gain control")
+	}
+	return c.decodeSpectrum(r)
+}
+
+func (c *aacChannel) decodeSections(r *aacBitReader) error {
+	info := &c.info
+	bits, esc := 5, uint32(31)
+	if info.windowSequence == aacEightShortSequence {
+		bits, esc = 3, 7
+	}
+	for g := 0; g < info.numGroups; g++ {
+		for k := 0; k < info.maxSfb; {
+			cb := int(r.read(4))
+			if cb == 12 {
+				return errors.New("Reserved AAC codebook")
+			}
+			end := k
+			for {
+				incr := r.read(bits)
+				end += int(incr)
+				if incr != esc {
+					break
+				}
+				if r.overrun() {
+					return errors.New("AAC frame too short")
+				}
+			}
+			if end > info.maxSfb || r.overrun() {
+				return errors.New("Malformed AAC section data")
+			}
+			for ; k < end; k++ {
+				c.cb[g][k] = cb
+			}
+		}
+	}
+	return nil
+}
+
+func (c *aacChannel) decodeScalefactors(r *aacBitReader, globalGain int) error {
+	info := &c.info
+	sf, is, noise := globalGain, 0, globalGain-90
+	noiseFirst := true
+	for g := 0; g < info.numGroups; g++ {
+		for sfb := 0; sfb < info.maxSfb; sfb++ {
+			switch c.cb[g][sfb] {
+			case aacZeroHcb:
+				c.sf[g][sfb] = 0
+			case aacIntensityHcb, aacIntensityHcb2:
+				is += aacScalefactorHuffman.decode(r) - 60
+				c.sf[g][sfb] = is
+			case aacNoiseHcb:
+				if noiseFirst {
+					noise += int(r.read(9)) - 256
+					noiseFirst = false
+				} else {
+					noise += aacScalefactorHuffman.decode(r) - 60
+				}
+				c.sf[g][sfb] = noise
+			default:
+				sf += aacScalefactorHuffman.decode(r) - 60
+				if sf < 0 || sf > 255 {
+					return fmt.Errorf("AAC scalefactor %d out of range", sf)
+				}
+				c.sf[g][sfb] = sf
+			}
+		}
+	}
+	return nil
+}
+
+// The pulses precede the spectral data they are added to.
+func (c *aacChannel) decodePulses(r *aacBitReader) {
+	c.pulses = c.pulses[:0]
+	n := int(r.read(2)) + 1
+	start := int(r.read(6))
+	k := aacFrameLength
+	if start < c.info.numSwb {
+		k = c.info.swbOffset[start]
+	}
+	for ii := 0; ii < n; ii++ {
+		k += int(r.read(5))
+		c.pulses = append(c.pulses, aacPulse{k, int(r.read(4))})
+	}
+}
+
+func (c *aacChannel) decodeTns(r *aacBitReader) error {
+	info := &c.info
+	nFiltBits, lengthBits, orderBits, maxOrder := 2, 6, 5, 12
+	if info.windowSequence == aacEightShortSequence {
+		nFiltBits, lengthBits, orderBits, maxOrder = 1, 4, 3, 7
+	}
+	for w := 0; w < info.numWindows; w++ {
+		nFilt := int(r.read(nFiltBits))
+		if nFilt == 0 {
+			continue
+		}
+		coefRes := int(r.read(1)) + 3
+		for f := 0; f < nFilt; f++ {
+			tf := aacTnsFilter{}
+			tf.length = int(r.read(lengthBits))
+			tf.order = int(r.read(orderBits))
+			if tf.order > maxOrder {
+				return fmt.Errorf("AAC TNS order %d exceeds %d", tf.order, maxOrder)
+			}
+			if tf.order > 0 {
+				tf.direction = r.bit()
+				coefBits := coefRes - int(r.read(1))
+				var parcor [12]float64
+				iqfac := (float64(int(1)<<uint(coefRes-1)) - 0.5) / (math.Pi / 2)
+				iqfacM := (float64(int(1)<<uint(coefRes-1)) + 0.5) / (math.Pi / 2)
+				for ii := 0; ii < tf.order; ii++ {
+					v := int(r.read(coefBits))
+					if v >= 1<<uint(coefBits-1) {
+						v -= 1 << uint(coefBits)
+					}
+					if v >= 0 {
+						parcor[ii] = math.Sin(float64(v) / iqfac)
+					} else {
+						parcor[ii] = math.Sin(float64(v) / iqfacM)
+					}
+				}
+				// Convert the reflection coefficients to the LPC
+				var b [13]float64
+				for m := 1; m <= tf.order; m++ {
+					b = tf.lpc
+					for ii := 1; ii < m; ii++ {
+						tf.lpc[ii] = b[ii] + parcor[m-1]*b[m-ii]
+					}
+					tf.lpc[m] = parcor[m-1]
+				}
+			}
+			c.tnsFilter[w] = append(c.tnsFilter[w], tf)
+		}
+	}
+	return nil
+}
+
+// Decode the spectral data to quant, which is in window order. The values
+// of the short windows of a group are interleaved by scalefactor band.
+func (c *aacChannel) decodeSpectrum(r *aacBitReader) error {
+	info := &c.info
+	c.quant = [aacFrameLength]int{}
+	win := 0
+	for g := 0; g < info.numGroups; g++ {
+		for sfb := 0; sfb < info.maxSfb; sfb++ {
+			cb := c.cb[g][sfb]
+			if cb == aacZeroHcb || cb >= aacNoiseHcb {
+				continue
+			}
+			book := &aacCodebooks[cb]
+			start, end := info.swbOffset[sfb], info.swbOffset[sfb+1]
+			for w := win; w < win+info.groupLength[g]; w++ {
+				q := c.quant[w*128:]
+				for k := start; k < end; k += book.dim {
+					book.decode(r, q[k:k+book.dim])
+				}
+			}
+			if r.overrun() {
+				return errors.New("AAC frame too short")
+			}
+		}
+		win += info.groupLength[g]
+	}
+	for _, p := range c.pulses {
+		if p.k >= aacFrameLength {
+			return errors.New("Malformed AAC pulse data")
+		}
+		if c.quant[p.k] > 0 {
+			c.quant[p.k] += p.amp
+		} else {
+			c.quant[p.k] -= p.amp
+		}
+	}
+	return nil
+}
+
+// Inverse quantize the spectrum and fill the noise bands.
+func (d *aacDecoder) dequantize(c *aacChannel) {
+	info := &c.info
+	c.spec = [aacFrameLength]float64{}
+	win := 0
+	for g := 0; g < info.numGroups; g++ {
+		for sfb := 0; sfb < info.maxSfb; sfb++ {
+			start, end := info.swbOffset[sfb], info.swbOffset[sfb+1]
+			switch cb := c.cb[g][sfb]; {
+			case cb == aacZeroHcb || cb == aacIntensityHcb || cb == aacIntensityHcb2:
+			case cb == aacNoiseHcb:
+				for w := win; w < win+info.groupLength[g]; w++ {
+					s := c.spec[w*128+start : w*128+end]
+					energy := 0.0
+					for k := range s {
+						d.noise = d.noise*1664525 + 1013904223
+						s[k] = float64(int32(d.noise))
+						energy += s[k] * s[k]
+					}
+					scale := math.Pow(2, 0.25*float64(c.sf[g][sfb])) / math.Sqrt(energy)
+					for k := range s {
+						s[k] *= scale
+					}
+				}
+			default:
+				scale := math.Pow(2, 0.25*float64(c.sf[g][sfb]-100))
+				for w := win; w < win+info.groupLength[g]; w++ {
+					for k := w*128 + start; k < w*128+end; k++ {
+						c.spec[k] = aacPow43(c.quant[k]) * scale
+					}
+				}
+			}
+		}
+		win += info.groupLength[g]
+	}
+}
+
+// Dequantize a single channel and apply TNS.
+func (d *aacDecoder) reconstruct(c *aacChannel) {
+	d.dequantize(c)
+	c.applyTns()
+}
+
+// Decode a channel_pair_element to the two channels.
+func (d *aacDecoder) decodeCpe(r *aacBitReader, left, right *aacChannel) error {
+	commonWindow := r.bit()
+	var msUsed [8][64]bool
+	msMaskPresent := uint32(0)
+	if commonWindow {
+		if err := d.decodeIcsInfo(r, &left.info); err != nil {
+			return err
+		}
+		right.info = left.info
+		msMaskPresent = r.read(2)
+		switch msMaskPresent {
+		case 1:
+			for g := 0; g < left.info.numGroups; g++ {
+				for sfb := 0; sfb < left.info.maxSfb; sfb++ {
+					msUsed[g][sfb] = r.bit()
+				}
+			}
+		case 2:
+			for g := range msUsed {
+				for sfb := range msUsed[g] {
+					msUsed[g][sfb] = true
+				}
+			}
+		case 3:
+			return errors.New("Reserved AAC ms_mask_present")
+		}
+	}
+	if err := d.decodeIcs(r, left, commonWindow); err != nil {
+		return err
+	}
+	if err := d.decodeIcs(r, right, commonWindow); err != nil {
+		return err
+	}
+	d.dequantize(left)
+	d.dequantize(right)
+
+	if commonWindow {
+		info := &left.info
+		win := 0
+		for g := 0; g < info.numGroups; g++ {
+			for sfb := 0; sfb < info.maxSfb; sfb++ {
+				start, end := info.swbOffset[sfb], info.swbOffset[sfb+1]
+				switch rcb := right.cb[g][sfb]; {
+				case rcb == aacIntensityHcb || rcb == aacIntensityHcb2:
+					scale := math.Pow(0.5, 0.25*float64(right.sf[g][sfb]))
+					if (rcb == aacIntensityHcb2) != (msMaskPresent == 1 && msUsed[g][sfb]) {
+						scale = -scale
+					}
+					for w := win; w < win+info.groupLength[g]; w++ {
+						for k := w*128 + start; k < w*128+end; k++ {
+							right.spec[k] = left.spec[k] * scale
+						}
+					}
+				case msUsed[g][sfb] && rcb != aacNoiseHcb && left.cb[g][sfb] != aacNoiseHcb:
+					for w := win; w < win+info.groupLength[g]; w++ {
+						for k := w*128 + start; k < w*128+end; k++ {
+							l, r := left.spec[k], right.spec[k]
+							left.spec[k], right.spec[k] = l+r, l-r
+						}
+					}
+				}
+			}
+			win += info.groupLength[g]
+		}
+	}
+	left.applyTns()
+	right.applyTns()
+	return nil
+}
+
+// Apply the temporal noise shaping filters to the spectrum.
+func (c *aacChannel) applyTns() {
+	info := &c.info
+	limit := info.tnsMaxBands
+	if info.maxSfb < limit {
+		limit = info.maxSfb
+	}
+	for w := 0; w < info.numWindows; w++ {
+		spec := c.spec[w*128:]
+		bottom := info.numSwb
+		for _, tf := range c.tnsFilter[w] {
+			top := bottom
+			bottom = top - tf.length
+			if bottom < 0 {
+				bottom = 0
+			}
+			if tf.order == 0 {
+				continue
+			}
+			start := info.swbOffset[minInt(bottom, limit)]
+			end := info.swbOffset[minInt(top, limit)]
+			if start >= end {
+				continue
+			}
+			k, inc := start, 1
+			if tf.direction {
+				k, inc = end-1, -1
+			}
+			var state [12]float64 // The previous outputs, most recent first
+			for n := start; n < end; n++ {
+				y := spec[k]
+				for ii := 0; ii < tf.order; ii++ {
+					y -= tf.lpc[ii+1] * state[ii]
+				}
+				copy(state[1:tf.order], state[:tf.order-1])
+				state[0] = y
+				spec[k] = y
+				k += inc
+			}
+		}
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// -------------------------- Filter bank -------------------------------------------------------
+
+// The rising halves of the windows by window shape, sine and KBD, and the
+// twiddle factors of the DCT-IV by its length.
+var aacFilterbank = struct {
+	long    [2][]float64
+	short   [2][]float64
+	twiddle map[int][]complex128
+}{
+	long:    [2][]float64{aacSineWindow(2048), aacKbdWindow(2048, 4)},
+	short:   [2][]float64{aacSineWindow(256), aacKbdWindow(256, 6)},
+	twiddle: map[int][]complex128{128: dct4Twiddles(128), 1024: dct4Twiddles(1024)},
+}
+
+func aacSineWindow(n int) []float64 {
+	w := make([]float64, n/2)
+	for ii := range w {
+		w[ii] = math.Sin(math.Pi / float64(n) * (float64(ii) + 0.5))
+	}
+	return w
+}
+
+// The Kaiser-Bessel derived window of length n.
+func aacKbdWindow(n int, alpha float64) []float64 {
+	kernel := make([]float64, n/2+1)
+	sum := 0.0
+	for p := range kernel {
+		x := float64(p-n/4) / float64(n/4)
+		kernel[p] = besselI0(math.Pi * alpha * math.Sqrt(1-x*x))
+		sum += kernel[p]
+	}
+	w := make([]float64, n/2)
+	acc := 0.0
+	for ii := range w {
+		acc += kernel[ii]
+		w[ii] = math.Sqrt(acc / sum)
+	}
+	return w
+}
+
+// The modified Bessel function of the first kind of order 0.
+func besselI0(x float64) float64 {
+	sum, term := 1.0, 1.0
+	for k := 1; k < 50; k++ {
+		term *= (x / 2 / float64(k)) * (x / 2 / float64(k))
+		sum += term
+	}
+	return sum
+}
+
+// Transform the spectrum to the time domain, window it and overlap it
+// with the previous frame into out.
+func (c *aacChannel) synthesize(out []float64) {
+	info := &c.info
+	var buf [2 * aacFrameLength]float64
+	longPrev, longCur := aacFilterbank.long[c.prevShape], aacFilterbank.long[info.windowShape]
+	shortPrev, shortCur := aacFilterbank.short[c.prevShape], aacFilterbank.short[info.windowShape]
+
+	if info.windowSequence == aacEightShortSequence {
+		var x [256]float64
+		for w := 0; w < 8; w++ {
+			imdct(c.spec[w*128:(w+1)*128], x[:])
+			left := shortCur
+			if w == 0 {
+				left = shortPrev
+			}
+			o := buf[448+128*w:]
+			for n := 0; n < 128; n++ {
+				o[n] += x[n] * left[n]
+				o[128+n] += x[128+n] * shortCur[127-n]
+			}
+		}
+	} else {
+		imdct(c.spec[:], buf[:])
+		switch info.windowSequence {
+		case aacLongStopSequence:
+			for n := 0; n < 448; n++ {
+				buf[n] = 0
+			}
+			for n := 0; n < 128; n++ {
+				buf[448+n] *= shortPrev[n]
+			}
+		default:
+			for n := 0; n < aacFrameLength; n++ {
+				buf[n] *= longPrev[n]
+			}
+		}
+		switch info.windowSequence {
+		case aacLongStartSequence:
+			for n := 0; n < 128; n++ {
+				buf[1472+n] *= shortCur[127-n]
+			}
+			for n := 1600; n < 2048; n++ {
+				buf[n] = 0
+			}
+		default:
+			for n := 0; n < aacFrameLength; n++ {
+				buf[aacFrameLength+n] *= longCur[aacFrameLength-1-n]
+			}
+		}
+	}
+	for n := 0; n < aacFrameLength; n++ {
+		out[n] = buf[n] + c.overlap[n]
+	}
+	copy(c.overlap[:], buf[aacFrameLength:])
+	c.prevShape = info.windowShape
+}
+
+// The inverse MDCT of the n/2 coefficients of spec to the n samples of
+// out, x[i] = 2/n * sum(spec[k] * cos(2*pi/n * (i + n0) * (k + 1/2))) with
+// n0 = (n/2 + 1)/2. It is computed with a DCT-IV of the coefficients.
+func imdct(spec []float64, out []float64) {
+	m := len(spec)
+	u := make([]float64, m)
+	dct4(spec, u)
+	scale := 2 / float64(2*m)
+	for n := 0; n < m/2; n++ {
+		out[n] = u[m/2+n] * scale
+	}
+	for n := m / 2; n < 3*m/2; n++ {
+		out[n] = -u[3*m/2-1-n] * scale
+	}
+	for n := 3 * m / 2; n < 2*m; n++ {
+		out[n] = -u[n-3*m/2] * scale
+	}
+}
+
+// The DCT-IV of in, u[n] = sum(in[k] * cos(pi/m * (n + 1/2) * (k + 1/2))),
+// computed with a complex FFT of m/2 points. The length must be one of the
+// transform lengths of aacFilterbank.
+func dct4(in []float64, u []float64) {
+	m := len(in)
+	tw := aacFilterbank.twiddle[m]
+	z := make([]complex128, m/2)
+	for n := range z {
+		z[n] = complex(in[2*n], in[m-1-2*n]) * tw[n]
+	}
+	fft(z)
+	for k := range z {
+		y := z[k] * tw[k]
+		u[2*k] = real(y)
+		u[m-1-2*k] = -imag(y)
+	}
+}
+
+// exp(-i*pi*(n + 1/8)/m) for the pre and post twiddle of dct4.
+func dct4Twiddles(m int) []complex128 {
+	tw := make([]complex128, m/2)
+	for n := range tw {
+		t := -math.Pi * (float64(n) + 0.125) / float64(m)
+		tw[n] = complex(math.Cos(t), math.Sin(t))
+	}
+	return tw
+}
+
+// An in place radix 2 FFT, the length of x must be a power of 2.
+func fft(x []complex128) {
+	n := len(x)
+	for ii, jj := 1, 0; ii < n; ii++ {
+		bit := n >> 1
+		for ; jj&bit != 0; bit >>= 1 {
+			jj ^= bit
+		}
+		jj |= bit
+		if ii < jj {
+			x[ii], x[jj] = x[jj], x[ii]
+		}
+	}
+	for size := 2; size <= n; size <<= 1 {
+		t := -2 * math.Pi / float64(size)
+		step := complex(math.Cos(t), math.Sin(t))
+		for start := 0; start < n; start += size {
+			w := complex(1, 0)
+			for k := 0; k < size/2; k++ {
+				a, b := x[start+k], x[start+k+size/2]*w
+				x[start+k], x[start+k+size/2] = a+b, a-b
+				w *= step
+			}
+		}
+	}
+}
+
+// -------------------------- Huffman decoding --------------------------------------------------
+
+type aacCodebook struct {
+	dim     int
+	lav     int // The largest absolute value
+	signed  bool
+	huffman *aacHuffman
+}
+
+// The spectral codebooks by codebook number, codebook 11 has escapes for
+// values of 16 or more.
+var aacCodebooks = func() (books [12]aacCodebook) {
+	for ii, p := range []struct {
+		dim, lav int
+		signed   bool
+	}{
+		{4, 1, true}, {4, 1, true}, {4, 2, false}, {4, 2, false},
+		{2, 4, true}, {2, 4, true}, {2, 7, false}, {2, 7, false},
+		{2, 12, false}, {2, 12, false}, {2, 16, false},
+	} {
+		books[ii+1] = aacCodebook{p.dim, p.lav, p.signed,
+			newAacHuffman(aacSpectralCodes[ii], aacSpectralBits[ii])}
+	}
+	return
+}()
+
+var aacScalefactorHuffman = newAacHuffman(aacScalefactorCodes, aacScalefactorBits)
+
+// Decode a codeword to len(q) values.
+func (book *aacCodebook) decode(r *aacBitReader, q []int) {
+	index := book.huffman.decode(r)
+	mod, off := book.lav+1, 0
+	if book.signed {
+		mod, off = 2*book.lav+1, book.lav
+	}
+	for ii := len(q) - 1; ii >= 0; ii-- {
+		q[ii] = index%mod - off
+		index /= mod
+	}
+	if book.signed {
+		return
+	}
+	for ii := range q {
+		if q[ii] != 0 && r.bit() {
+			q[ii] = -q[ii]
+		}
+	}
+	if book.lav != 16 { // Not the escape codebook
+		return
+	}
+	for ii := range q {
+		if q[ii] == 16 || q[ii] == -16 {
+			n := 4
+			for r.bit() && n < 13 {
+				n++
+			}
+			v := 1<<uint(n) + int(r.read(n))
+			if q[ii] < 0 {
+				v = -v
+			}
+			q[ii] = v
+		}
+	}
+}
+
+// A Huffman code as a binary tree. A node has the indexes of its children,
+// leaves are stored as -(value+1).
+type aacHuffman struct {
+	nodes [][2]int32
+}
+
+func newAacHuffman(codes []uint32, bits []uint8) *aacHuffman {
+	h := &aacHuffman{nodes: make([][2]int32, 1, len(codes))}
+	for value, code := range codes {
+		node := 0
+		for ii := int(bits[value]) - 1; ii >= 0; ii-- {
+			b := (code >> uint(ii)) & 1
+			if ii == 0 {
+				h.nodes[node][b] = -int32(value + 1)
+				break
+			}
+			if h.nodes[node][b] == 0 {
+				h.nodes = append(h.nodes, [2]int32{})
+				h.nodes[node][b] = int32(len(h.nodes) - 1)
+			}
+			node = int(h.nodes[node][b])
+		}
+	}
+	return h
+}
+
+func (h *aacHuffman) decode(r *aacBitReader) int {
+	node := int32(0)
+	for {
+		node = h.nodes[node][r.read(1)]
+		if node < 0 {
+			return int(-node - 1)
+		}
+		if node == 0 {
+			// Not a code, only possible when reading past the end
+			return 0
+		}
+	}
+}
+
+// -------------------------- Bit reader --------------------------------------------------------
+
+// aacBitReader reads bits MSB first. Reading past the end returns zero bits
+// and is reported by overrun.
+type aacBitReader struct {
+	b   []byte
+	pos int // In bits
+}
+
+func (r *aacBitReader) read(n int) uint32 {
+	v := uint32(0)
+	for ii := 0; ii < n; ii++ {
+		v <<= 1
+		if byteIndex := r.pos >> 3; byteIndex < len(r.b) {
+			v |= uint32(r.b[byteIndex]>>(7-uint(r.pos&7))) & 1
+		}
+		r.pos++
+	}
+	return v
+}
+
+func (r *aacBitReader) bit() bool {
+	return r.read(1) == 1
+}
+
+func (r *aacBitReader) skip(n int) {
+	r.pos += n
+}
+
+func (r *aacBitReader) align() {
+	r.pos = (r.pos + 7) &^ 7
+}
+
+func (r *aacBitReader) overrun() bool {
+	return r.pos > 8*len(r.b)
+}
+
+// -------------------------- Inverse quantization ----------------------------------------------
+
+// |q|^(4/3) with the sign of q.
+func aacPow43(q int) float64 {
+	switch {
+	case q == 0:
+		return 0
+	case q < 0:
+		return -aacPow43(-q)
+	case q < len(aacPow43Table):
+		return aacPow43Table[q]
+	}
+	return math.Pow(float64(q), 4.0/3)
+}
+
+var aacPow43Table = func() []float64 {
+	t := make([]float64, 8192)
+	for ii := range t {
+		t[ii] = math.Pow(float64(ii), 4.0/3)
+	}
+	return t
+}()
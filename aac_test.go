@@ -0,0 +1,232 @@
+package raopd
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Two access units of a 1 kHz sine in the left channel and a 2.5 kHz sine
+// in the right channel, both with an amplitude of 8000, at 44100 Hz. The
+// output of the second access unit is the first 1024 samples of the sines.
+var aacTestTone = []string{
+	"21058465d800000028c851254c953254cc2c4d2ee82c654ee7eeddc840222512" +
+		"83688e93d2843e7078f48e6eb92809c7a1fa96c5b6a79833b5a9a53254c9510a" +
+		"30a30a30a30a30a30a30a30a30a600000000000000000000465d800000000000" +
+		"0000000000000000000000000000000061a61a30a30a30a321449589cb12ca3e" +
+		"35935e4aa7c9f27f14b2c4965f5db6a0ad4c2990a214614614614c34c00e",
+	"21058465d800000051651651621f387ce2dac2dba21f3066be68fbd9030c9c99" +
+		"64379e2923f62fb490d848271c76217e3f6e63b9821ee05b585b387ce1f38388" +
+		"38838839459459459459458000000000000000000000465d8000000000000000" +
+		"0000000000000000000000000000051628c28c28c28c2a64ab4d306b67b8888d" +
+		"24b07f0589fcfac212861f8dcbd15752ca63a7851851851852ca2c0380",
+}
+
+// The same sines coded as mid and side.
+var aacTestToneMS = []string{
+	"21059465d800000028c28c28c28c28c851254cc2d4ed8ca9ddc58280912191b9" +
+		"dc087adb9e91ad071f0fba7169e60cd2c4953254428c28c28c28c28c28c28c85" +
+		"1256288e52b74649fe8f27e61a76702d98330a64230a30a30a31a61a00001197" +
+		"60000000a30a30a30a30a30a892a64ac4ed8ca9ddc58280912191b9dc087adb9" +
+		"e91ad031f0fba7169e60cd2992a614614614614600000030d18544c2eec36de1" +
+		"917fa3c879869d9a0b6a0ac49461461463400000000038",
+	"21059465d80000000051651651620e21f387d22dba21f4c68ffb213424862b98" +
+		"11f837c2c860d1639fc332fc810f702daa1f387ce0e21651651651651628c29e" +
+		"4ab505b6bf824a478f49fb16454c5cbb0e594c74614614628b28b0000008cbb0" +
+		"000000000b28b287107107387d22dba21f4c68ffb21342486279891f837c2c86" +
+		"0d1639fc332fc80eb702da43e70710710710730d30d30d1851854c95dd6cff08" +
+		"8c8f1e90f62c8a94b97a1ab494f0a30a30a30000000007",
+}
+
+// The first access units of the audio of testdata/sample.mp4 of
+// github.com/abema/go-mp4, coded by libavcodec. The first has a FIL element
+// and the first three switch to short windows and back.
+var aacTestEncoded = []string{
+	"de02004c61766335382e35342e31303000424008c11838",
+	"21426c9fdc02244997fd6f9e9f438db0cd03ec6ae7bbf55029df740850a15ff9" +
+		"5f3d3e80003dbc",
+	"2172cf40978209dbf97da8038bd9ea6d78855609c8179772819bf9faff50529f" +
+		"a5d71c",
+	"2112cd039a8209cfdb8fd0008723634231a89c0269d67edfcffe0201e2f516f7" +
+		"9b400038",
+	"2112cf0193a11a5f6fdbaec00968e525c3f5ab285f7d26eb7dbf6ff7ffa02c01" +
+		"e400120e",
+	"2112cf029b6209de3e7f1fdb35b75d80fce84a439cc01366b78f9ff6ffa0007f" +
+		"fe8038",
+}
+
+func aacTestAccessUnits(frames []string) [][]byte {
+	aus := [][]byte{}
+	for _, f := range frames {
+		au, err := hex.DecodeString(f)
+		if err != nil {
+			panic(err)
+		}
+		aus = append(aus, au)
+	}
+	return aus
+}
+
+// Returns the largest difference of the decoded channel from the sine.
+func aacTestSineError(pcm []byte, channel int, frequency float64) float64 {
+	maxErr := 0.0
+	for n := 0; n < len(pcm)/4; n++ {
+		v := float64(int16(binary.LittleEndian.Uint16(pcm[4*n+2*channel:])))
+		maxErr = math.Max(maxErr, math.Abs(v-8000*math.Sin(2*math.Pi*frequency*float64(n)/44100)))
+	}
+	return maxErr
+}
+
+func TestAacDecoderInit(t *testing.T) {
+	d := &aacDecoder{}
+	assert.NoError(t, d.Init("96 mpeg4-generic/44100/2", "96 mode=AAC-hbr; config=1210"))
+	assert.Equal(t, 44100, d.SampleRate())
+	assert.Equal(t, 2, d.Channels())
+	assert.Equal(t, 16, d.BitDepth())
+
+	assert.NoError(t, d.Init("96 mpeg4-generic/48000/1", "96 streamtype=5; config=1188; sizelength=13"))
+	assert.Equal(t, 48000, d.SampleRate())
+	assert.Equal(t, 1, d.Channels())
+	assert.Equal(t, 13, d.sizeLength)
+
+	// As announced by AirPlay sources, without a config
+	assert.NoError(t, d.Init("96 mpeg4-generic/44100/2", "96 mode=AAC-main; constantDuration=1024"))
+	assert.Equal(t, 44100, d.SampleRate())
+	assert.Equal(t, 2, d.Channels())
+	assert.Equal(t, 0, d.sizeLength)
+
+	// With an SBR sync extension, which is ignored
+	assert.NoError(t, d.Init("96 mpeg4-generic/44100/2", "96 config=121056e500"))
+
+	assert.Error(t, d.Init("96 mpeg4-generic/44100/2", "96 config=1190"), "Not the clock rate")
+	assert.Error(t, d.Init("96 mpeg4-generic/44100/2", "96 config=0a10"), "AAC Main")
+	assert.Error(t, d.Init("96 mpeg4-generic/44100/2", "96 config=1214"), "960 samples per frame")
+	assert.Error(t, d.Init("96 mpeg4-generic/44100/2", "96 config=12"))
+	assert.Error(t, d.Init("96 mpeg4-generic/44100/2", "96 config=xyz"))
+	assert.Error(t, d.Init("96 mpeg4-generic/44100/2", "96 sizelength=x"))
+	assert.Error(t, d.Init("96 mpeg4-generic/44000/2", ""))
+	assert.Error(t, d.Init("96 mpeg4-generic/44100/6", ""))
+}
+
+func TestAacDecodeTone(t *testing.T) {
+	for _, frames := range [][]string{aacTestTone, aacTestToneMS} {
+		d := &aacDecoder{}
+		assert.NoError(t, d.Init("96 mpeg4-generic/44100/2", "96 mode=AAC-hbr; config=1210"))
+		var pcm []byte
+		for _, au := range aacTestAccessUnits(frames) {
+			var err error
+			pcm, err = d.Decode(au)
+			assert.NoError(t, err)
+			assert.Len(t, pcm, 4096)
+		}
+		assert.Less(t, aacTestSineError(pcm, 0, 1000), 40.0)
+		assert.Less(t, aacTestSineError(pcm, 1, 2500), 40.0)
+	}
+}
+
+func TestAacDecodeAUHeaders(t *testing.T) {
+	d := &aacDecoder{}
+	assert.NoError(t, d.Init("96 mpeg4-generic/44100/2",
+		"96 mode=AAC-hbr; config=1210; sizelength=13; indexlength=3; indexdeltalength=3"))
+	aus := aacTestAccessUnits(aacTestTone)
+
+	// A 13 bit size and a 3 bit index for each access unit
+	payload := []byte{0, 32}
+	for _, au := range aus {
+		payload = append(payload, byte(len(au)>>5), byte(len(au)<<3))
+	}
+	for _, au := range aus {
+		payload = append(payload, au...)
+	}
+	pcm, err := d.Decode(payload)
+	assert.NoError(t, err)
+	assert.Len(t, pcm, 8192)
+	assert.Less(t, aacTestSineError(pcm[4096:], 0, 1000), 40.0)
+
+	_, err = d.Decode(payload[:len(payload)-1])
+	assert.Error(t, err)
+	_, err = d.Decode(payload[:1])
+	assert.Error(t, err)
+	_, err = d.Decode([]byte{1, 0, 0})
+	assert.Error(t, err, "AU headers longer than the payload")
+}
+
+func TestAacDecodeEncoded(t *testing.T) {
+	d := &aacDecoder{}
+	assert.NoError(t, d.Init("96 mpeg4-generic/44100/2", "96 mode=AAC-hbr; config=121056e500"))
+	aus := aacTestAccessUnits(aacTestEncoded)
+	sequences := []int{}
+	var pcm []byte
+	for _, au := range aus {
+		var err error
+		pcm, err = d.Decode(au)
+		assert.NoError(t, err)
+		assert.Len(t, pcm, 4096)
+		sequences = append(sequences, d.ch[0].info.windowSequence)
+	}
+	assert.Equal(t, []int{aacLongStartSequence, aacEightShortSequence, aacLongStopSequence,
+		aacOnlyLongSequence, aacOnlyLongSequence, aacOnlyLongSequence}, sequences)
+	assert.NotEqual(t, make([]byte, 4096), pcm)
+
+	// Each access unit ends in its last byte
+	for _, au := range aus {
+		_, err := d.Decode(au[:len(au)-1])
+		assert.Error(t, err)
+	}
+
+	// Mono streams can not decode a channel pair
+	assert.NoError(t, d.Init("96 mpeg4-generic/44100/1", ""))
+	_, err := d.Decode(aus[1])
+	assert.Error(t, err)
+}
+
+func TestAacHuffmanTables(t *testing.T) {
+	codes := append([][]uint32{aacScalefactorCodes}, aacSpectralCodes[:]...)
+	bits := append([][]uint8{aacScalefactorBits}, aacSpectralBits[:]...)
+	for ii := range codes {
+		h := newAacHuffman(codes[ii], bits[ii])
+		kraft := 0
+		for value, code := range codes[ii] {
+			kraft += 1 << (19 - bits[ii][value])
+			b := make([]byte, 4)
+			binary.BigEndian.PutUint32(b, code<<(32-bits[ii][value]))
+			r := &aacBitReader{b: b}
+			assert.Equal(t, value, h.decode(r))
+			assert.Equal(t, int(bits[ii][value]), r.pos)
+		}
+		assert.Equal(t, 1<<19, kraft, "Table %d is not a complete code", ii)
+	}
+}
+
+func TestAacSwbOffsets(t *testing.T) {
+	longBands := []int{41, 41, 47, 49, 49, 51, 47, 47, 43, 43, 43, 40}
+	shortBands := []int{12, 12, 12, 14, 14, 14, 15, 15, 15, 15, 15, 15}
+	for ii := range aacSampleRates {
+		assert.Len(t, aacSwbOffsetLong[ii], longBands[ii]+1)
+		assert.Len(t, aacSwbOffsetShort[ii], shortBands[ii]+1)
+		assert.Equal(t, 1024, aacSwbOffsetLong[ii][longBands[ii]])
+		assert.Equal(t, 128, aacSwbOffsetShort[ii][shortBands[ii]])
+	}
+}
+
+func TestImdct(t *testing.T) {
+	for _, m := range []int{128, 1024} {
+		spec := make([]float64, m)
+		for k := range spec {
+			spec[k] = math.Sin(float64(k*k)) * 1000
+		}
+		out := make([]float64, 2*m)
+		imdct(spec, out)
+		n := float64(2 * m)
+		for ii := range out {
+			x := 0.0
+			for k := range spec {
+				x += spec[k] * math.Cos(2*math.Pi/n*(float64(ii)+(n/2+1)/2)*(float64(k)+0.5))
+			}
+			assert.InDelta(t, 2/n*x, out[ii], 1e-6)
+		}
+	}
+}
@@ -1,57 +1,89 @@
 package raopd
 
 import (
-	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
 	"errors"
-	"io"
+	"fmt"
 	"os"
-	"sync"
 	"time"
-
-	"github.com/maghul/go.alac"
 )
 
-var alacNotInitialized = errors.New("Alac has not been initialized")
-
-type audioStream struct {
-	audioWriter io.Writer
-	ctx         context.Context
-	count       int
-}
+var codecNotInitialized = errors.New("The audio codec has not been initialized")
 
-type audioStreams struct {
+// The decryption and decoding state of a session.
+type audioDecoder struct {
 	audioBuffer []byte
 	mode        cipher.BlockMode
-	aeskey      cipher.Block
+	aeskey      cipher.Block // nil if the stream is not encrypted
 	aesiv       []byte
-	alac        *alac.Alac
-
-	streamsMutex sync.Mutex
-	streams      []*audioStream
+	codec       Decoder
+	conv        *pcmConverter // nil if the audio is written as decoded
+	native      bool          // Write the audio as decoded, see SinkInfo
+	format      StreamFormat  // The format of the audio written
 }
 
 var audiolog = getLogger("raopd.audio", "Audio Output")
 
-func (r *audioStreams) initAlac(rtpmap, fmtpstr string) error {
-	var err error
-	r.alac, err = alac.NewFromFmtp(fmtpstr)
-	return err
+// Create the decoder for the encoding of the rtpmap. The fmtp may be nil
+// if the stream has none.
+func (r *audioDecoder) initCodec(rtpmap *sdpRtpmap, fmtp *sdpFmtp) error {
+	encoding := streamEncoding(rtpmap, fmtp)
+	codec := newDecoder(encoding)
+	if codec == nil {
+		return fmt.Errorf("Unsupported encoding '%s'", encoding)
+	}
+	fmtpstr := ""
+	if fmtp != nil {
+		fmtpstr = fmtp.String()
+	}
+	return r.initDecoder(codec, encoding, rtpmap.String(), fmtpstr)
+}
+
+func (r *audioDecoder) initDecoder(codec Decoder, encoding, rtpmap, fmtp string) error {
+	if err := codec.Init(rtpmap, fmtp); err != nil {
+		return err
+	}
+	if err := checkDecoderFormat(codec); err != nil {
+		return err
+	}
+	r.codec = codec
+	r.format = StreamFormat{encoding, outputSampleRate, outputChannels, 16, binary.LittleEndian}
+	if r.native {
+		r.format.SampleRate = codec.SampleRate()
+		r.format.Channels = codec.Channels()
+		r.format.BitsPerSample = codec.BitDepth()
+		r.conv = nil
+	} else {
+		r.conv = newPcmConverter(codec.SampleRate(), codec.Channels(), codec.BitDepth())
+	}
+	return nil
 }
 
-func (r *audioStreams) newStream(ctx context.Context, w io.Writer) {
-	audiolog.Debug.Println("audioStreams:newStream w=", w)
-	// Sets a timeout count of 10.
-	ns := &audioStream{w, ctx, 10}
+// Decrypt and decode an audio packet. The packet will be reclaimed.
+func (r *audioDecoder) decode(pkt *rtpPacket) []byte {
+	if r.aeskey != nil {
+		r.decrypt(pkt)
+	}
 
-	r.streamsMutex.Lock()
-	defer r.streamsMutex.Unlock()
+	decoded, err := r.codec.Decode(pkt.content[12:])
+	pkt.Reclaim()
+	if err != nil {
+		audiolog.Debug.Println("Could not decode audio: ", err)
+		return nil
+	}
+	if r.conv != nil {
+		decoded = r.conv.convert(decoded)
+	}
+	r.audioBuffer = decoded
 
-	r.streams = append(r.streams, ns)
+	return r.audioBuffer
 }
 
-func (r *audioStreams) handleAudioPacket(pkt *rtpPacket) {
+// Decrypt the payload of an audio packet in place. Any trailing partial
+// block is not encrypted.
+func (r *audioDecoder) decrypt(pkt *rtpPacket) {
 	r.mode = cipher.NewCBCDecrypter(r.aeskey, r.aesiv)
 
 	ciphertext := pkt.content[12:]
@@ -63,43 +95,20 @@ func (r *audioStreams) handleAudioPacket(pkt *rtpPacket) {
 		os.Exit(0)
 	}
 	r.mode.CryptBlocks(ciphertext, ciphertext)
-
-	r.audioBuffer = r.alac.Decode(pkt.content[12:])
-	pkt.Reclaim()
-
-	r.writeToStreams(r.audioBuffer)
 }
 
-const audioTimeout = time.Millisecond
-
-func (r *audioStreams) writeToStreams(b []byte) {
-	r.streamsMutex.Lock()
-	defer r.streamsMutex.Unlock()
-
-	jj := 0
-	for ii, as := range r.streams {
-		ctx := as.ctx
-		select {
-		case <-ctx.Done():
-			audiolog.Debug.Println("Context closed audio output ", as)
-		default:
-			of := as.audioWriter
-			_, err := of.Write(b)
-			if err != nil {
-				audiolog.Debug.Println("Closing audio output ", as, ", on error=", err)
-			} else {
-				r.streams[jj] = r.streams[ii]
-				jj++
-			}
-		}
+func (a *audioDecoder) rtptoms(rtp int64) (int, error) {
+	if a.codec == nil {
+		return 0, codecNotInitialized
 	}
-	r.streams = r.streams[0:jj]
+	sampleRate := a.codec.SampleRate()
+	return int((rtp * 1000) / int64(sampleRate)), nil
 }
 
-func (a *audioStreams) rtptoms(rtp int64) (int, error) {
-	if a.alac == nil {
-		return 0, alacNotInitialized
+func (a *audioDecoder) durationtortp(d time.Duration) (int64, error) {
+	if a.codec == nil {
+		return 0, codecNotInitialized
 	}
-	sampleRate := a.alac.SampleRate()
-	return int((rtp * 1000) / int64(sampleRate)), nil
+	sampleRate := a.codec.SampleRate()
+	return int64(d) * int64(sampleRate) / int64(time.Second), nil
 }
@@ -0,0 +1,225 @@
+package raopd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+/*
+Capture files record the traffic of a Source so it can be replayed with
+SinkCollection.Replay. A capture file starts with the 8 byte magic
+"RAOPCAP1" followed by records until the end of the file. Each record is:
+
+	timestamp  8 bytes  Unix time in nanoseconds when the record was made
+	connection 4 bytes  Identifies the RTSP connection of the record
+	kind       1 byte   The kind of record, see below
+	length     4 bytes  The length of the payload
+	payload    length bytes
+
+All integers are big endian. The kinds of records are:
+
+	1 Open         A new RTSP connection. The payload is the local and
+	               the remote address separated by a newline.
+	2 Request      An RTSP request as text, including any body.
+	3 Response     The RTSP response to the last request as text.
+	4 Data         An RTP packet received on the data port.
+	5 Control      An RTP packet received on the control port.
+	6 Timing       An RTP packet received on the timing port.
+	7 Interleaved  A '$' framed RTP packet received on the RTSP connection.
+	8 Close        The RTSP connection was closed. The payload is the reason.
+*/
+const captureMagic = "RAOPCAP1"
+
+const (
+	captureOpen = iota + 1
+	captureRequest
+	captureResponse
+	captureData
+	captureControl
+	captureTiming
+	captureInterleaved
+	captureClose
+)
+
+type captureRecord struct {
+	timestamp int64
+	conn      uint32
+	kind      byte
+	payload   []byte
+}
+
+// A capture writes records to a capture file. It is safe for use by
+// several go-routines.
+type capture struct {
+	m   sync.Mutex
+	w   io.Writer
+	err error
+}
+
+var capturelog = getLogger("raopd.capture", "Session Capture and Replay")
+
+func newCapture(w io.Writer) (*capture, error) {
+	_, err := io.WriteString(w, captureMagic)
+	if err != nil {
+		return nil, err
+	}
+	return &capture{w: w}, nil
+}
+
+// Write a record. Capturing stops at the first error.
+func (c *capture) record(conn uint32, kind byte, payload []byte) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	header := make([]byte, 17)
+	binary.BigEndian.PutUint64(header[0:8], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(header[8:12], conn)
+	header[12] = kind
+	binary.BigEndian.PutUint32(header[13:17], uint32(len(payload)))
+	_, c.err = c.w.Write(append(header, payload...))
+	if c.err != nil {
+		capturelog.Info.Println("Capture stopped: ", c.err)
+	}
+}
+
+// Read the magic at the start of a capture file
+func readCaptureMagic(r io.Reader) error {
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return err
+	}
+	if string(magic) != captureMagic {
+		return fmt.Errorf("Not a capture file, magic=%q", magic)
+	}
+	return nil
+}
+
+// Read the next record of a capture file. Returns io.EOF at the end of
+// the file.
+func readCaptureRecord(r io.Reader) (*captureRecord, error) {
+	header := make([]byte, 17)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	cr := &captureRecord{}
+	cr.timestamp = int64(binary.BigEndian.Uint64(header[0:8]))
+	cr.conn = binary.BigEndian.Uint32(header[8:12])
+	cr.kind = header[12]
+	length := binary.BigEndian.Uint32(header[13:17])
+	if length > maxRTSPContentLength+maxRTSPLineLength*(maxRTSPHeaders+1) {
+		return nil, fmt.Errorf("Capture record too long, length=%d", length)
+	}
+	cr.payload = make([]byte, length)
+	if _, err := io.ReadFull(r, cr.payload); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return cr, nil
+}
+
+/*
+Capture starts recording all RTSP requests and responses and all RTP
+packets of the source to w, see the capture file format above. Any
+previous capture is stopped. Calling Capture with a nil writer stops
+capturing. Connections which are already open are captured from their
+next request.
+*/
+func (source *Source) Capture(w io.Writer) error {
+	var c *capture
+	if w != nil {
+		var err error
+		c, err = newCapture(w)
+		if err != nil {
+			return err
+		}
+	}
+	source.raop.captureValue.Store(c)
+	return nil
+}
+
+// Returns the active capture of the sink or nil.
+func (r *raop) capture() *capture {
+	c, _ := r.captureValue.Load().(*capture)
+	return c
+}
+
+// Capture a record for the connection if capturing.
+func (rs *rtspSession) capture(kind byte, payload []byte) {
+	if c := rs.raop.capture(); c != nil {
+		c.record(rs.id, kind, payload)
+	}
+}
+
+// Serialize a request as it was received. The body is read and replaced
+// so it can still be read by the handler.
+func encodeRequest(req *http.Request) []byte {
+	b := bytes.NewBufferString("")
+	fmt.Fprintf(b, "%s %s %s/%d.%d\r\n", req.Method, req.RequestURI, req.Proto, req.ProtoMajor, req.ProtoMinor)
+	keys := make([]string, 0, len(req.Header))
+	for key := range req.Header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		for _, value := range req.Header[key] {
+			fmt.Fprintf(b, "%s: %s\r\n", key, value)
+		}
+	}
+	b.WriteString("\r\n")
+
+	body := bytes.NewBufferString("")
+	io.Copy(body, req.Body)
+	b.Write(body.Bytes())
+	req.Body = ioutil.NopCloser(body)
+	return b.Bytes()
+}
+
+// Handle a request and write the response. The request and response are
+// captured if capturing.
+func (rs *rtspSession) serveRequest(wr *bufio.Writer, req *http.Request) {
+	if rs.raop.capture() == nil {
+		rw := newRtspResponseWriter(wr)
+		rs.handle(rw, req)
+		rw.finishResponse()
+		return
+	}
+
+	rs.capture(captureRequest, encodeRequest(req))
+	response := bytes.NewBufferString("")
+	rw := newRtspResponseWriter(bufio.NewWriter(response))
+	rs.handle(rw, req)
+	rw.finishResponse()
+	rs.capture(captureResponse, response.Bytes())
+
+	wr.Write(response.Bytes())
+	wr.Flush()
+}
+
+// Capture that the RTSP connection was opened.
+func (rs *rtspSession) captureOpen() {
+	if rs.c != nil {
+		rs.capture(captureOpen, []byte(fmt.Sprint(rs.c.LocalAddr(), "\n", rs.c.RemoteAddr())))
+	}
+}
+
+// Wrap the handler of an RTP factory to capture all received packets.
+func (s *session) capturing(kind byte, f rtpFactory) rtpFactory {
+	return func(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter, string) {
+		handler, tx, name := f(raddr)
+		return func(pkt *rtpPacket) {
+			s.rs.capture(kind, pkt.content)
+			handler(pkt)
+		}, tx, name
+	}
+}
@@ -0,0 +1,220 @@
+package raopd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureRecord(t *testing.T) {
+	b := bytes.NewBufferString("")
+	c, err := newCapture(b)
+	assert.NoError(t, err)
+	c.record(7, captureRequest, []byte("OPTIONS * RTSP/1.0\r\n\r\n"))
+	c.record(8, captureClose, nil)
+
+	assert.NoError(t, readCaptureMagic(b))
+	cr, err := readCaptureRecord(b)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(7), cr.conn)
+	assert.Equal(t, byte(captureRequest), cr.kind)
+	assert.Equal(t, "OPTIONS * RTSP/1.0\r\n\r\n", string(cr.payload))
+	assert.NotZero(t, cr.timestamp)
+
+	cr, err = readCaptureRecord(b)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(8), cr.conn)
+	assert.Equal(t, byte(captureClose), cr.kind)
+	assert.Empty(t, cr.payload)
+
+	_, err = readCaptureRecord(b)
+	assert.Equal(t, io.EOF, err)
+
+	assert.Error(t, readCaptureMagic(bytes.NewBufferString("RAOPCAP0")))
+}
+
+// Capture a session which announces a stream, receives interleaved RTP and
+// tears the stream down.
+func captureTestSession(t *testing.T) (*rtspSession, []byte) {
+	r := makeTestRtspSession()
+	b := bytes.NewBufferString("")
+	c, err := newCapture(b)
+	assert.NoError(t, err)
+	r.raop.captureValue.Store(c)
+
+	client, server := net.Pipe()
+	r.c = server
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.runRtspServerSession(server)
+	}()
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	encrypted, err := rsa.EncryptOAEP(sha1.New(), rand.Reader, &r.i.key.PublicKey, key, nil)
+	assert.NoError(t, err)
+	sdp := "v=0\r\n" +
+		"o=AirTunes 1234 0 IN IP4 127.0.0.1\r\n" +
+		"s=AirTunes\r\n" +
+		"c=IN IP4 127.0.0.1\r\n" +
+		"t=0 0\r\n" +
+		"m=audio 0 RTP/AVP 96\r\n" +
+		"a=rtpmap:96 AppleLossless\r\n" +
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n" +
+		"a=rsaaeskey:" + base64.StdEncoding.EncodeToString(encrypted) + "\r\n" +
+		"a=aesiv:" + base64.StdEncoding.EncodeToString(make([]byte, 16)) + "\r\n"
+
+	cr := bufio.NewReader(client)
+	cw := bufio.NewWriter(client)
+	resp := raopTxRx(cw, cr, "OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n")
+	assert.Contains(t, resp, "RTSP/1.0 200 OK\r\n")
+	resp = raopTxRx(cw, cr, fmt.Sprintf("ANNOUNCE rtsp://127.0.0.1/1234 RTSP/1.0\r\n"+
+		"Content-Type: application/sdp\r\n"+
+		"Content-Length: %d\r\n"+
+		"CSeq: 2\r\n\r\n%s", len(sdp), sdp))
+	assert.Contains(t, resp, "RTSP/1.0 200 OK\r\n")
+	id := r.s.id
+	resp = raopTxRx(cw, cr, "SETUP rtsp://127.0.0.1/1234 RTSP/1.0\r\n"+
+		"Transport: RTP/AVP/TCP;unicast;interleaved=0-1;mode=record\r\n"+
+		"CSeq: 3\r\n"+
+		"Session: "+id+"\r\n\r\n")
+	assert.Contains(t, resp, "RTSP/1.0 200 OK\r\n")
+	resp = raopTxRx(cw, cr, "RECORD rtsp://127.0.0.1/1234 RTSP/1.0\r\n"+
+		"RTP-Info: seq=7;rtptime=0\r\n"+
+		"CSeq: 4\r\n"+
+		"Session: "+id+"\r\n\r\n")
+	assert.Contains(t, resp, "RTSP/1.0 200 OK\r\n")
+	sync := interleavedFrame(1, testPacket(7, 84).content[:20])
+	resp = raopTxRx(cw, cr, string(sync)+"TEARDOWN rtsp://127.0.0.1/1234 RTSP/1.0\r\n"+
+		"CSeq: 5\r\n"+
+		"Session: "+id+"\r\n\r\n")
+	assert.Contains(t, resp, "RTSP/1.0 200 OK\r\n")
+	client.Close()
+	<-done
+
+	return r, b.Bytes()
+}
+
+func TestCaptureReplay(t *testing.T) {
+	r, captured := captureTestSession(t)
+	r.raop.sink.(*testClient).assertStopped(t, 1, ErrTeardown)
+
+	// Open, 5 requests and responses, the interleaved packet and close
+	kinds := []byte{}
+	rd := bytes.NewReader(captured)
+	assert.NoError(t, readCaptureMagic(rd))
+	for {
+		cr, err := readCaptureRecord(rd)
+		if err != nil {
+			assert.Equal(t, io.EOF, err)
+			break
+		}
+		kinds = append(kinds, cr.kind)
+	}
+	assert.Equal(t, []byte{captureOpen,
+		captureRequest, captureResponse, captureRequest, captureResponse,
+		captureRequest, captureResponse, captureRequest, captureResponse,
+		captureInterleaved, captureRequest, captureResponse, captureClose}, kinds)
+
+	sc := &SinkCollection{i: r.i}
+	tc := makeTestClient().(*testClient)
+	err := sc.Replay(bytes.NewReader(captured), tc, nil)
+	assert.NoError(t, err)
+	tc.assertStopped(t, 1, ErrTeardown)
+}
+
+func TestCaptureReplayMismatch(t *testing.T) {
+	r, captured := captureTestSession(t)
+
+	// Every request is answered with 401 Unauthorized when replaying to a
+	// sink with a password.
+	sc := &SinkCollection{i: r.i}
+	tc := makeTestClient().(*testClient)
+	tc.si.Password = "secret"
+	err := sc.Replay(bytes.NewReader(captured), tc, nil)
+	assert.Error(t, err)
+	tc.assertStopped(t, 0, nil)
+
+	err = sc.Replay(bytes.NewBufferString("RAOPCAP0"), tc, nil)
+	assert.Error(t, err)
+}
+
+// A capture of a source streaming L16 over UDP, with the data packets but
+// without any network.
+func captureUdpTestSession(t *testing.T) []byte {
+	b := bytes.NewBufferString("")
+	c, err := newCapture(b)
+	assert.NoError(t, err)
+
+	sdp := strings.Replace(unencryptedSdp, "a=rtpmap:96 AppleLossless\r\n"+
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n", "a=rtpmap:96 L16/44100/2\r\n", 1)
+	c.record(1, captureOpen, []byte("10.0.0.1:5000\n10.0.0.2:49152"))
+	c.record(1, captureRequest, []byte(announceRequest(sdp)))
+	c.record(1, captureResponse, []byte("RTSP/1.0 200 OK\r\nCSeq: 1\r\n\r\n"))
+	c.record(1, captureRequest, []byte("SETUP rtsp://10.0.0.1/1234 RTSP/1.0\r\n"+
+		"Transport: RTP/AVP/UDP;unicast;mode=record;control_port=6001;timing_port=6002\r\n"+
+		"CSeq: 2\r\n\r\n"))
+	c.record(1, captureResponse, []byte("RTSP/1.0 200 OK\r\nCSeq: 2\r\n\r\n"))
+	c.record(1, captureRequest, []byte("RECORD rtsp://10.0.0.1/1234 RTSP/1.0\r\n"+
+		"RTP-Info: seq=7;rtptime=1000\r\n"+
+		"CSeq: 3\r\n"+
+		"Session: 1\r\n\r\n"))
+	c.record(1, captureResponse, []byte("RTSP/1.0 200 OK\r\nCSeq: 3\r\n\r\n"))
+	for ii := 0; ii < 3; ii++ {
+		b := byte(4 * ii)
+		pkt := audioTestPacket(seqno(7+ii), uint32(1000+ii), b, b+1, b+2, b+3)
+		c.record(1, captureData, pkt.content)
+	}
+	c.record(1, captureRequest, []byte("TEARDOWN rtsp://10.0.0.1/1234 RTSP/1.0\r\n"+
+		"CSeq: 4\r\n"+
+		"Session: 1\r\n\r\n"))
+	c.record(1, captureResponse, []byte("RTSP/1.0 200 OK\r\nCSeq: 4\r\n\r\n"))
+	c.record(1, captureClose, nil)
+	return b.Bytes()
+}
+
+func TestCaptureReplayUdp(t *testing.T) {
+	sc := &SinkCollection{i: makeTestRtspSession().i}
+	tc := makeTestClient().(*testClient)
+	audio := &bytes.Buffer{}
+	err := sc.Replay(bytes.NewReader(captureUdpTestSession(t)), tc, audio)
+	assert.NoError(t, err)
+	tc.assertStopped(t, 1, ErrTeardown)
+
+	// The big endian L16 samples of the data packets
+	assert.Equal(t, []byte{1, 0, 3, 2, 5, 4, 7, 6, 9, 8, 11, 10}, audio.Bytes())
+}
+
+func TestCaptureReplayNoInfo(t *testing.T) {
+	sc := &SinkCollection{i: makeTestRtspSession().i}
+	tc := makeTestClient().(*testClient)
+	tc.si = nil
+	audio := &bytes.Buffer{}
+	err := sc.Replay(bytes.NewReader(captureUdpTestSession(t)), tc, audio)
+	assert.NoError(t, err)
+	tc.assertStopped(t, 1, ErrTeardown)
+	assert.Len(t, audio.Bytes(), 12)
+}
+
+func TestCaptureReplayTargetLatency(t *testing.T) {
+	sc := &SinkCollection{i: makeTestRtspSession().i}
+	tc := makeTestClient().(*testClient)
+	tc.si.TargetLatency = time.Second
+	audio := &bytes.Buffer{}
+	err := sc.Replay(bytes.NewReader(captureUdpTestSession(t)), tc, audio)
+	assert.NoError(t, err)
+	tc.assertStopped(t, 1, ErrTeardown)
+	assert.Equal(t, []byte{1, 0, 3, 2, 5, 4, 7, 6, 9, 8, 11, 10}, audio.Bytes())
+}
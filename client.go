@@ -2,6 +2,7 @@ package raopd
 
 import (
 	"net"
+	"time"
 )
 
 /*
@@ -25,8 +26,63 @@ type SinkInfo struct {
 
 	// The port the RAOP server should start at. Set to 0 to get an ephemeral port selected at random.
 	Port uint16
+
+	// What to do when a source connects while another source is streaming
+	// to the sink. See SessionPolicy.
+	SessionPolicy SessionPolicy
+
+	// If set the sources must use this password to connect to the sink.
+	Password string
+
+	// Stop the stream if no audio data has been received for this long
+	// while playing. Zero disables the timeout.
+	DataTimeout time.Duration
+
+	// Stop the stream if the source has not sent any RTSP request, such as
+	// the OPTIONS or GET_PARAMETER keepalives, for this long. Zero disables
+	// the timeout.
+	KeepaliveTimeout time.Duration
+
+	// Close RTSP connections which have been idle for this long. Zero
+	// disables the timeout.
+	IdleTimeout time.Duration
+
+	// The latency of the audio output, reported to the sources so they can
+	// synchronize video and other speakers with the sink. Zero will report
+	// the default latency of 11025 samples, 250ms at 44100 samples/second.
+	AudioLatency time.Duration
+
+	// Write the audio to the audio streams in the format of the stream
+	// instead of converting it to 16 bit stereo at 44100 samples/second.
+	// The format is given to a SinkFormatHandler when a stream is
+	// announced.
+	NativeAudioFormat bool
+
+	// Hold the audio in a jitter buffer until this long after the source
+	// sent it, usually 2 seconds, and write it to the audio streams at real
+	// time pace. Silence is written if the buffer runs empty. Zero writes
+	// the audio as soon as it has been received and decoded.
+	TargetLatency time.Duration
+
+	// The audio written in place of packets lost in the network.
+	LossConcealment Concealment
 }
 
+/*
+SessionPolicy decides what happens when a second source tries to stream to
+a sink which already has an active source.
+*/
+type SessionPolicy int
+
+const (
+	// Reject the new source with 453 Not Enough Bandwidth. This is the default.
+	RejectNewSession SessionPolicy = iota
+
+	// Stop the active source, calling Stopped on the sink, and let the
+	// new source take over the sink.
+	PreemptSession
+)
+
 /*
 AirplaySink is the interface necessary to implement to act as an Airplay output device.
 This interface should be registered with the AirplaySinkCollection and will then be
@@ -74,3 +130,57 @@ type Sink interface {
 	// Called when the sink has been closed and removed
 	Closed()
 }
+
+/*
+SinkRejectionHandler may optionally be implemented by a Sink to be told when
+a request from a source is rejected. The RTSPError contains the status code
+that was sent to the source and the reason for the rejection.
+*/
+type SinkRejectionHandler interface {
+	Rejected(err *RTSPError)
+}
+
+/*
+SinkStopHandler may optionally be implemented by a Sink to be told why a
+stream was stopped. If implemented StoppedWithReason is called instead of
+Stopped. The reason is one of ErrTeardown, ErrPreempted, ErrReannounced,
+ErrDisconnected, ErrShutdown, ErrDataTimeout, ErrKeepaliveTimeout,
+ErrIdleTimeout or an RTSPError.
+*/
+type SinkStopHandler interface {
+	StoppedWithReason(reason error)
+}
+
+/*
+SinkFlushHandler may optionally be implemented by a Sink to be told when the
+source flushes the stream, which happens when the user skips or seeks. Any
+audio written to the audio writers but not yet played should be discarded.
+*/
+type SinkFlushHandler interface {
+	Flush()
+}
+
+/*
+SinkParameterHandler may optionally be implemented by a Sink to handle text
+parameters of GET_PARAMETER and SET_PARAMETER which raopd does not handle
+itself, such as vendor specific parameters. Parameters handled by raopd,
+e.g. "volume" and "progress", are never passed to the sink.
+*/
+type SinkParameterHandler interface {
+	// GetParameter returns the value of the parameter or false if the
+	// sink does not know the parameter.
+	GetParameter(name string) (value string, ok bool)
+
+	// SetParameter is called for each parameter set by the source. If an
+	// error is returned the request is answered with 400 Bad Request.
+	SetParameter(name, value string) error
+}
+
+/*
+SinkFormatHandler may optionally be implemented by a Sink to be told the
+format of the audio written to the audio streams when a source announces a
+stream. It is called before any audio of the stream is written.
+*/
+type SinkFormatHandler interface {
+	SetStreamFormat(format StreamFormat)
+}
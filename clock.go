@@ -0,0 +1,246 @@
+package raopd
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+var clocklog = getLogger("raopd.clock", "Clock Synchronisation")
+
+// An NTP timestamp, seconds since 1900 as 32.32 fixed point.
+type ntpTime uint64
+
+// Seconds from the NTP epoch, 1900, to the Unix epoch
+const ntpEpochOffset = 2208988800
+
+func toNtpTime(t time.Time) ntpTime {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return ntpTime(secs<<32 | frac)
+}
+
+// The wall clock time of the NTP timestamp.
+func (n ntpTime) Time() time.Time {
+	secs := int64(n>>32) - ntpEpochOffset
+	nsec := int64(uint64(n&0xffffffff) * uint64(time.Second) >> 32)
+	return time.Unix(secs, nsec)
+}
+
+// Returns n - m as a duration.
+func (n ntpTime) Sub(m ntpTime) time.Duration {
+	d := int64(n - m) // Wraps correctly for differences below 2^31 seconds
+	secs := d >> 32
+	frac := uint64(d & 0xffffffff)
+	return time.Duration(secs)*time.Second + time.Duration(frac*uint64(time.Second)>>32)
+}
+
+func decodeNtpTime(b []byte) ntpTime {
+	return ntpTime(binary.BigEndian.Uint64(b))
+}
+
+func (n ntpTime) encode(b []byte) {
+	binary.BigEndian.PutUint64(b, uint64(n))
+}
+
+// An offset measured by a timing request and response.
+type timingSample struct {
+	local  time.Time     // When the response was received
+	offset time.Duration // The source clock minus the local clock
+	rtt    time.Duration
+}
+
+// The number of timing samples used to estimate the offset and drift
+const timingSamples = 8
+
+/*
+clockSync relates the RTP timestamps of a stream to the local clock.
+
+Sync packets on the control channel map an RTP timestamp to the NTP time of
+the source clock. Timing requests on the timing channel measure the offset
+of the source clock from the local clock, as in NTP. The offset is taken from
+the sample with the lowest round trip time of the last samples and the drift
+is the slope of the offsets over time. Without timing samples, e.g. when the
+RTP is interleaved on the RTSP connection, the offset is estimated from the
+arrival of the sync packets.
+*/
+type clockSync struct {
+	m sync.Mutex
+
+	// The latest sync packet
+	synced     bool
+	syncRtp    uint32 // The RTP timestamp of the frame played at syncNtp
+	syncNtp    ntpTime
+	syncLocal  time.Time // When the sync packet was received
+	rtpLatency uint32    // The latency of the source in RTP samples
+
+	samples []timingSample
+	offset  timingSample // The best sample
+	drift   float64      // Source clock rate relative to the local, minus 1
+}
+
+// Handle a sync packet, RTP payload type 84. The packet gives the NTP time
+// of the source when the next packet is sent, which is played the latency
+// later. So the frame of the RTP timestamp less the latency plays at the
+// NTP time.
+func (c *clockSync) handleSync(content []byte, received time.Time) {
+	if len(content) < 20 {
+		clocklog.Debug.Println("Sync packet too short, length=", len(content))
+		return
+	}
+	lessLatency := binary.BigEndian.Uint32(content[4:8])
+	ntp := decodeNtpTime(content[8:16])
+	rtptime := binary.BigEndian.Uint32(content[16:20])
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.synced = true
+	c.syncRtp = lessLatency
+	c.syncNtp = ntp
+	c.syncLocal = received
+	c.rtpLatency = rtptime - lessLatency
+	clocklog.Debug.Println("Sync rtptime=", rtptime, ", ntp=", ntp.Time(), ", latency=", c.rtpLatency)
+}
+
+// Handle a timing response, RTP payload type 83, received at the local time.
+func (c *clockSync) handleTimingResponse(content []byte, received time.Time) {
+	if len(content) < 32 {
+		clocklog.Debug.Println("Timing response too short, length=", len(content))
+		return
+	}
+	origin := decodeNtpTime(content[8:16])   // When the request was sent
+	receive := decodeNtpTime(content[16:24]) // When the source received it
+	transmit := decodeNtpTime(content[24:32])
+	arrival := toNtpTime(received)
+
+	sample := timingSample{local: received}
+	sample.offset = (receive.Sub(origin) + transmit.Sub(arrival)) / 2
+	sample.rtt = arrival.Sub(origin) - transmit.Sub(receive)
+	if sample.rtt < 0 {
+		clocklog.Debug.Println("Ignoring timing response with negative rtt=", sample.rtt)
+		return
+	}
+	c.addSample(sample)
+}
+
+func (c *clockSync) addSample(sample timingSample) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	c.samples = append(c.samples, sample)
+	if len(c.samples) > timingSamples {
+		c.samples = c.samples[1:]
+	}
+	c.offset = c.samples[0]
+	for _, s := range c.samples[1:] {
+		if s.rtt <= c.offset.rtt {
+			c.offset = s
+		}
+	}
+	c.drift = driftOf(c.samples)
+	clocklog.Debug.Println("Timing offset=", sample.offset, ", rtt=", sample.rtt, ", best offset=", c.offset.offset, ", drift=", c.drift)
+}
+
+// The least squares slope of the offsets over local time.
+func driftOf(samples []timingSample) float64 {
+	if len(samples) < 2 {
+		return 0
+	}
+	t0 := samples[0].local
+	var sx, sy, sxx, sxy float64
+	for _, s := range samples {
+		x := s.local.Sub(t0).Seconds()
+		y := s.offset.Seconds()
+		sx += x
+		sy += y
+		sxx += x * x
+		sxy += x * y
+	}
+	n := float64(len(samples))
+	d := n*sxx - sx*sx
+	if d < 1e-6 {
+		return 0
+	}
+	return (n*sxy - sx*sy) / d
+}
+
+// Returns the offset of the source clock from the local clock at the local
+// time. Must be called with the lock held.
+func (c *clockSync) offsetAt(local time.Time) time.Duration {
+	if len(c.samples) == 0 {
+		return c.syncNtp.Time().Sub(c.syncLocal)
+	}
+	correction := c.drift * local.Sub(c.offset.local).Seconds()
+	return c.offset.offset + time.Duration(correction*float64(time.Second))
+}
+
+/*
+Returns the local time at which the frame with the RTP timestamp is played
+by the source, or false if there has been no sync packet yet. The time has a
+monotonic clock reading, so it can be compared with time.Now. The rate is
+the sample rate of the RTP timestamps.
+*/
+func (c *clockSync) localTime(rtptime uint32, rate int) (time.Time, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.localTimeLocked(rtptime, rate)
+}
+
+// Returns the local time at which the source sent the frame with the RTP
+// timestamp, the time it is played less the latency of the source.
+func (c *clockSync) sendTime(rtptime uint32, rate int) (time.Time, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.localTimeLocked(rtptime-c.rtpLatency, rate)
+}
+
+func (c *clockSync) localTimeLocked(rtptime uint32, rate int) (time.Time, bool) {
+	if !c.synced || rate <= 0 {
+		return time.Time{}, false
+	}
+	// The source time of the frame relative to the sync packet
+	frames := int64(int32(rtptime - c.syncRtp))
+	fromSync := time.Duration(frames) * time.Second / time.Duration(rate)
+	fromSync = time.Duration(float64(fromSync) / (1 + c.drift))
+
+	// The local time of the sync NTP time. The local time has a monotonic
+	// clock reading as it is based on syncLocal.
+	syncAt := c.syncLocal.Add(c.syncNtp.Time().Sub(c.syncLocal) - c.offsetAt(c.syncLocal))
+	return syncAt.Add(fromSync), true
+}
+
+// Returns the estimated offset and drift of the source clock and false if
+// there are no timing samples.
+func (c *clockSync) estimate() (offset time.Duration, drift float64, ok bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if len(c.samples) == 0 {
+		return 0, 0, false
+	}
+	return c.offsetAt(time.Now()), c.drift, true
+}
+
+// The latency of the source in RTP samples given by the last sync packet.
+func (c *clockSync) latency() uint32 {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.rtpLatency
+}
+
+// How often timing requests are sent
+const timingInterval = 3 * time.Second
+
+// Encode a timing request, RTP payload type 82, sent at the local time.
+func encodeTimingRequest(buf []byte, sn seqno, sent time.Time) []byte {
+	buf = buf[:32]
+	for ii := range buf {
+		buf[ii] = 0
+	}
+	buf[0] = 0x80
+	buf[1] = 82 + 0x80
+	sn.encode(buf[2:4])
+	toNtpTime(sent).encode(buf[24:32])
+	return buf
+}
@@ -0,0 +1,132 @@
+package raopd
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNtpTime(t *testing.T) {
+	now := time.Unix(1500000000, 250000000)
+	n := toNtpTime(now)
+	assert.Equal(t, uint64(1500000000+ntpEpochOffset), uint64(n>>32))
+	assert.Equal(t, uint64(1)<<30, uint64(n&0xffffffff))
+	assert.Equal(t, now, n.Time())
+
+	later := toNtpTime(now.Add(1500 * time.Millisecond))
+	assert.Equal(t, 1500*time.Millisecond, later.Sub(n))
+	assert.Equal(t, -1500*time.Millisecond, n.Sub(later))
+}
+
+func syncPacket(rtptime, latency uint32, ntp ntpTime) []byte {
+	b := make([]byte, 20)
+	b[0] = 0x90
+	b[1] = 84 + 0x80
+	binary.BigEndian.PutUint32(b[4:8], rtptime-latency)
+	ntp.encode(b[8:16])
+	binary.BigEndian.PutUint32(b[16:20], rtptime)
+	return b
+}
+
+// A timing response from a source with a clock offset from the local clock,
+// with the request and response each taking delay.
+func timingResponse(sent time.Time, offset, delay time.Duration) ([]byte, time.Time) {
+	b := make([]byte, 32)
+	b[0] = 0x80
+	b[1] = 83 + 0x80
+	toNtpTime(sent).encode(b[8:16])
+	toNtpTime(sent.Add(delay + offset)).encode(b[16:24])
+	toNtpTime(sent.Add(delay + offset)).encode(b[24:32])
+	return b, sent.Add(2 * delay)
+}
+
+func TestClockSyncWithoutTiming(t *testing.T) {
+	var c clockSync
+	_, ok := c.localTime(0, 44100)
+	assert.False(t, ok)
+
+	// The offset is taken from the arrival of the sync packet
+	now := time.Now()
+	c.handleSync(syncPacket(100000, 11025, toNtpTime(now.Add(time.Hour))), now)
+	assert.Equal(t, uint32(11025), c.latency())
+	_, _, ok = c.estimate()
+	assert.False(t, ok)
+
+	at, ok := c.localTime(100000-11025, 44100)
+	assert.True(t, ok)
+	assert.Equal(t, now, at)
+
+	// The frame of the sync packet is played the latency later
+	at, _ = c.localTime(100000, 44100)
+	assert.Equal(t, now.Add(250*time.Millisecond), at)
+	at, _ = c.localTime(100000+44100, 44100)
+	assert.Equal(t, now.Add(1250*time.Millisecond), at)
+	at, _ = c.localTime(100000-11025-22050, 44100)
+	assert.Equal(t, now.Add(-500*time.Millisecond), at)
+
+	// RTP timestamps wrap
+	c.handleSync(syncPacket(0xffffffff-4409, 0, toNtpTime(now.Add(time.Hour))), now)
+	at, _ = c.localTime(0, 44100)
+	assert.Equal(t, now.Add(100*time.Millisecond), at)
+}
+
+func TestClockSyncTiming(t *testing.T) {
+	var c clockSync
+	start := time.Now()
+	offset := 5 * time.Second
+
+	// The sample with the least delay gives the offset
+	delays := []time.Duration{20, 5, 30, 10}
+	for ii, delay := range delays {
+		sent := start.Add(time.Duration(ii) * timingInterval)
+		b, received := timingResponse(sent, offset+delay*time.Millisecond/10, delay*time.Millisecond)
+		c.handleTimingResponse(b, received)
+	}
+	assert.Len(t, c.samples, len(delays))
+	// The NTP timestamps are truncated to their resolution
+	assert.InDelta(t, float64(10*time.Millisecond), float64(c.offset.rtt), float64(time.Microsecond))
+
+	// The sync packet arrives late, the timing gives the offset
+	c.handleSync(syncPacket(1000, 0, toNtpTime(start.Add(offset))), start.Add(time.Second))
+	at, ok := c.localTime(1000+44100, 44100)
+	assert.True(t, ok)
+	assert.InDelta(t, 0, float64(at.Sub(start.Add(time.Second))), float64(5*time.Millisecond))
+
+	// Negative round trips are ignored, the source took longer than the round trip
+	b, received := timingResponse(start, offset, time.Millisecond)
+	toNtpTime(start.Add(offset + 10*time.Millisecond)).encode(b[24:32])
+	c.handleTimingResponse(b, received)
+	assert.Len(t, c.samples, len(delays))
+
+	// Short packets are ignored
+	c.handleTimingResponse(b[:20], start)
+	c.handleSync(b[:12], start)
+	assert.Len(t, c.samples, len(delays))
+}
+
+func TestClockSyncDrift(t *testing.T) {
+	var c clockSync
+	start := time.Now()
+
+	// The source clock runs 100ppm fast
+	for ii := 0; ii < timingSamples+4; ii++ {
+		local := start.Add(time.Duration(ii) * timingInterval)
+		offset := time.Duration(float64(local.Sub(start)) * 100e-6)
+		b, received := timingResponse(local, offset, time.Millisecond)
+		c.handleTimingResponse(b, received)
+	}
+	assert.Len(t, c.samples, timingSamples)
+	_, drift, ok := c.estimate()
+	assert.True(t, ok)
+	assert.InDelta(t, 100e-6, drift, 1e-6)
+}
+
+func TestEncodeTimingRequest(t *testing.T) {
+	now := time.Now()
+	b := encodeTimingRequest(make([]byte, 40), seqno(7), now)
+	assert.Len(t, b, 32)
+	assert.Equal(t, []byte{0x80, 0xd2, 0, 7}, b[:4])
+	assert.Equal(t, toNtpTime(now), decodeNtpTime(b[24:32]))
+}
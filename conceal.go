@@ -0,0 +1,177 @@
+package raopd
+
+import "sync"
+
+var conceallog = getLogger("raopd.conceal", "Packet Loss Concealment")
+
+/*
+Concealment decides the audio written in place of packets which were lost,
+i.e. not received even after resend requests. The audio of the lost packets
+is always replaced with audio of the same length to keep the timeline of
+the stream.
+*/
+type Concealment int
+
+const (
+	// Write silence for the lost packets. This is the default.
+	ConcealSilence Concealment = iota
+
+	// Repeat the last frame received before the lost packets.
+	ConcealRepeat
+
+	// Crossfade from the last frame received before the lost packets to the
+	// first frame received after them.
+	ConcealCrossfade
+)
+
+// Gaps longer than this, in seconds, are not concealed
+const maxConcealment = 1
+
+/*
+concealer inserts audio for the packets the sequencer gave up on. The lost
+packets are reported by the sequencer before the packet following them is
+output, so the length of the gap is known from the RTP timestamps when that
+packet is decoded.
+*/
+type concealer struct {
+	mode    Concealment
+	format  StreamFormat // The format of the audio
+	rtpRate int          // The sample rate of the RTP timestamps
+
+	m        sync.Mutex
+	started  bool
+	last     []byte // The last frame written
+	expected uint32 // The RTP timestamp following the last frame
+	lost     int    // Packets lost since the last frame
+
+	concealed int // Frames written in place of lost packets
+}
+
+func newConcealer(mode Concealment, format StreamFormat, rtpRate int) *concealer {
+	return &concealer{mode: mode, format: format, rtpRate: rtpRate}
+}
+
+// Note packets lost before the next frame.
+func (c *concealer) lostPackets(count int) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.lost += count
+}
+
+// Forget the last frame, the stream does not continue from it.
+func (c *concealer) reset() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.started = false
+	c.lost = 0
+}
+
+// Returns the number of frames written in place of lost packets.
+func (c *concealer) concealedFrames() int {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.concealed
+}
+
+/*
+Returns the frames to write in place of the packets lost before the frame,
+one per lost packet. The frame is remembered as the last frame.
+*/
+func (c *concealer) conceal(frame AudioFrame) []AudioFrame {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	var frames []AudioFrame
+	if c.started && c.lost > 0 {
+		frames = c.fill(frame)
+	}
+	c.lost = 0
+	c.started = true
+	c.last = append(c.last[:0], frame.Audio...)
+	samples := len(frame.Audio) / c.format.frameSize()
+	c.expected = frame.RtpTime + uint32(int64(samples)*int64(c.rtpRate)/int64(c.format.SampleRate))
+	return frames
+}
+
+func (c *concealer) fill(next AudioFrame) []AudioFrame {
+	gap := int64(int32(next.RtpTime - c.expected))
+	if gap <= 0 || gap > int64(maxConcealment*c.rtpRate) {
+		conceallog.Debug.Println("Not concealing ", c.lost, " lost packets, gap=", gap)
+		return nil
+	}
+	conceallog.Debug.Println("Concealing ", c.lost, " lost packets, rtptime=", c.expected, ", gap=", gap)
+
+	// The concealment is built in one piece, to crossfade over the whole
+	// gap, and then split into a frame per lost packet
+	samples := int(gap * int64(c.format.SampleRate) / int64(c.rtpRate))
+	audio := c.audio(samples, next.Audio)
+
+	count := c.lost
+	if count > samples {
+		count = samples
+	}
+	frames := make([]AudioFrame, 0, count)
+	size := c.format.frameSize()
+	offset := 0
+	for ii := 0; ii < count; ii++ {
+		n := samples / count
+		if ii == count-1 {
+			n = samples - offset
+		}
+		rtptime := c.expected + uint32(int64(offset)*int64(c.rtpRate)/int64(c.format.SampleRate))
+		frames = append(frames, AudioFrame{Audio: audio[offset*size : (offset+n)*size], RtpTime: rtptime})
+		offset += n
+	}
+	c.concealed += len(frames)
+	return frames
+}
+
+// Returns samples of audio to conceal a gap before the next audio.
+func (c *concealer) audio(samples int, next []byte) []byte {
+	size := c.format.frameSize()
+	audio := make([]byte, samples*size)
+	if len(c.last) < size || c.mode == ConcealSilence {
+		return audio
+	}
+	repeat := func(b []byte) {
+		for ii := 0; ii < len(audio); ii += len(b) {
+			copy(audio[ii:], b)
+		}
+	}
+	if c.mode == ConcealRepeat || len(next) < size {
+		repeat(c.last[:len(c.last)/size*size])
+		return audio
+	}
+
+	// Crossfade linearly from the repeated last frame to the repeated next
+	// frame
+	bytes := c.format.BitsPerSample / 8
+	last := c.last[:len(c.last)/size*size]
+	next = next[:len(next)/size*size]
+	for s := 0; s < samples; s++ {
+		for ch := 0; ch < c.format.Channels; ch++ {
+			o := s*size + ch*bytes
+			a := int64(readSample(last[(s*size)%len(last)+ch*bytes:], bytes))
+			b := int64(readSample(next[(s*size)%len(next)+ch*bytes:], bytes))
+			writeSample(audio[o:], bytes, int32(a+(b-a)*int64(s)/int64(samples)))
+		}
+	}
+	return audio
+}
+
+// Read a signed little endian sample of 1 to 4 bytes.
+func readSample(b []byte, bytes int) int32 {
+	var v uint32
+	for ii := bytes - 1; ii >= 0; ii-- {
+		v = v<<8 | uint32(b[ii])
+	}
+	shift := uint(32 - 8*bytes)
+	return int32(v<<shift) >> shift
+}
+
+// Write a signed little endian sample of 1 to 4 bytes.
+func writeSample(b []byte, bytes int, v int32) {
+	for ii := 0; ii < bytes; ii++ {
+		b[ii] = byte(v >> uint(8*ii))
+	}
+}
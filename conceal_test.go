@@ -0,0 +1,134 @@
+package raopd
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var concealTestFormat = StreamFormat{EncodingL16, 44100, 1, 16, nil}
+
+// A frame of 4 mono samples
+func concealTestFrame(rtptime uint32, samples ...int16) AudioFrame {
+	audio := make([]byte, 0, 2*len(samples))
+	for _, s := range samples {
+		audio = append(audio, byte(s), byte(uint16(s)>>8))
+	}
+	return AudioFrame{Audio: audio, RtpTime: rtptime}
+}
+
+func concealedAudio(frames []AudioFrame) (rtptimes []uint32, samples []int16) {
+	for _, f := range frames {
+		rtptimes = append(rtptimes, f.RtpTime)
+		for ii := 0; ii < len(f.Audio); ii += 2 {
+			samples = append(samples, int16(readSample(f.Audio[ii:], 2)))
+		}
+	}
+	return
+}
+
+func TestConcealSilence(t *testing.T) {
+	c := newConcealer(ConcealSilence, concealTestFormat, 44100)
+	assert.Empty(t, c.conceal(concealTestFrame(100, 1, 2, 3, 4)))
+	assert.Empty(t, c.conceal(concealTestFrame(104, 5, 6, 7, 8)))
+
+	c.lostPackets(2)
+	frames := c.conceal(concealTestFrame(116, 9, 10, 11, 12))
+	rtptimes, samples := concealedAudio(frames)
+	assert.Equal(t, []uint32{108, 112}, rtptimes)
+	assert.Equal(t, []int16{0, 0, 0, 0, 0, 0, 0, 0}, samples)
+	assert.Equal(t, 2, c.concealedFrames())
+
+	// Nothing is concealed without lost packets or after a reset
+	assert.Empty(t, c.conceal(concealTestFrame(124, 1, 2, 3, 4)))
+	c.lostPackets(1)
+	c.reset()
+	assert.Empty(t, c.conceal(concealTestFrame(200, 1, 2, 3, 4)))
+
+	// Or if the gap is too long
+	c.lostPackets(1)
+	assert.Empty(t, c.conceal(concealTestFrame(200+2*44100, 1, 2, 3, 4)))
+	assert.Equal(t, 2, c.concealedFrames())
+}
+
+func TestConcealRepeat(t *testing.T) {
+	c := newConcealer(ConcealRepeat, concealTestFormat, 44100)
+	c.conceal(concealTestFrame(100, 1, 2, 3, 4))
+	c.lostPackets(1)
+	rtptimes, samples := concealedAudio(c.conceal(concealTestFrame(110, 5, 6, 7, 8)))
+	assert.Equal(t, []uint32{104}, rtptimes)
+	assert.Equal(t, []int16{1, 2, 3, 4, 1, 2}, samples)
+	assert.Equal(t, 1, c.concealedFrames())
+}
+
+func TestConcealCrossfade(t *testing.T) {
+	c := newConcealer(ConcealCrossfade, concealTestFormat, 44100)
+	c.conceal(concealTestFrame(100, 1000, 1000, 1000, 1000))
+	c.lostPackets(2)
+	rtptimes, samples := concealedAudio(c.conceal(concealTestFrame(108, -1000, -1000, -1000, -1000)))
+	assert.Equal(t, []uint32{104, 106}, rtptimes)
+	assert.Equal(t, []int16{1000, 500, 0, -500}, samples)
+}
+
+func TestConcealSampleFormats(t *testing.T) {
+	b := make([]byte, 4)
+	for _, bytes := range []int{1, 2, 3, 4} {
+		for _, v := range []int32{0, 1, -1, 100, -100} {
+			writeSample(b, bytes, v)
+			assert.Equal(t, v, readSample(b, bytes))
+		}
+	}
+	writeSample(b, 3, -8388608)
+	assert.Equal(t, []byte{0, 0, 0x80}, b[:3])
+}
+
+func TestSequencerLost(t *testing.T) {
+	s := &sequencer{}
+	s.restartSequencer()
+	var lost []seqno
+	s.lostf = func(start, count seqno) {
+		lost = append(lost, start, count)
+	}
+	outf := func(pkt *rtpPacket) {}
+	rrc := make(chan rerequest, 10)
+	s.lowd = true
+	s.low = 10
+	s.handle(testPacket(13, 0), outf)
+	for ii := 0; ii < 37; ii++ {
+		s.sendReRequests(rrc)
+	}
+	assert.Equal(t, []seqno{10, 3}, lost)
+	assert.Equal(t, seqno(13), s.low)
+}
+
+func TestSessionConcealment(t *testing.T) {
+	source, rs, fc := makeFormatTestSource()
+	fc.si.NativeAudioFormat = true
+	fc.si.LossConcealment = ConcealRepeat
+
+	sdp := strings.Replace(unencryptedSdp, "a=rtpmap:96 AppleLossless\r\n"+
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n", "a=rtpmap:96 L16/44100/2\r\n", 1)
+	resp, err := request(rs, announceRequest(sdp))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+
+	tw := &timedTestWriter{}
+	source.NewAudioStream(context.Background(), tw)
+
+	rs.s.handleAudioPacket(audioTestPacket(1, 1000, 0x01, 0x02, 0x03, 0x04))
+	rs.s.lostPackets(2, 2)
+	rs.s.handleAudioPacket(audioTestPacket(4, 1003, 0x05, 0x06, 0x07, 0x08))
+	rs.s.sync()
+
+	assert.Len(t, tw.frames, 4)
+	assert.Equal(t, uint32(1001), tw.frames[1].RtpTime)
+	assert.Equal(t, []byte{0x02, 0x01, 0x04, 0x03}, tw.frames[1].Audio)
+	assert.Equal(t, uint32(1002), tw.frames[2].RtpTime)
+	assert.Equal(t, []byte{0x02, 0x01, 0x04, 0x03}, tw.frames[2].Audio)
+
+	stats, ok := source.StreamStats()
+	assert.True(t, ok)
+	assert.Equal(t, 2, stats.ConcealedFrames)
+}
@@ -0,0 +1,108 @@
+package raopd
+
+// The output format of all streams, see NewAudioStream.
+const (
+	outputSampleRate = 44100
+	outputChannels   = 2
+)
+
+type outputFrame [outputChannels]int16
+
+// pcmConverter converts decoded audio to the output format. The first two
+// channels are kept, mono is converted to stereo, samples are truncated or
+// extended to 16 bits and other sample rates are resampled by linear
+// interpolation.
+type pcmConverter struct {
+	rate     int
+	channels int
+	bytes    int // Bytes per sample
+	buf      []byte
+
+	// Resampling state. pos is the position of the next output frame
+	// in input frames times outputSampleRate, counted from prev which is
+	// the last frame of the previous block.
+	prev    outputFrame
+	pos     int
+	started bool
+}
+
+func newPcmConverter(rate, channels, bitDepth int) *pcmConverter {
+	return &pcmConverter{rate: rate, channels: channels, bytes: bitDepth / 8}
+}
+
+// Returns true if the input already is in the output format.
+func (c *pcmConverter) passthrough() bool {
+	return c.rate == outputSampleRate && c.channels == outputChannels && c.bytes == 2
+}
+
+// Returns the sample as 16 bits. The most significant bytes of wider
+// samples are kept.
+func (c *pcmConverter) sample(in []byte) int16 {
+	switch c.bytes {
+	case 1:
+		return int16(int8(in[0])) << 8
+	default:
+		msb := c.bytes - 1
+		return int16(uint16(in[msb-1]) | uint16(in[msb])<<8)
+	}
+}
+
+// Returns input frame n as an output frame.
+func (c *pcmConverter) frame(in []byte, n int) (f outputFrame) {
+	offset := n * c.bytes * c.channels
+	f[0] = c.sample(in[offset:])
+	if c.channels > 1 {
+		f[1] = c.sample(in[offset+c.bytes:])
+	} else {
+		f[1] = f[0]
+	}
+	return
+}
+
+func (c *pcmConverter) output(f outputFrame) {
+	c.buf = append(c.buf, byte(f[0]), byte(uint16(f[0])>>8), byte(f[1]), byte(uint16(f[1])>>8))
+}
+
+// Convert a block of decoded audio. A trailing partial frame is dropped.
+// The returned slice is reused by the next call.
+func (c *pcmConverter) convert(in []byte) []byte {
+	if c.passthrough() {
+		return in
+	}
+	frames := len(in) / (c.bytes * c.channels)
+	c.buf = c.buf[:0]
+	if frames == 0 {
+		return c.buf
+	}
+	if c.rate == outputSampleRate {
+		for n := 0; n < frames; n++ {
+			c.output(c.frame(in, n))
+		}
+		return c.buf
+	}
+
+	if !c.started {
+		c.prev = c.frame(in, 0)
+		c.started = true
+	}
+	// Frame 0 is prev, frame n is input frame n-1
+	get := func(n int) outputFrame {
+		if n == 0 {
+			return c.prev
+		}
+		return c.frame(in, n-1)
+	}
+	for ; c.pos/outputSampleRate < frames; c.pos += c.rate {
+		n := c.pos / outputSampleRate
+		frac := int64(c.pos % outputSampleRate)
+		a, b := get(n), get(n+1)
+		var f outputFrame
+		for ch := range f {
+			f[ch] = int16(int64(a[ch]) + (int64(b[ch])-int64(a[ch]))*frac/outputSampleRate)
+		}
+		c.output(f)
+	}
+	c.pos -= frames * outputSampleRate
+	c.prev = c.frame(in, frames-1)
+	return c.buf
+}
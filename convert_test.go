@@ -0,0 +1,72 @@
+package raopd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func pcmMonoSamples(samples ...int16) []byte {
+	b := []byte{}
+	for _, s := range samples {
+		b = append(b, byte(s), byte(uint16(s)>>8))
+	}
+	return b
+}
+
+// Returns the left channel of output frames
+func pcmLeft(out []byte) []int16 {
+	samples := []int16{}
+	for ii := 0; ii+3 < len(out); ii += 4 {
+		samples = append(samples, int16(uint16(out[ii])|uint16(out[ii+1])<<8))
+	}
+	return samples
+}
+
+func TestConvertPassthrough(t *testing.T) {
+	c := newPcmConverter(44100, 2, 16)
+	in := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	assert.Equal(t, in, c.convert(in))
+}
+
+func TestConvertChannels(t *testing.T) {
+	c := newPcmConverter(44100, 1, 16)
+	assert.Equal(t, []byte{0x02, 0x01, 0x02, 0x01, 0x04, 0x03, 0x04, 0x03},
+		c.convert([]byte{0x02, 0x01, 0x04, 0x03, 0x05}))
+
+	// Only the first two channels are kept
+	c = newPcmConverter(44100, 3, 16)
+	assert.Equal(t, []byte{1, 2, 3, 4, 7, 8, 9, 10},
+		c.convert([]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}))
+}
+
+func TestConvertBitDepth(t *testing.T) {
+	c := newPcmConverter(44100, 2, 24)
+	assert.Equal(t, []byte{0x02, 0x03, 0x05, 0x06}, c.convert([]byte{1, 2, 3, 4, 5, 6}))
+
+	c = newPcmConverter(44100, 2, 32)
+	assert.Equal(t, []byte{0x03, 0x04, 0x07, 0x08}, c.convert([]byte{1, 2, 3, 4, 5, 6, 7, 8}))
+
+	c = newPcmConverter(44100, 1, 8)
+	assert.Equal(t, []int16{-256, 127 << 8}, pcmLeft(c.convert([]byte{0xff, 0x7f})))
+}
+
+func TestConvertResample(t *testing.T) {
+	c := newPcmConverter(22050, 1, 16)
+
+	// Every input frame becomes two output frames, the first frame is
+	// repeated as there is nothing to interpolate from.
+	out := c.convert(pcmMonoSamples(0, 100, 200))
+	assert.Equal(t, []int16{0, 0, 0, 50, 100, 150}, pcmLeft(out))
+
+	// Interpolation continues across blocks
+	out = c.convert(pcmMonoSamples(300, 400))
+	assert.Equal(t, []int16{200, 250, 300, 350}, pcmLeft(out))
+
+	// Downsampling drops frames
+	c = newPcmConverter(88200, 1, 16)
+	out = c.convert(pcmMonoSamples(0, 100, 200, 300, 400, 500))
+	assert.Equal(t, []int16{0, 100, 300}, pcmLeft(out))
+	out = c.convert(pcmMonoSamples(600, 700))
+	assert.Equal(t, []int16{500}, pcmLeft(out))
+}
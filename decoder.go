@@ -0,0 +1,184 @@
+package raopd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/maghul/go.alac"
+)
+
+/*
+Decoder decodes the audio of a stream from a source. A new Decoder is
+created for each stream by the function registered for the encoding of
+the stream with RegisterDecoder.
+
+The decoded audio is converted to the output format of NewAudioStream by
+raopd, so a decoder only needs to output the format of the stream.
+*/
+type Decoder interface {
+	// Init configures the decoder from the values of the a=rtpmap and
+	// a=fmtp attributes of the stream, e.g. "96 AppleLossless" and
+	// "96 352 0 16 40 10 14 2 255 0 0 44100". The fmtp is "" if the
+	// stream does not have one. If an error is returned the stream is
+	// rejected with 415 Unsupported Media Type.
+	Init(rtpmap, fmtp string) error
+
+	// Decode decodes the payload of one RTP packet. The decoded audio is
+	// interleaved signed little endian PCM in the format reported by the
+	// decoder. The returned slice may be reused by the next call.
+	Decode(frame []byte) ([]byte, error)
+
+	// The format of the decoded audio. The sample rate is also the rate
+	// of the RTP timestamps.
+	SampleRate() int
+	Channels() int
+	BitDepth() int
+}
+
+// Encodings of the codecs a source may choose from
+const (
+	EncodingL16    = "L16"
+	EncodingALAC   = "AppleLossless"
+	EncodingAAC    = "mpeg4-generic"
+	EncodingAACELD = "AAC-ELD"
+)
+
+// The codec numbers of the cn TXT value
+var txtCodecEncodings = []struct {
+	cn       string
+	encoding string
+}{
+	{"0", EncodingL16},
+	{"1", EncodingALAC},
+	{"2", EncodingAAC},
+	{"3", EncodingAACELD},
+}
+
+var decoders = struct {
+	m sync.RWMutex
+	d map[string]func() Decoder
+}{d: map[string]func() Decoder{
+	strings.ToLower(EncodingALAC): func() Decoder { return &alacDecoder{} },
+	strings.ToLower(EncodingL16):  func() Decoder { return &pcmDecoder{} },
+	strings.ToLower(EncodingAAC):  func() Decoder { return &aacDecoder{} },
+}}
+
+/*
+RegisterDecoder registers a function creating decoders for streams with the
+encoding, the name in the rtpmap. Encoding names are not case sensitive. A
+registered decoder replaces any decoder for the encoding, including the
+built in decoders for EncodingALAC, EncodingL16 and EncodingAAC, which
+decodes AAC-LC. Registering nil removes the decoder.
+
+AAC-ELD streams are announced as EncodingAAC with the fmtp mode AAC-eld.
+They are not decoded by this package, so they are rejected and the sinks
+do not advertise AAC-ELD unless a decoder is registered for EncodingAACELD.
+Sources are told which codecs the sink can receive when the sink is
+registered so decoders should be registered before any sinks.
+*/
+func RegisterDecoder(encoding string, newDecoder func() Decoder) {
+	decoders.m.Lock()
+	defer decoders.m.Unlock()
+
+	encoding = strings.ToLower(encoding)
+	if newDecoder == nil {
+		delete(decoders.d, encoding)
+		return
+	}
+	decoders.d[encoding] = newDecoder
+}
+
+// Returns a new, uninitialized, decoder for the encoding or nil.
+func newDecoder(encoding string) Decoder {
+	decoders.m.RLock()
+	defer decoders.m.RUnlock()
+
+	if nd, ok := decoders.d[strings.ToLower(encoding)]; ok {
+		return nd()
+	}
+	return nil
+}
+
+// Returns the encoding of the decoder of the stream. AAC-ELD streams have
+// the AAC encoding with a mode parameter in the fmtp.
+func streamEncoding(rtpmap *sdpRtpmap, fmtp *sdpFmtp) string {
+	if strings.EqualFold(rtpmap.encoding, EncodingAAC) {
+		if mode, _ := fmtp.parameter("mode"); strings.EqualFold(mode, "AAC-eld") {
+			return EncodingAACELD
+		}
+	}
+	return rtpmap.encoding
+}
+
+// Returns the cn TXT value, the codecs with a registered decoder.
+func txtCodecs() string {
+	cn := []string{}
+	for _, tc := range txtCodecEncodings {
+		if newDecoder(tc.encoding) != nil {
+			cn = append(cn, tc.cn)
+		}
+	}
+	return strings.Join(cn, ",")
+}
+
+// Check that the decoded format can be converted to the output format.
+func checkDecoderFormat(d Decoder) error {
+	switch {
+	case d.SampleRate() < 8000 || d.SampleRate() > 192000:
+		return fmt.Errorf("Unsupported sample rate %d", d.SampleRate())
+	case d.Channels() < 1:
+		return fmt.Errorf("Unsupported channel count %d", d.Channels())
+	}
+	switch d.BitDepth() {
+	case 8, 16, 24, 32:
+		return nil
+	}
+	return fmt.Errorf("Unsupported bit depth %d", d.BitDepth())
+}
+
+// -------------------------- ALAC --------------------------------------------------------------
+
+// alacDecoder decodes Apple Lossless using github.com/maghul/go.alac
+type alacDecoder struct {
+	alac     *alac.Alac
+	channels int
+	bitDepth int
+}
+
+func (d *alacDecoder) Init(rtpmap, fmtp string) error {
+	f, err := parseSdpFmtp(fmtp)
+	if err != nil {
+		return err
+	}
+	// frame length, compatible version, bit depth, pb, mb, kb, channels,
+	// max run, max frame bytes, average bit rate and sample rate
+	if len(f.fields) != 11 {
+		return fmt.Errorf("Malformed ALAC fmtp '%s'", fmtp)
+	}
+	if d.bitDepth, err = strconv.Atoi(f.fields[2]); err != nil {
+		return fmt.Errorf("Malformed ALAC bit depth '%s'", f.fields[2])
+	}
+	if d.channels, err = strconv.Atoi(f.fields[6]); err != nil {
+		return fmt.Errorf("Malformed ALAC channels '%s'", f.fields[6])
+	}
+	d.alac, err = alac.NewFromFmtp(fmtp)
+	return err
+}
+
+func (d *alacDecoder) Decode(frame []byte) ([]byte, error) {
+	return d.alac.Decode(frame), nil
+}
+
+func (d *alacDecoder) SampleRate() int {
+	return d.alac.SampleRate()
+}
+
+func (d *alacDecoder) Channels() int {
+	return d.channels
+}
+
+func (d *alacDecoder) BitDepth() int {
+	return d.bitDepth
+}
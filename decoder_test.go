@@ -0,0 +1,114 @@
+package raopd
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A decoder of 8 bit mono, the payload is the decoded audio
+type testDecoder struct {
+	rtpmap, fmtp string
+}
+
+func (d *testDecoder) Init(rtpmap, fmtp string) error {
+	if fmtp == "96 fail" {
+		return errors.New("Init failed")
+	}
+	d.rtpmap, d.fmtp = rtpmap, fmtp
+	return nil
+}
+
+func (d *testDecoder) Decode(frame []byte) ([]byte, error) {
+	if len(frame) == 0 {
+		return nil, errors.New("Empty frame")
+	}
+	return frame, nil
+}
+
+func (d *testDecoder) SampleRate() int { return 44100 }
+func (d *testDecoder) Channels() int   { return 1 }
+func (d *testDecoder) BitDepth() int   { return 8 }
+
+func TestRegisterDecoder(t *testing.T) {
+	assert.IsType(t, &alacDecoder{}, newDecoder("AppleLossless"))
+	assert.IsType(t, &pcmDecoder{}, newDecoder("l16"))
+	assert.IsType(t, &aacDecoder{}, newDecoder("mpeg4-generic"))
+	assert.Nil(t, newDecoder("x-test"))
+
+	RegisterDecoder("X-Test", func() Decoder { return &testDecoder{} })
+	defer RegisterDecoder("x-test", nil)
+
+	var dec audioDecoder
+	rtpmap, _ := parseSdpRtpmap("96 x-test/44100/1")
+	fmtp, _ := parseSdpFmtp("96 mode=test")
+	assert.NoError(t, dec.initCodec(rtpmap, fmtp))
+	td := dec.codec.(*testDecoder)
+	assert.Equal(t, "96 x-test/44100/1", td.rtpmap)
+	assert.Equal(t, "96 mode=test", td.fmtp)
+
+	ms, err := dec.rtptoms(44100)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, ms)
+
+	// Decoded and converted to the output format
+	pkt := testPacket(1, 96)
+	pkt.content = append(pkt.content[:12], 0x7f)
+	assert.Equal(t, []byte{0, 0x7f, 0, 0x7f}, dec.decode(pkt))
+	pkt = testPacket(2, 96)
+	pkt.content = pkt.content[:12]
+	assert.Nil(t, dec.decode(pkt))
+
+	// No fmtp
+	assert.NoError(t, dec.initCodec(rtpmap, nil))
+	assert.Equal(t, "", dec.codec.(*testDecoder).fmtp)
+
+	fmtp, _ = parseSdpFmtp("96 fail")
+	assert.Error(t, dec.initCodec(rtpmap, fmtp))
+
+	// AAC-LC is decoded, AAC-ELD needs a registered decoder
+	rtpmap, _ = parseSdpRtpmap("96 mpeg4-generic/44100/2")
+	assert.NoError(t, dec.initCodec(rtpmap, nil))
+	assert.IsType(t, &aacDecoder{}, dec.codec)
+	fmtp, _ = parseSdpFmtp("96 mode=AAC-eld; constantDuration=480")
+	assert.Error(t, dec.initCodec(rtpmap, fmtp))
+}
+
+func TestAlacDecoderInit(t *testing.T) {
+	d := &alacDecoder{}
+	assert.NoError(t, d.Init("96 AppleLossless", "96 352 0 24 40 10 14 1 255 0 0 48000"))
+	assert.Equal(t, 24, d.BitDepth())
+	assert.Equal(t, 1, d.Channels())
+	assert.Equal(t, 48000, d.SampleRate())
+
+	assert.Error(t, d.Init("96 AppleLossless", ""))
+	assert.Error(t, d.Init("96 AppleLossless", "96 352 0 x 40 10 14 2 255 0 0 44100"))
+}
+
+func TestTxtCodecs(t *testing.T) {
+	assert.Equal(t, "0,1,2", txtCodecs())
+
+	RegisterDecoder(EncodingAAC, nil)
+	defer RegisterDecoder(EncodingAAC, func() Decoder { return &aacDecoder{} })
+	assert.Equal(t, "0,1", txtCodecs())
+
+	RegisterDecoder(EncodingAAC, func() Decoder { return &testDecoder{} })
+	assert.Equal(t, "0,1,2", txtCodecs())
+
+	RegisterDecoder(EncodingAACELD, func() Decoder { return &testDecoder{} })
+	defer RegisterDecoder(EncodingAACELD, nil)
+	assert.Equal(t, "0,1,2,3", txtCodecs())
+}
+
+func TestStreamEncoding(t *testing.T) {
+	rtpmap, _ := parseSdpRtpmap("96 mpeg4-generic/44100/2")
+	assert.Equal(t, "mpeg4-generic", streamEncoding(rtpmap, nil))
+	fmtp, _ := parseSdpFmtp("96 streamtype=5; mode=AAC-hbr; config=1210")
+	assert.Equal(t, "mpeg4-generic", streamEncoding(rtpmap, fmtp))
+	fmtp, _ = parseSdpFmtp("96 streamtype=5; mode=AAC-eld; constantDuration=480")
+	assert.Equal(t, EncodingAACELD, streamEncoding(rtpmap, fmtp))
+
+	rtpmap, _ = parseSdpRtpmap("96 AppleLossless")
+	assert.Equal(t, "AppleLossless", streamEncoding(rtpmap, fmtp))
+}
@@ -0,0 +1,96 @@
+package raopd
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// RTSP Digest authentication as used by password protected AirPlay
+// receivers. See RFC 2617, only the basic digest without qop is used.
+
+const digestRealm = "raop"
+
+func md5hex(s ...string) string {
+	d := md5.Sum([]byte(strings.Join(s, ":")))
+	return hex.EncodeToString(d[:])
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Parse the parameters of a Digest Authorization header into a map.
+func parseDigestAuthorization(auth string) (map[string]string, bool) {
+	const prefix = "Digest "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return nil, false
+	}
+	params := make(map[string]string)
+	for _, kv := range strings.Split(auth[len(prefix):], ",") {
+		p := strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(p) != 2 {
+			continue
+		}
+		params[strings.ToLower(p[0])] = strings.Trim(p[1], "\"")
+	}
+	return params, true
+}
+
+// The expected digest response for a request
+func digestResponse(username, password, nonce, method, uri string) string {
+	ha1 := md5hex(username, digestRealm, password)
+	ha2 := md5hex(method, uri)
+	return md5hex(ha1, nonce, ha2)
+}
+
+// Returns the WWW-Authenticate header value for the connection.
+func (rs *rtspSession) digestChallenge() string {
+	if rs.nonce == "" {
+		rs.nonce = newNonce()
+	}
+	return fmt.Sprintf("Digest realm=\"%s\", nonce=\"%s\"", digestRealm, rs.nonce)
+}
+
+// authenticate checks the Authorization header of the request if the sink
+// has a password. The user name is not checked, senders use "iTunes" or
+// "AirPlay".
+func (rs *rtspSession) authenticate(req *http.Request) error {
+	si := rs.raop.sink.Info()
+	if si == nil || si.Password == "" {
+		return nil
+	}
+
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return newRTSPError(401, nil, "No authorization")
+	}
+	params, ok := parseDigestAuthorization(auth)
+	if !ok {
+		return newRTSPError(401, nil, "Not a digest authorization")
+	}
+	if rs.nonce == "" || params["nonce"] != rs.nonce {
+		return newRTSPError(401, nil, "Stale or unknown nonce")
+	}
+	if params["realm"] != digestRealm {
+		return newRTSPError(401, nil, "Wrong realm ", params["realm"])
+	}
+	if params["uri"] != req.RequestURI {
+		return newRTSPError(401, nil, "Wrong URI ", params["uri"])
+	}
+	expected := digestResponse(params["username"], si.Password, rs.nonce, req.Method, params["uri"])
+	response := strings.ToLower(params["response"])
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(response)) != 1 {
+		return newRTSPError(401, nil, "Wrong password")
+	}
+	return nil
+}
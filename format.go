@@ -0,0 +1,55 @@
+package raopd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+/*
+StreamFormat describes the audio written to the audio streams of a source,
+see NewAudioStream. Unless NativeAudioFormat is set in the SinkInfo the
+audio is always 16 bit stereo at 44100 samples/second, whatever the format
+of the stream sent by the source.
+*/
+type StreamFormat struct {
+	// The encoding of the stream sent by the source, e.g. EncodingALAC
+	Codec string
+
+	SampleRate    int
+	Channels      int // The samples of the channels are interleaved
+	BitsPerSample int // Signed samples of 8, 16, 24 or 32 bits
+
+	// The byte order of the samples, always binary.LittleEndian
+	ByteOrder binary.ByteOrder
+}
+
+func (f StreamFormat) String() string {
+	return fmt.Sprintf("%s %dHz %d channels %d bits %v", f.Codec, f.SampleRate, f.Channels, f.BitsPerSample, f.ByteOrder)
+}
+
+// The bytes of a sample of all channels
+func (f StreamFormat) frameSize() int {
+	return f.Channels * f.BitsPerSample / 8
+}
+
+// Returns the play time of the audio.
+func (f StreamFormat) duration(audio []byte) time.Duration {
+	samples := len(audio) / f.frameSize()
+	return time.Duration(int64(samples) * int64(time.Second) / int64(f.SampleRate))
+}
+
+/*
+StreamFormat returns the format of the audio of the stream currently sent
+by the source. It returns false if the source is not streaming.
+*/
+func (source *Source) StreamFormat() (StreamFormat, bool) {
+	r := &source.raop
+	r.sessionMutex.Lock()
+	defer r.sessionMutex.Unlock()
+
+	if r.active == nil || r.active.codec == nil {
+		return StreamFormat{}, false
+	}
+	return r.active.format, true
+}
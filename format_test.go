@@ -0,0 +1,74 @@
+package raopd
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type formatTestClient struct {
+	*testClient
+	formats []StreamFormat
+}
+
+func (fc *formatTestClient) SetStreamFormat(format StreamFormat) {
+	fc.formats = append(fc.formats, format)
+}
+
+// Make a source with a test session and a sink which records the formats
+func makeFormatTestSource() (*Source, *rtspSession, *formatTestClient) {
+	rs := makeTestRtspSession()
+	source := &Source{}
+	source.raop.dacp = rs.raop.dacp
+	source.raop.vol = rs.raop.vol
+	fc := &formatTestClient{testClient: rs.raop.sink.(*testClient)}
+	source.raop.sink = fc
+	rs.raop = &source.raop
+	return source, rs, fc
+}
+
+func TestStreamFormatConverted(t *testing.T) {
+	source, rs, fc := makeFormatTestSource()
+	_, ok := source.StreamFormat()
+	assert.False(t, ok)
+
+	sdp := strings.Replace(unencryptedSdp, "96 352 0 16 40 10 14 2 255 0 0 44100", "96 352 0 24 40 10 14 1 255 0 0 48000", 1)
+	resp, err := request(rs, announceRequest(sdp))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+
+	expected := StreamFormat{EncodingALAC, 44100, 2, 16, binary.LittleEndian}
+	assert.Equal(t, []StreamFormat{expected}, fc.formats)
+	format, ok := source.StreamFormat()
+	assert.True(t, ok)
+	assert.Equal(t, expected, format)
+	assert.Equal(t, "AppleLossless 44100Hz 2 channels 16 bits LittleEndian", format.String())
+}
+
+func TestStreamFormatNative(t *testing.T) {
+	source, rs, fc := makeFormatTestSource()
+	fc.si.NativeAudioFormat = true
+
+	sdp := strings.Replace(unencryptedSdp, "a=rtpmap:96 AppleLossless\r\n"+
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n", "a=rtpmap:96 L16/22050/1\r\n", 1)
+	resp, err := request(rs, announceRequest(sdp))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+
+	expected := StreamFormat{EncodingL16, 22050, 1, 16, binary.LittleEndian}
+	assert.Equal(t, []StreamFormat{expected}, fc.formats)
+	format, ok := source.StreamFormat()
+	assert.True(t, ok)
+	assert.Equal(t, expected, format)
+
+	// The audio is written as decoded
+	pkt := testPacket(1, 96)
+	pkt.content = append(pkt.content[:12], 0x01, 0x02, 0x03, 0x04)
+	assert.Equal(t, []byte{0x02, 0x01, 0x04, 0x03}, rs.s.decode(pkt))
+
+	rs.raop.release(rs.s, ErrTeardown)
+	_, ok = source.StreamFormat()
+	assert.False(t, ok)
+}
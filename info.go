@@ -6,6 +6,8 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"fmt"
 	"net"
 	"os"
 )
@@ -18,13 +20,27 @@ type info struct {
 var authlog = getLogger("raopd.auth", "RAOP Authentication Data")
 
 func makeInfo(keyfilename string) (*info, error) {
-	i := &info{}
 	file, err := os.Open(keyfilename)
 	if err != nil {
 		return nil, err
 	}
-	i.key, err = getRSAPrivateKey(file)
-	return i, err
+	defer file.Close()
+
+	key, err := getRSAPrivateKey(file)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read key from %s: %v", keyfilename, err)
+	}
+	return makeInfoFromKey(key)
+}
+
+func makeInfoFromKey(key *rsa.PrivateKey) (*info, error) {
+	if key == nil {
+		return nil, errors.New("No private key")
+	}
+	if err := key.Validate(); err != nil {
+		return nil, err
+	}
+	return &info{key: key}, nil
 }
 
 var ipv4prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
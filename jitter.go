@@ -0,0 +1,259 @@
+package raopd
+
+import (
+	"sync"
+	"time"
+)
+
+var jitterlog = getLogger("raopd.jitter", "Jitter Buffer")
+
+// Frames scheduled this close to the end of the audio written are not late
+const jitterTolerance = time.Millisecond
+
+// The length of the silence written on an underrun before any audio
+const defaultSilence = 10 * time.Millisecond
+
+type jitterFrame struct {
+	AudioFrame
+	play    time.Time // When the frame is written
+	samples int
+}
+
+/*
+jitterBuffer holds the decoded audio of a session until it should be
+played and writes it at real time pace. The play time of a frame is the
+time the source sent it plus the target latency. If the source has not
+sent a sync packet the play time is the arrival of the first frame after a
+flush plus the target latency, with the following frames played after it
+according to their RTP timestamps.
+
+Silence is written when the buffer runs empty and frames arriving after
+their audio time has been filled with silence are dropped.
+*/
+type jitterBuffer struct {
+	latency time.Duration
+	format  StreamFormat // The format of the audio
+	rtpRate int          // The sample rate of the RTP timestamps
+	out     func(AudioFrame, time.Duration)
+
+	m       sync.Mutex
+	frames  []*jitterFrame
+	queued  int // Samples in frames
+	started bool
+	next    time.Time // The play time of the next audio to write
+	nextRtp uint32    // The RTP timestamp of the next audio to write
+	silence int       // The length of the silence written on underruns in samples
+	zeros   []byte
+
+	// The play time of the first frame after a flush, used for frames
+	// without a send time
+	anchored  bool
+	anchor    time.Time
+	anchorRtp uint32
+
+	underrun   bool // Writing silence as the buffer is empty
+	underruns  int
+	silenced   int // Samples of silence written
+	lateFrames int
+
+	wake chan struct{}
+	quit chan struct{}
+	done chan struct{}
+}
+
+func startJitterBuffer(latency time.Duration, format StreamFormat, rtpRate int, out func(AudioFrame, time.Duration)) *jitterBuffer {
+	jb := &jitterBuffer{
+		latency: latency,
+		format:  format,
+		rtpRate: rtpRate,
+		out:     out,
+		silence: int(int64(defaultSilence) * int64(format.SampleRate) / int64(time.Second)),
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	jitterlog.Debug.Println("Starting jitter buffer latency=", latency, ", format=", format)
+	go jb.run()
+	return jb
+}
+
+func (jb *jitterBuffer) duration(samples int) time.Duration {
+	return time.Duration(int64(samples) * int64(time.Second) / int64(jb.format.SampleRate))
+}
+
+func (jb *jitterBuffer) rtpSamples(samples int) uint32 {
+	return uint32(int64(samples) * int64(jb.rtpRate) / int64(jb.format.SampleRate))
+}
+
+/*
+Queue a decoded frame. The send time is the local time the source sent the
+frame, zero if it is not known. The audio is copied as the decoder reuses
+its buffer.
+*/
+func (jb *jitterBuffer) push(frame AudioFrame, sent time.Time) {
+	f := &jitterFrame{AudioFrame: frame}
+	f.Audio = append([]byte(nil), frame.Audio...)
+	f.samples = len(f.Audio) / jb.format.frameSize()
+
+	jb.m.Lock()
+	if !sent.IsZero() {
+		f.play = sent.Add(jb.latency)
+	} else {
+		if !jb.anchored {
+			jb.anchored = true
+			jb.anchor = time.Now().Add(jb.latency)
+			jb.anchorRtp = frame.RtpTime
+		}
+		offset := int64(int32(frame.RtpTime - jb.anchorRtp))
+		f.play = jb.anchor.Add(time.Duration(offset * int64(time.Second) / int64(jb.rtpRate)))
+	}
+	jb.frames = append(jb.frames, f)
+	jb.queued += f.samples
+	jb.m.Unlock()
+	jb.signal()
+}
+
+// Drop all buffered audio. Silence is not written until audio is pushed.
+func (jb *jitterBuffer) flush() {
+	jb.m.Lock()
+	jb.frames = nil
+	jb.queued = 0
+	jb.started = false
+	jb.anchored = false
+	jb.m.Unlock()
+	jb.signal()
+}
+
+// Stop writing audio and wait until the last write has returned.
+func (jb *jitterBuffer) close() {
+	close(jb.quit)
+	<-jb.done
+}
+
+func (jb *jitterBuffer) signal() {
+	select {
+	case jb.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Add the buffered audio and the underrun statistics to the stats.
+func (jb *jitterBuffer) stats(stats *StreamStats) {
+	jb.m.Lock()
+	defer jb.m.Unlock()
+
+	stats.TargetLatency = jb.latency
+	stats.BufferDepth = jb.duration(jb.queued)
+	stats.Underruns = jb.underruns
+	stats.Silence = jb.duration(jb.silenced)
+	stats.LateFrames = jb.lateFrames
+}
+
+// Returns the next frame to write when it is due, or the time to wait for
+// it. Must be called with the lock held.
+func (jb *jitterBuffer) nextFrame(now time.Time) (*jitterFrame, time.Duration) {
+	for len(jb.frames) > 0 {
+		f := jb.frames[0]
+		if jb.started && f.play.Before(jb.next.Add(-jitterTolerance)) {
+			jitterlog.Debug.Println("Dropping late frame rtptime=", f.RtpTime, ", late=", jb.next.Sub(f.play))
+			jb.frames = jb.frames[1:]
+			jb.queued -= f.samples
+			jb.lateFrames++
+			continue
+		}
+		if jb.started && jb.next.Before(f.play.Add(-jitterTolerance)) {
+			// A gap before the frame is filled with silence
+			break
+		}
+		if wait := f.play.Sub(now); wait > 0 {
+			return nil, wait
+		}
+		jb.frames = jb.frames[1:]
+		jb.queued -= f.samples
+		jb.underrun = false
+		if !jb.started {
+			jb.started = true
+		} else {
+			f.play = jb.next // Keep the audio contiguous
+		}
+		jb.next = f.play.Add(jb.duration(f.samples))
+		jb.nextRtp = f.RtpTime + jb.rtpSamples(f.samples)
+		if f.samples > 0 {
+			jb.silence = f.samples
+		}
+		return f, 0
+	}
+	if !jb.started {
+		return nil, -1
+	}
+	if wait := jb.next.Sub(now); wait > 0 {
+		return nil, wait
+	}
+
+	// Underrun, write silence until the next frame or for the length of a frame
+	samples := jb.silence
+	if len(jb.frames) > 0 {
+		gap := int(int64(jb.frames[0].play.Sub(jb.next)) * int64(jb.format.SampleRate) / int64(time.Second))
+		if gap < samples {
+			samples = gap
+		}
+	} else if !jb.underrun {
+		jb.underrun = true
+		jb.underruns++
+		jitterlog.Debug.Println("Underrun at rtptime=", jb.nextRtp)
+	}
+	if samples <= 0 {
+		samples = 1
+	}
+	f := &jitterFrame{samples: samples, play: jb.next}
+	if n := samples * jb.format.frameSize(); len(jb.zeros) < n {
+		jb.zeros = make([]byte, n)
+	}
+	f.Audio = jb.zeros[:samples*jb.format.frameSize()]
+	f.RtpTime = jb.nextRtp
+	jb.next = f.play.Add(jb.duration(samples))
+	jb.nextRtp += jb.rtpSamples(samples)
+	jb.silenced += samples
+	return f, 0
+}
+
+func (jb *jitterBuffer) run() {
+	defer close(jb.done)
+	timer := time.NewTimer(time.Hour)
+	timer.Stop()
+
+	for {
+		jb.m.Lock()
+		f, wait := jb.nextFrame(time.Now())
+		jb.m.Unlock()
+
+		if f != nil {
+			f.PresentationTime = f.play
+			jb.out(f.AudioFrame, jb.duration(f.samples))
+			select {
+			case <-jb.quit:
+				return
+			default:
+			}
+			continue
+		}
+
+		var timeout <-chan time.Time
+		if wait > 0 {
+			timer.Reset(wait)
+			timeout = timer.C
+		}
+		select {
+		case <-jb.quit:
+			return
+		case <-jb.wake:
+		case <-timeout:
+		}
+		if timeout != nil && !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+	}
+}
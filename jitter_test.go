@@ -0,0 +1,161 @@
+package raopd
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var jitterTestFormat = StreamFormat{EncodingL16, 44100, 2, 16, nil}
+
+type jitterTestOutput struct {
+	frame AudioFrame
+	at    time.Time
+}
+
+func startJitterTestBuffer(latency time.Duration) (*jitterBuffer, chan jitterTestOutput) {
+	outc := make(chan jitterTestOutput, 100)
+	jb := startJitterBuffer(latency, jitterTestFormat, 44100, func(frame AudioFrame, duration time.Duration) {
+		frame.Audio = append([]byte(nil), frame.Audio...)
+		outc <- jitterTestOutput{frame, time.Now()}
+	})
+	return jb, outc
+}
+
+// A frame of 10ms, 441 samples
+func jitterTestFrame(rtptime uint32, b byte) AudioFrame {
+	audio := make([]byte, 441*4)
+	for ii := range audio {
+		audio[ii] = b
+	}
+	return AudioFrame{Audio: audio, RtpTime: rtptime}
+}
+
+func nextJitterOutput(t *testing.T, outc chan jitterTestOutput) jitterTestOutput {
+	select {
+	case out := <-outc:
+		return out
+	case <-time.After(time.Second):
+		t.Fatal("No output from the jitter buffer")
+		return jitterTestOutput{}
+	}
+}
+
+func TestJitterBufferPacing(t *testing.T) {
+	jb, outc := startJitterTestBuffer(50 * time.Millisecond)
+	defer jb.close()
+
+	start := time.Now()
+	for ii := 0; ii < 3; ii++ {
+		jb.push(jitterTestFrame(uint32(1000+ii*441), byte(ii+1)), time.Time{})
+	}
+	var stats StreamStats
+	jb.stats(&stats)
+	assert.Equal(t, 50*time.Millisecond, stats.TargetLatency)
+	assert.Equal(t, 30*time.Millisecond, stats.BufferDepth)
+
+	first := nextJitterOutput(t, outc)
+	assert.True(t, first.at.Sub(start) >= 50*time.Millisecond, "Written after ", first.at.Sub(start))
+	assert.Equal(t, uint32(1000), first.frame.RtpTime)
+	assert.Equal(t, byte(1), first.frame.Audio[0])
+	for ii := 1; ii < 3; ii++ {
+		out := nextJitterOutput(t, outc)
+		assert.Equal(t, uint32(1000+ii*441), out.frame.RtpTime)
+		assert.Equal(t, byte(ii+1), out.frame.Audio[0])
+		assert.Equal(t, first.frame.PresentationTime.Add(time.Duration(ii)*10*time.Millisecond), out.frame.PresentationTime)
+		assert.False(t, out.at.Before(out.frame.PresentationTime))
+	}
+
+	// Silence follows when the buffer runs empty
+	out := nextJitterOutput(t, outc)
+	assert.Equal(t, uint32(1000+3*441), out.frame.RtpTime)
+	assert.Equal(t, make([]byte, 441*4), out.frame.Audio)
+	out = nextJitterOutput(t, outc)
+	assert.Equal(t, uint32(1000+4*441), out.frame.RtpTime)
+
+	jb.stats(&stats)
+	assert.Equal(t, time.Duration(0), stats.BufferDepth)
+	assert.Equal(t, 1, stats.Underruns)
+	assert.True(t, stats.Silence >= 20*time.Millisecond)
+
+	// Silence stops after a flush
+	jb.flush()
+	for len(outc) > 0 {
+		<-outc
+	}
+	time.Sleep(30 * time.Millisecond)
+	assert.True(t, len(outc) <= 1)
+}
+
+func TestJitterBufferGapAndLate(t *testing.T) {
+	jb, outc := startJitterTestBuffer(20 * time.Millisecond)
+	defer jb.close()
+
+	sent := time.Now()
+	jb.push(jitterTestFrame(0, 1), sent)
+	jb.push(jitterTestFrame(882, 3), sent.Add(20*time.Millisecond))
+
+	out := nextJitterOutput(t, outc)
+	assert.Equal(t, uint32(0), out.frame.RtpTime)
+	assert.Equal(t, sent.Add(20*time.Millisecond), out.frame.PresentationTime)
+
+	// The missing frame is filled with silence, it is not an underrun
+	out = nextJitterOutput(t, outc)
+	assert.Equal(t, uint32(441), out.frame.RtpTime)
+	assert.Equal(t, make([]byte, 441*4), out.frame.Audio)
+
+	// It is late when it arrives
+	jb.push(jitterTestFrame(441, 2), sent.Add(10*time.Millisecond))
+	out = nextJitterOutput(t, outc)
+	assert.Equal(t, uint32(882), out.frame.RtpTime)
+	assert.Equal(t, byte(3), out.frame.Audio[0])
+
+	var stats StreamStats
+	jb.stats(&stats)
+	assert.Equal(t, 0, stats.Underruns)
+	assert.Equal(t, 1, stats.LateFrames)
+	assert.Equal(t, 10*time.Millisecond, stats.Silence)
+}
+
+type jitterTestWriter chan []byte
+
+func (w jitterTestWriter) Write(b []byte) (int, error) {
+	w <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func TestSessionTargetLatency(t *testing.T) {
+	source, rs, fc := makeFormatTestSource()
+	fc.si.NativeAudioFormat = true
+	fc.si.TargetLatency = 20 * time.Millisecond
+
+	sdp := strings.Replace(unencryptedSdp, "a=rtpmap:96 AppleLossless\r\n"+
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n", "a=rtpmap:96 L16/44100/2\r\n", 1)
+	resp, err := request(rs, announceRequest(sdp))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+
+	w := make(jitterTestWriter, 100)
+	source.NewAudioStream(context.Background(), w)
+
+	start := time.Now()
+	rs.s.handleAudioPacket(audioTestPacket(1, 1000, 0x01, 0x02, 0x03, 0x04))
+	stats, ok := source.StreamStats()
+	assert.True(t, ok)
+	assert.Equal(t, 20*time.Millisecond, stats.TargetLatency)
+
+	select {
+	case b := <-w:
+		assert.True(t, time.Since(start) >= 20*time.Millisecond)
+		assert.Equal(t, []byte{0x02, 0x01, 0x04, 0x03}, b)
+	case <-time.After(time.Second):
+		t.Fatal("No audio written")
+	}
+
+	rs.raop.release(rs.s, ErrTeardown)
+	_, ok = source.StreamStats()
+	assert.False(t, ok)
+}
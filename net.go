@@ -2,8 +2,6 @@ package raopd
 
 import (
 	"errors"
-	"fmt"
-	"net"
 	"strconv"
 	"strings"
 )
@@ -34,14 +32,37 @@ func getPortsFromTransport(transport string) (control int, timing int, err error
 	return
 }
 
-func cToIP(host string) (net.IP, error) {
-	if strings.Index(host, "IN IP6 ") != 0 && strings.Index(host, "IN IP4 ") != 0 {
-		return nil, errors.New(fmt.Sprintf("Unknown C record '%s'", host))
+// Get the interleaved channels for data and control if the transport is
+// RTP/AVP/TCP, i.e. "RTP/AVP/TCP;unicast;interleaved=0-1;mode=record".
+// Senders using UDP may also send an interleaved parameter which should
+// be ignored.
+func getInterleavedChannels(transport string) (data, control byte, tcp bool, err error) {
+	ts := strings.Split(transport, ";")
+	if strings.TrimSpace(ts[0]) != "RTP/AVP/TCP" {
+		return
 	}
-	a := net.ParseIP(host[7:])
-	netlog.Debug.Println("HOST IS", a)
-	if a == nil {
-		return nil, errors.New(fmt.Sprintf("Unparsable IP address '%s'", host[7:]))
+	tcp = true
+	for _, tv := range ts[1:] {
+		if strings.Index(tv, "interleaved=") != 0 {
+			continue
+		}
+		channels := strings.Split(tv[len("interleaved="):], "-")
+		var v uint64
+		v, err = strconv.ParseUint(channels[0], 10, 8)
+		if err != nil {
+			return
+		}
+		data = byte(v)
+		control = data + 1
+		if len(channels) > 1 {
+			v, err = strconv.ParseUint(channels[1], 10, 8)
+			if err != nil {
+				return
+			}
+			control = byte(v)
+		}
+		return
 	}
-	return a, nil
+	err = errors.New("No interleaved channels in TCP transport")
+	return
 }
@@ -1,7 +1,6 @@
 package raopd
 
 import (
-	"net"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -18,20 +17,26 @@ func TestNetGetPortsFromTransport(t *testing.T) {
 
 }
 
-func TestNetCToIP(t *testing.T) {
-	remote, err := cToIP("IN IP6 fe80::1c14:b58a:3cb8:868b")
+func TestNetGetInterleavedChannels(t *testing.T) {
+	data, control, tcp, err := getInterleavedChannels("RTP/AVP/TCP;unicast;interleaved=0-1;mode=record")
 	assert.Nil(t, err)
-	expected := net.ParseIP("fe80::1c14:b58a:3cb8:868b")
-	assert.Equal(t, expected, remote)
+	assert.True(t, tcp)
+	assert.Equal(t, byte(0), data)
+	assert.Equal(t, byte(1), control)
 
-	remote, err = cToIP("IN IP4 194.128.55.78")
+	data, control, tcp, err = getInterleavedChannels("RTP/AVP/TCP;unicast;interleaved=4;mode=record")
 	assert.Nil(t, err)
-	expected = net.ParseIP("194.128.55.78")
-	assert.Equal(t, expected, remote)
+	assert.True(t, tcp)
+	assert.Equal(t, byte(4), data)
+	assert.Equal(t, byte(5), control)
 
-	remote, err = cToIP("IN IP8 194.128.55.78")
+	_, _, tcp, err = getInterleavedChannels("RTP/AVP/UDP;unicast;interleaved=0-1;mode=record;control_port=6001;timing_port=6002")
+	assert.Nil(t, err)
+	assert.False(t, tcp)
+
+	_, _, _, err = getInterleavedChannels("RTP/AVP/TCP;unicast;mode=record")
 	assert.NotNil(t, err)
 
-	remote, err = cToIP("IN IP4 194.128,55.78")
+	_, _, _, err = getInterleavedChannels("RTP/AVP/TCP;unicast;interleaved=300-301")
 	assert.NotNil(t, err)
 }
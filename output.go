@@ -0,0 +1,116 @@
+package raopd
+
+import (
+	"sync"
+	"time"
+)
+
+// The number of decoded frames queued for the audio streams of a session
+const outputQueueFrames = 128
+
+type queuedFrame struct {
+	frame    AudioFrame
+	duration time.Duration
+	synced   chan struct{} // Closed when reached, for a sync without a frame
+}
+
+/*
+outputQueue hands the decoded audio of a session to the audio streams from
+a go-routine of its own. The sequencer never waits for the audio streams,
+a frame is dropped if the queue is full as a stream with the policy
+OverflowBlock has fallen behind.
+*/
+type outputQueue struct {
+	out    func(AudioFrame, time.Duration)
+	frames chan queuedFrame
+
+	m       sync.Mutex
+	dropped int
+
+	quit chan struct{}
+	done chan struct{}
+}
+
+func startOutputQueue(out func(AudioFrame, time.Duration)) *outputQueue {
+	q := &outputQueue{
+		out:    out,
+		frames: make(chan queuedFrame, outputQueueFrames),
+		quit:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go q.run()
+	return q
+}
+
+// Queue a frame of the duration. The audio is copied as the decoder reuses
+// its buffer.
+func (q *outputQueue) push(frame AudioFrame, duration time.Duration) {
+	frame.Audio = append([]byte(nil), frame.Audio...)
+	select {
+	case q.frames <- queuedFrame{frame: frame, duration: duration}:
+	default:
+		q.m.Lock()
+		q.dropped++
+		q.m.Unlock()
+		audiolog.Debug.Println("Output queue full, dropping rtptime=", frame.RtpTime)
+	}
+}
+
+// Drop all queued frames.
+func (q *outputQueue) flush() {
+	for {
+		select {
+		case of := <-q.frames:
+			if of.synced != nil {
+				close(of.synced)
+			}
+		default:
+			return
+		}
+	}
+}
+
+// Wait until all frames queued before the call have been handed to the
+// audio streams.
+func (q *outputQueue) sync() {
+	synced := make(chan struct{})
+	select {
+	case q.frames <- queuedFrame{synced: synced}:
+	case <-q.done:
+		return
+	}
+	select {
+	case <-synced:
+	case <-q.done:
+	}
+}
+
+// Stop handing audio to the streams and wait until the last frame has
+// been handed over. Queued frames are dropped.
+func (q *outputQueue) close() {
+	close(q.quit)
+	<-q.done
+}
+
+// The number of frames dropped as the queue was full.
+func (q *outputQueue) droppedFrames() int {
+	q.m.Lock()
+	defer q.m.Unlock()
+	return q.dropped
+}
+
+func (q *outputQueue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case <-q.quit:
+			return
+		case of := <-q.frames:
+			if of.synced != nil {
+				close(of.synced)
+				continue
+			}
+			q.out(of.frame, of.duration)
+		}
+	}
+}
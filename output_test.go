@@ -0,0 +1,52 @@
+package raopd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputQueue(t *testing.T) {
+	var out []byte
+	q := startOutputQueue(func(frame AudioFrame, duration time.Duration) {
+		out = append(out, frame.Audio...)
+	})
+	defer q.close()
+
+	// The audio is copied
+	audio := []byte{1}
+	q.push(AudioFrame{Audio: audio}, time.Millisecond)
+	audio[0] = 2
+	q.push(AudioFrame{Audio: audio}, time.Millisecond)
+	q.sync()
+	assert.Equal(t, []byte{1, 2}, out)
+	assert.Equal(t, 0, q.droppedFrames())
+}
+
+func TestOutputQueueFull(t *testing.T) {
+	gate := make(chan struct{})
+	var out []byte
+	q := startOutputQueue(func(frame AudioFrame, duration time.Duration) {
+		<-gate
+		out = append(out, frame.Audio...)
+	})
+
+	// The first frame is being output, the last ones do not fit the queue
+	q.push(AudioFrame{Audio: []byte{0}}, time.Millisecond)
+	for len(q.frames) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for ii := 0; ii < outputQueueFrames+2; ii++ {
+		q.push(AudioFrame{Audio: []byte{byte(ii + 1)}}, time.Millisecond)
+	}
+	assert.Equal(t, 2, q.droppedFrames())
+
+	// Flushed frames are not output
+	q.flush()
+	q.push(AudioFrame{Audio: []byte{0xff}}, time.Millisecond)
+	close(gate)
+	q.sync()
+	assert.Equal(t, []byte{0, 0xff}, out)
+	q.close()
+}
@@ -0,0 +1,122 @@
+package raopd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A text parameter of GET_PARAMETER and SET_PARAMETER handled by raopd.
+// Either get or set may be nil if the parameter can't be read or written.
+type parameter struct {
+	get func(rs *rtspSession) string
+	set func(rs *rtspSession, value string) error
+}
+
+var parameterlog = getLogger("raopd.parameter", "RTSP Text Parameters")
+
+var parameters = map[string]*parameter{
+	"volume":   {getVolumeParameter, setVolumeParameter},
+	"progress": {nil, setProgressParameter},
+}
+
+func getVolumeParameter(rs *rtspSession) string {
+	return fmt.Sprintf("%f", rs.raop.vol.DeviceVolume())
+}
+
+func setVolumeParameter(rs *rtspSession, value string) error {
+	vol, err := strconv.ParseFloat(value, 32)
+	if err != nil {
+		return newRTSPError(400, err, "Malformed volume ", value)
+	}
+	rs.raop.vol.SetServiceVolume(float32(vol))
+	return nil
+}
+
+func setProgressParameter(rs *rtspSession, value string) error {
+	var start, current, end int64
+	n, _ := fmt.Sscanf(value, "%d/%d/%d", &start, &current, &end)
+	if n != 3 {
+		return newRTSPError(400, nil, "Malformed progress ", value)
+	}
+	if rs.s == nil {
+		return newRTSPError(455, nil, "No session for progress")
+	}
+	err := rs.s.setProgress(start, current, end)
+	if err != nil {
+		return newRTSPError(455, err, "Could not set progress ", start, "/", current, "/", end)
+	}
+	return nil
+}
+
+// Returns the value of a parameter from raopd or the sink.
+func (rs *rtspSession) getParameter(name string) (string, bool) {
+	if p, ok := parameters[name]; ok && p.get != nil {
+		return p.get(rs), true
+	}
+	if ph, ok := rs.raop.sink.(SinkParameterHandler); ok {
+		return ph.GetParameter(name)
+	}
+	parameterlog.Debug.Println("Unknown parameter ", name)
+	return "", false
+}
+
+// Set a parameter handled by raopd or the sink.
+func (rs *rtspSession) setParameter(name, value string) error {
+	if p, ok := parameters[name]; ok && p.set != nil {
+		return p.set(rs, value)
+	}
+	if ph, ok := rs.raop.sink.(SinkParameterHandler); ok {
+		if err := ph.SetParameter(name, value); err != nil {
+			if re, ok := err.(*RTSPError); ok {
+				return re
+			}
+			return newRTSPError(400, err, "Sink could not set ", name)
+		}
+		return nil
+	}
+	parameterlog.Debug.Println("Ignoring parameter ", name, ": ", value)
+	return nil
+}
+
+// Answer a GET_PARAMETER body with one parameter name per line. Parameters
+// without a value are left out of the response.
+func (rs *rtspSession) getParameters(req io.Reader, resp io.Writer) {
+	scanner := bufio.NewScanner(req)
+	bw := bufio.NewWriter(resp)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" {
+			continue
+		}
+		if value, ok := rs.getParameter(name); ok {
+			fmt.Fprintf(bw, "%s: %s\n", name, value)
+		}
+	}
+	bw.Flush()
+}
+
+// Set each "name: value" line of a SET_PARAMETER body. All parameters are
+// set even if one fails, the first error is returned.
+func (rs *rtspSession) setParameters(req io.Reader) error {
+	var first error
+	scanner := bufio.NewScanner(req)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) != 2 {
+			parameterlog.Info.Println("Malformed parameter line: ", line)
+			continue
+		}
+		err := rs.setParameter(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
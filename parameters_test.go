@@ -0,0 +1,86 @@
+package raopd
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type parameterTestClient struct {
+	*testClient
+	params map[string]string
+}
+
+func (pc *parameterTestClient) GetParameter(name string) (string, bool) {
+	value, ok := pc.params[name]
+	return value, ok
+}
+
+func (pc *parameterTestClient) SetParameter(name, value string) error {
+	if name == "readonly" {
+		return errors.New("Read only")
+	}
+	pc.params[name] = value
+	return nil
+}
+
+func makeParameterTestRtspSession() (*rtspSession, *parameterTestClient) {
+	r := makeAnnouncedTestRtspSession()
+	pc := &parameterTestClient{r.raop.sink.(*testClient), map[string]string{"vendor-name": "ACME"}}
+	r.raop.sink = pc
+	return r, pc
+}
+
+func parameterRequest(method, body string) string {
+	return fmt.Sprintf("%s rtsp://10.0.0.1/1234 RTSP/1.0\r\n"+
+		"Content-Length: %d\r\n"+
+		"Content-Type: text/parameters\r\n"+
+		"CSeq: 5\r\n\r\n%s", method, len(body), body)
+}
+
+func TestGetParameterSink(t *testing.T) {
+	r, _ := makeParameterTestRtspSession()
+	resp, err := request(r, parameterRequest("GET_PARAMETER", "volume\r\nvendor-name\r\nunknown\r\n"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	assert.Equal(t, "volume: 0.000000\nvendor-name: ACME\n", readToString(resp.Body))
+}
+
+func TestSetParameterMultiLine(t *testing.T) {
+	r, pc := makeParameterTestRtspSession()
+	resp, err := request(r, parameterRequest("SET_PARAMETER",
+		"volume: -12.5\r\nprogress: 866155144/880664705/900835976\r\nvendor-mode: party\r\n"))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	assert.Equal(t, float32(-12.5), <-r.raop.vol.deviceVolumeChan)
+	assert.Equal(t, 329014, pc.pos)
+	assert.Equal(t, 786413, pc.end)
+	assert.Equal(t, "party", pc.params["vendor-mode"])
+	assert.NotContains(t, pc.params, "volume")
+}
+
+func TestSetParameterErrors(t *testing.T) {
+	r, pc := makeParameterTestRtspSession()
+	resp, err := request(r, parameterRequest("SET_PARAMETER", "readonly: 1\r\nvendor-mode: party\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 400, resp.StatusCode, "StatusCode")
+	assert.Equal(t, "party", pc.params["vendor-mode"], "Later parameters are still set")
+
+	resp, err = request(r, parameterRequest("SET_PARAMETER", "volume: loud\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 400, resp.StatusCode, "StatusCode")
+
+	resp, err = request(r, parameterRequest("SET_PARAMETER", "progress: 880664705/900835976\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 400, resp.StatusCode, "StatusCode")
+
+	// Without a sink handler unknown parameters are ignored
+	r = makeTestRtspSession()
+	resp, err = request(r, parameterRequest("SET_PARAMETER", "vendor-mode: party\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+}
@@ -0,0 +1,59 @@
+package raopd
+
+import (
+	"fmt"
+)
+
+// pcmDecoder decodes L16 audio, RFC 3551, which is uncompressed 16 bit big
+// endian PCM.
+type pcmDecoder struct {
+	rate     int
+	channels int
+	buf      []byte
+}
+
+// A rate or channel count not given in the rtpmap is taken to be the output
+// rate or channel count.
+func (d *pcmDecoder) Init(rtpmap, fmtp string) error {
+	rm, err := parseSdpRtpmap(rtpmap)
+	if err != nil {
+		return err
+	}
+	d.rate, d.channels = rm.clockRate, rm.channels
+	if d.rate == 0 {
+		d.rate = outputSampleRate
+	}
+	if d.channels == 0 {
+		d.channels = outputChannels
+	}
+	if d.rate < 8000 || d.rate > 192000 {
+		return fmt.Errorf("Unsupported L16 sample rate %d", d.rate)
+	}
+	if d.channels != 1 && d.channels != 2 {
+		return fmt.Errorf("Unsupported L16 channel count %d", d.channels)
+	}
+	return nil
+}
+
+// Swap the byte order of the samples. A trailing partial frame is dropped.
+func (d *pcmDecoder) Decode(frame []byte) ([]byte, error) {
+	frameSize := 2 * d.channels
+	n := len(frame) / frameSize * frameSize
+	d.buf = d.buf[:0]
+	for ii := 0; ii < n; ii += 2 {
+		d.buf = append(d.buf, frame[ii+1], frame[ii])
+	}
+	return d.buf, nil
+}
+
+func (d *pcmDecoder) SampleRate() int {
+	return d.rate
+}
+
+func (d *pcmDecoder) Channels() int {
+	return d.channels
+}
+
+func (d *pcmDecoder) BitDepth() int {
+	return 16
+}
@@ -0,0 +1,45 @@
+package raopd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPcmStereo(t *testing.T) {
+	d := &pcmDecoder{}
+	assert.NoError(t, d.Init("96 L16/44100/2", ""))
+	assert.Equal(t, 44100, d.SampleRate())
+	assert.Equal(t, 2, d.Channels())
+	assert.Equal(t, 16, d.BitDepth())
+
+	// Big endian in, little endian out. A trailing partial frame is dropped
+	out, err := d.Decode([]byte{0x01, 0x02, 0x03, 0x04, 0xff, 0xfe, 0x80, 0x00, 0x11})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x02, 0x01, 0x04, 0x03, 0xfe, 0xff, 0x00, 0x80}, out)
+	out, err = d.Decode([]byte{0x01})
+	assert.NoError(t, err)
+	assert.Empty(t, out)
+}
+
+func TestPcmMono(t *testing.T) {
+	d := &pcmDecoder{}
+	assert.NoError(t, d.Init("96 L16/22050/1", ""))
+	assert.Equal(t, 22050, d.SampleRate())
+	assert.Equal(t, 1, d.Channels())
+
+	out, err := d.Decode([]byte{0x01, 0x02, 0x03})
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x02, 0x01}, out)
+}
+
+func TestPcmDefaults(t *testing.T) {
+	d := &pcmDecoder{}
+	assert.NoError(t, d.Init("96 L16", ""))
+	assert.Equal(t, 44100, d.rate)
+	assert.Equal(t, 2, d.channels)
+
+	assert.Error(t, d.Init("96 L16/44100/6", ""))
+	assert.Error(t, d.Init("96 L16/100/2", ""))
+	assert.Error(t, d.Init("L16", ""))
+}
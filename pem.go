@@ -1,26 +1,109 @@
 package raopd
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/hmac"
 	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
 	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"strings"
 )
 
-func getRSAPrivateKey(r io.Reader) (*rsa.PrivateKey, error) {
-	b := make([]byte, 8192)
+var errNoPEMBlock = errors.New("No PEM block found")
 
-	n, err := r.Read(b)
+// Read an unencrypted RSA private key in the PEM format.
+func getRSAPrivateKey(r io.Reader) (*rsa.PrivateKey, error) {
+	b, err := ioutil.ReadAll(r)
 	if err != nil {
 		return nil, err
 	}
+	return parseRSAPrivateKeyPEM(b, nil)
+}
+
+/*
+Parse the first private key of PEM data. The key may be PKCS#1 ("RSA
+PRIVATE KEY") or PKCS#8 ("PRIVATE KEY"). It may be encrypted with a
+password as PKCS#8 with PBES2 ("ENCRYPTED PRIVATE KEY"), or in the legacy
+PEM format, i.e. with a Proc-Type header. Other blocks, e.g. certificates,
+are skipped.
+*/
+func parseRSAPrivateKeyPEM(data, password []byte) (*rsa.PrivateKey, error) {
+	var found []string
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		switch block.Type {
+		case "RSA PRIVATE KEY", "PRIVATE KEY":
+			return parsePrivateKeyBlock(block, password)
+		case "ENCRYPTED PRIVATE KEY":
+			return parseEncryptedPrivateKeyBlock(block, password)
+		}
+		found = append(found, block.Type)
+	}
+	if len(found) == 0 {
+		return nil, errNoPEMBlock
+	}
+	return nil, fmt.Errorf("No private key in PEM data, found %s", strings.Join(found, ", "))
+}
 
-	block, _ := pem.Decode(b[0:n])
+func parsePrivateKeyBlock(block *pem.Block, password []byte) (*rsa.PrivateKey, error) {
+	der := block.Bytes
+	// The legacy PEM encryption is insecure and deprecated, but it is what
+	// "openssl genrsa -aes256" wrote before OpenSSL 3 so such keys are
+	// still around.
+	if x509.IsEncryptedPEMBlock(block) {
+		if password == nil {
+			return nil, errors.New("The private key is encrypted and no password was given")
+		}
+		var err error
+		der, err = x509.DecryptPEMBlock(block, password)
+		if err != nil {
+			return nil, fmt.Errorf("Could not decrypt the private key: %v", err)
+		}
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return getPrivateKey(der)
+	}
+	return parsePKCS8PrivateKey(der)
+}
+
+func parseEncryptedPrivateKeyBlock(block *pem.Block, password []byte) (*rsa.PrivateKey, error) {
+	if password == nil {
+		return nil, errors.New("The private key is encrypted and no password was given")
+	}
+	der, err := decryptPKCS8(block.Bytes, password)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("Could not decrypt the private key: %v", err)
 	}
+	return parsePKCS8PrivateKey(der)
+}
 
-	return getPrivateKey(block.Bytes)
+func parsePKCS8PrivateKey(der []byte) (*rsa.PrivateKey, error) {
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("The private key is not an RSA key but %T", key)
+	}
+	return rsaKey, nil
 }
 
 func getPrivateKey(bytes []byte) (*rsa.PrivateKey, error) {
@@ -30,3 +113,136 @@ func getPrivateKey(bytes []byte) (*rsa.PrivateKey, error) {
 	}
 	return priv, nil
 }
+
+// -------------------------- PKCS#8 PBES2, RFC 8018 --------------------------------------------
+
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+)
+
+// The pseudorandom functions of PBKDF2 by OID, hmacWithSHA1 is the default
+var pbkdf2PRFs = map[string]func() hash.Hash{
+	"1.2.840.113549.2.7":  sha1.New,
+	"1.2.840.113549.2.8":  sha256.New224,
+	"1.2.840.113549.2.9":  sha256.New,
+	"1.2.840.113549.2.10": sha512.New384,
+	"1.2.840.113549.2.11": sha512.New,
+}
+
+// The CBC encryption schemes of PBES2 by OID
+var pbes2Ciphers = map[string]struct {
+	keyLength int
+	newCipher func(key []byte) (cipher.Block, error)
+}{
+	"2.16.840.1.101.3.4.1.2":  {16, aes.NewCipher},
+	"2.16.840.1.101.3.4.1.22": {24, aes.NewCipher},
+	"2.16.840.1.101.3.4.1.42": {32, aes.NewCipher},
+	"1.2.840.113549.3.7":      {24, des.NewTripleDESCipher},
+}
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// Decrypt an EncryptedPrivateKeyInfo encrypted with PBES2 and PBKDF2,
+// which is what OpenSSL 3 writes. The older PBES1 schemes are not
+// supported.
+func decryptPKCS8(der, password []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, err
+	}
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported encryption %v, only PBES2 is supported", info.Algorithm.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); err != nil {
+		return nil, err
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("Unsupported key derivation %v, only PBKDF2 is supported", params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, err
+	}
+	prf := sha1.New
+	if len(kdf.PRF.Algorithm) > 0 {
+		var ok bool
+		if prf, ok = pbkdf2PRFs[kdf.PRF.Algorithm.String()]; !ok {
+			return nil, fmt.Errorf("Unsupported PBKDF2 function %v", kdf.PRF.Algorithm)
+		}
+	}
+	scheme, ok := pbes2Ciphers[params.EncryptionScheme.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported cipher %v", params.EncryptionScheme.Algorithm)
+	}
+	if kdf.IterationCount < 1 || (kdf.KeyLength != 0 && kdf.KeyLength != scheme.keyLength) {
+		return nil, errors.New("Malformed PBKDF2 parameters")
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+
+	block, err := scheme.newCipher(pbkdf2Key(prf, password, kdf.Salt, kdf.IterationCount, scheme.keyLength))
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	bs := block.BlockSize()
+	if len(iv) != bs || len(data) == 0 || len(data)%bs != 0 {
+		return nil, errors.New("Malformed encrypted data")
+	}
+	plain := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, data)
+
+	// A wrong password is almost always detected by the padding
+	pad := int(plain[len(plain)-1])
+	if pad < 1 || pad > bs {
+		return nil, errors.New("Wrong password")
+	}
+	for _, b := range plain[len(plain)-pad:] {
+		if int(b) != pad {
+			return nil, errors.New("Wrong password")
+		}
+	}
+	return plain[:len(plain)-pad], nil
+}
+
+// Derive a key from the password with PBKDF2.
+func pbkdf2Key(prf func() hash.Hash, password, salt []byte, iterations, keyLength int) []byte {
+	mac := hmac.New(prf, password)
+	var key []byte
+	for block := uint32(1); len(key) < keyLength; block++ {
+		mac.Reset()
+		mac.Write(salt)
+		binary.Write(mac, binary.BigEndian, block)
+		u := mac.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < iterations; n++ {
+			mac.Reset()
+			mac.Write(u)
+			u = mac.Sum(u[:0])
+			for ii := range t {
+				t[ii] ^= u[ii]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLength]
+}
@@ -0,0 +1,310 @@
+package raopd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"unicode/utf16"
+)
+
+// Property list encoding in the XML and binary formats used by Apple. The
+// values that can be encoded are map[string]interface{} (dict),
+// []interface{} (array), string, bool, int, int64, uint64, float64 and
+// []byte (data).
+
+type plistError struct {
+	v interface{}
+}
+
+func (e *plistError) Error() string {
+	return fmt.Sprintf("Can not encode %T as a property list", e.v)
+}
+
+// Returns the keys of a dict in the order they are encoded.
+func plistKeys(d map[string]interface{}) []string {
+	keys := make([]string, 0, len(d))
+	for k := range d {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func plistInt(v interface{}) (int64, bool) {
+	switch v := v.(type) {
+	case int:
+		return int64(v), true
+	case int64:
+		return v, true
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v), true
+		}
+	}
+	return 0, false
+}
+
+// -------------------------- XML ---------------------------------------------------------------
+
+const plistXMLHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`
+
+func encodePlistXML(w io.Writer, v interface{}) error {
+	b := bytes.NewBufferString(plistXMLHeader)
+	err := encodePlistXMLValue(b, v, "")
+	if err != nil {
+		return err
+	}
+	b.WriteString("</plist>\n")
+	_, err = b.WriteTo(w)
+	return err
+}
+
+func writePlistXMLElement(b *bytes.Buffer, indent, name, text string) {
+	b.WriteString(indent)
+	b.WriteString("<" + name + ">")
+	xml.EscapeText(b, []byte(text))
+	b.WriteString("</" + name + ">\n")
+}
+
+func encodePlistXMLValue(b *bytes.Buffer, v interface{}, indent string) error {
+	if i, ok := plistInt(v); ok {
+		writePlistXMLElement(b, indent, "integer", strconv.FormatInt(i, 10))
+		return nil
+	}
+	switch v := v.(type) {
+	case string:
+		writePlistXMLElement(b, indent, "string", v)
+	case bool:
+		if v {
+			b.WriteString(indent + "<true/>\n")
+		} else {
+			b.WriteString(indent + "<false/>\n")
+		}
+	case float64:
+		writePlistXMLElement(b, indent, "real", strconv.FormatFloat(v, 'g', -1, 64))
+	case []byte:
+		writePlistXMLElement(b, indent, "data", base64.StdEncoding.EncodeToString(v))
+	case []interface{}:
+		b.WriteString(indent + "<array>\n")
+		for _, e := range v {
+			if err := encodePlistXMLValue(b, e, indent+"\t"); err != nil {
+				return err
+			}
+		}
+		b.WriteString(indent + "</array>\n")
+	case map[string]interface{}:
+		b.WriteString(indent + "<dict>\n")
+		for _, k := range plistKeys(v) {
+			writePlistXMLElement(b, indent+"\t", "key", k)
+			if err := encodePlistXMLValue(b, v[k], indent+"\t"); err != nil {
+				return err
+			}
+		}
+		b.WriteString(indent + "</dict>\n")
+	default:
+		return &plistError{v}
+	}
+	return nil
+}
+
+// -------------------------- Binary ------------------------------------------------------------
+
+type bplistEncoder struct {
+	objects []interface{} // All objects in object reference order
+	refSize int
+}
+
+// Add the value and all values it contains to the object table. A value
+// is always followed by the values it contains.
+func (e *bplistEncoder) flatten(v interface{}) error {
+	e.objects = append(e.objects, v)
+	switch v := v.(type) {
+	case []interface{}:
+		for _, c := range v {
+			if err := e.flatten(c); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		keys := plistKeys(v)
+		for _, k := range keys {
+			e.flatten(k)
+		}
+		for _, k := range keys {
+			if err := e.flatten(v[k]); err != nil {
+				return err
+			}
+		}
+	case string, bool, float64, []byte:
+	default:
+		if _, ok := plistInt(v); !ok {
+			return &plistError{v}
+		}
+	}
+	return nil
+}
+
+// The number of bytes needed to store n as an unsigned integer
+func bplistIntSize(n uint64) int {
+	switch {
+	case n <= math.MaxUint8:
+		return 1
+	case n <= math.MaxUint16:
+		return 2
+	case n <= math.MaxUint32:
+		return 4
+	}
+	return 8
+}
+
+func bplistPutUint(b *bytes.Buffer, n uint64, size int) {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, n)
+	b.Write(buf[8-size:])
+}
+
+func bplistWriteInt(b *bytes.Buffer, i int64) {
+	size := 8
+	if i >= 0 {
+		size = bplistIntSize(uint64(i))
+	}
+	// The marker holds log2 of the size
+	marker := map[int]byte{1: 0x10, 2: 0x11, 4: 0x12, 8: 0x13}[size]
+	b.WriteByte(marker)
+	bplistPutUint(b, uint64(i), size)
+}
+
+// Write an object marker with a count, counts of 15 or more follow the
+// marker as an integer object.
+func bplistWriteMarker(b *bytes.Buffer, marker byte, count int) {
+	if count < 15 {
+		b.WriteByte(marker | byte(count))
+	} else {
+		b.WriteByte(marker | 0x0f)
+		bplistWriteInt(b, int64(count))
+	}
+}
+
+func isASCII(s string) bool {
+	for ii := 0; ii < len(s); ii++ {
+		if s[ii] > 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// Write the object with reference ref. Objects contained in the object
+// always follow it in the object table in the order written by flatten.
+func (e *bplistEncoder) writeObject(b *bytes.Buffer, ref int) {
+	v := e.objects[ref]
+	next := ref + 1
+	if i, ok := plistInt(v); ok {
+		bplistWriteInt(b, i)
+		return
+	}
+	switch v := v.(type) {
+	case bool:
+		if v {
+			b.WriteByte(0x09)
+		} else {
+			b.WriteByte(0x08)
+		}
+	case float64:
+		b.WriteByte(0x23)
+		bplistPutUint(b, math.Float64bits(v), 8)
+	case []byte:
+		bplistWriteMarker(b, 0x40, len(v))
+		b.Write(v)
+	case string:
+		if isASCII(v) {
+			bplistWriteMarker(b, 0x50, len(v))
+			b.WriteString(v)
+		} else {
+			u := utf16.Encode([]rune(v))
+			bplistWriteMarker(b, 0x60, len(u))
+			for _, c := range u {
+				bplistPutUint(b, uint64(c), 2)
+			}
+		}
+	case []interface{}:
+		bplistWriteMarker(b, 0xa0, len(v))
+		refs := make([]int, len(v))
+		for ii := range v {
+			refs[ii] = next
+			next = e.skip(next)
+		}
+		for _, r := range refs {
+			bplistPutUint(b, uint64(r), e.refSize)
+		}
+	case map[string]interface{}:
+		bplistWriteMarker(b, 0xd0, len(v))
+		refs := make([]int, 2*len(v))
+		for ii := range refs {
+			refs[ii] = next
+			next = e.skip(next)
+		}
+		for _, r := range refs {
+			bplistPutUint(b, uint64(r), e.refSize)
+		}
+	}
+}
+
+// Returns the reference of the object following the object with reference
+// ref and all the objects it contains.
+func (e *bplistEncoder) skip(ref int) int {
+	next := ref + 1
+	switch v := e.objects[ref].(type) {
+	case []interface{}:
+		for range v {
+			next = e.skip(next)
+		}
+	case map[string]interface{}:
+		for ii := 0; ii < 2*len(v); ii++ {
+			next = e.skip(next)
+		}
+	}
+	return next
+}
+
+func encodeBinaryPlist(w io.Writer, v interface{}) error {
+	e := &bplistEncoder{}
+	if err := e.flatten(v); err != nil {
+		return err
+	}
+	e.refSize = bplistIntSize(uint64(len(e.objects)))
+
+	b := bytes.NewBufferString("bplist00")
+	offsets := make([]uint64, len(e.objects))
+	for ii := range e.objects {
+		offsets[ii] = uint64(b.Len())
+		e.writeObject(b, ii)
+	}
+
+	offsetTable := uint64(b.Len())
+	offsetSize := bplistIntSize(offsetTable)
+	for _, o := range offsets {
+		bplistPutUint(b, o, offsetSize)
+	}
+
+	// Trailer: 6 unused bytes, offset size, reference size, number of
+	// objects, top object and the offset of the offset table.
+	b.Write(make([]byte, 6))
+	b.WriteByte(byte(offsetSize))
+	b.WriteByte(byte(e.refSize))
+	bplistPutUint(b, uint64(len(e.objects)), 8)
+	bplistPutUint(b, 0, 8)
+	bplistPutUint(b, offsetTable, 8)
+
+	_, err := b.WriteTo(w)
+	return err
+}
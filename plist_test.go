@@ -0,0 +1,72 @@
+package raopd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBinaryPlist(t *testing.T) {
+	b := bytes.NewBufferString("")
+	err := encodeBinaryPlist(b, map[string]interface{}{"a": 1})
+	assert.NoError(t, err)
+
+	expected := []byte("bplist00")
+	expected = append(expected,
+		0xd1, 0x01, 0x02, // dict {1: 2}
+		0x51, 'a', // "a"
+		0x10, 0x01, // 1
+		0x08, 0x0b, 0x0d, // offset table
+		0, 0, 0, 0, 0, 0, 1, 1, // trailer
+		0, 0, 0, 0, 0, 0, 0, 3,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 15)
+	assert.Equal(t, expected, b.Bytes())
+}
+
+func TestBinaryPlistValues(t *testing.T) {
+	b := bytes.NewBufferString("")
+	err := encodeBinaryPlist(b, []interface{}{true, false, int64(-1), 65536, 1.5, []byte{1, 2}, "å", "0123456789abcdef"})
+	assert.NoError(t, err)
+	c := b.Bytes()[8:]
+
+	assert.Equal(t, []byte{0xa8, 1, 2, 3, 4, 5, 6, 7, 8}, c[:9])
+	c = c[9:]
+	assert.Equal(t, []byte{0x09, 0x08}, c[:2])
+	assert.Equal(t, []byte{0x13, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, c[2:11])
+	assert.Equal(t, []byte{0x12, 0, 1, 0, 0}, c[11:16])
+	assert.Equal(t, []byte{0x23, 0x3f, 0xf8, 0, 0, 0, 0, 0, 0}, c[16:25])
+	assert.Equal(t, []byte{0x42, 1, 2}, c[25:28])
+	assert.Equal(t, []byte{0x61, 0x00, 0xe5}, c[28:31])
+	assert.Equal(t, append([]byte{0x5f, 0x10, 0x10}, "0123456789abcdef"...), c[31:50])
+
+	err = encodeBinaryPlist(b, map[string]interface{}{"a": struct{}{}})
+	assert.Error(t, err)
+}
+
+func TestXMLPlist(t *testing.T) {
+	b := bytes.NewBufferString("")
+	err := encodePlistXML(b, map[string]interface{}{
+		"name":  "Kitchen & Bath",
+		"count": 2,
+		"on":    true,
+		"list":  []interface{}{1.5, []byte("hi")},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, plistXMLHeader+`<dict>
+	<key>count</key>
+	<integer>2</integer>
+	<key>list</key>
+	<array>
+		<real>1.5</real>
+		<data>aGk=</data>
+	</array>
+	<key>name</key>
+	<string>Kitchen &amp; Bath</string>
+	<key>on</key>
+	<true/>
+</dict>
+</plist>
+`, b.String())
+}
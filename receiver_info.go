@@ -0,0 +1,143 @@
+package raopd
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AirPlay feature bits reported in GET /info
+const (
+	featureAudio            = 1 << 9
+	featureAudioRedundant   = 1 << 11
+	featureMetadataArtwork  = 1 << 15
+	featureMetadataProgress = 1 << 16
+	featureMetadataText     = 1 << 17
+)
+
+// Codec names of the cn TXT value
+var txtCodecNames = map[string]string{
+	"0": "PCM",
+	"1": "ALAC",
+	"2": "AAC",
+	"3": "AAC-ELD",
+}
+
+func (r *raop) features() int64 {
+	features := int64(featureAudio | featureAudioRedundant | featureMetadataProgress)
+	si := r.sink.Info()
+	if si == nil {
+		return features
+	}
+	if si.SupportsCoverArt {
+		features |= featureMetadataArtwork
+	}
+	if si.SupportsMetaData != "" {
+		features |= featureMetadataText
+	}
+	return features
+}
+
+// Encode TXT values the way they are sent in a DNS TXT record, each value
+// prefixed by its length.
+func encodeTxt(values []string) []byte {
+	b := bytes.NewBufferString("")
+	for _, v := range values {
+		if len(v) > 255 {
+			v = v[:255]
+		}
+		b.WriteByte(byte(len(v)))
+		b.WriteString(v)
+	}
+	return b.Bytes()
+}
+
+// receiverInfo describes the receiver in the dictionary returned by GET /info
+func (r *raop) receiverInfo() map[string]interface{} {
+	si := r.sink.Info()
+	values := raopTxtValues(r)
+	txt := make(map[string]string)
+	for _, v := range values {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) == 2 {
+			txt[kv[0]] = kv[1]
+		}
+	}
+	toInt := func(key string) int64 {
+		i, _ := strconv.ParseInt(txt[key], 10, 64)
+		return i
+	}
+
+	codecs := []interface{}{}
+	for _, cn := range strings.Split(txt["cn"], ",") {
+		if name, ok := txtCodecNames[cn]; ok {
+			codecs = append(codecs, name)
+		}
+	}
+
+	var name string
+	var latency time.Duration
+	if si != nil {
+		name = si.Name
+		latency = si.AudioLatency
+	}
+	if latency <= 0 {
+		latency = time.Duration(defaultAudioLatency) * time.Second / 44100
+	}
+	if si != nil && si.TargetLatency > 0 {
+		latency += si.TargetLatency // Held by the jitter buffer
+	}
+
+	deviceID := strings.ToUpper(r.hwaddr.String())
+	return map[string]interface{}{
+		"name":          name,
+		"model":         txt["am"],
+		"deviceID":      deviceID,
+		"macAddress":    deviceID,
+		"features":      r.features(),
+		"sourceVersion": txt["vs"],
+		"codecs":        codecs,
+		"sampleRate":    toInt("sr"),
+		"sampleSize":    toInt("ss"),
+		"channels":      toInt("ch"),
+		"audioLatencies": []interface{}{
+			map[string]interface{}{
+				"type":                100,
+				"audioType":           "default",
+				"inputLatencyMicros":  0,
+				"outputLatencyMicros": int64(latency / time.Microsecond),
+			},
+		},
+		"txtRAOP": encodeTxt(values),
+	}
+}
+
+// Answer GET /info with the receiver info as a binary property list, or as
+// an XML property list if the sender only accepts XML.
+func (rs *rtspSession) handleGet(rw http.ResponseWriter, req *http.Request) error {
+	if req.URL == nil || req.URL.Path != "/info" {
+		return newRTSPError(404, nil, "Unknown path")
+	}
+
+	info := rs.raop.receiverInfo()
+	content := bytes.NewBufferString("")
+	var err error
+	contentType := "application/x-apple-binary-plist"
+	if strings.Contains(req.Header.Get("Accept"), "xml") {
+		contentType = "text/x-apple-plist+xml"
+		err = encodePlistXML(content, info)
+	} else {
+		err = encodeBinaryPlist(content, info)
+	}
+	if err != nil {
+		return newRTSPError(500, err, "Could not encode info")
+	}
+
+	h := rw.Header()
+	h.Add("Content-Type", contentType)
+	h.Add("Content-Length", strconv.Itoa(content.Len()))
+	_, err = content.WriteTo(rw)
+	return err
+}
@@ -0,0 +1,274 @@
+package raopd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var errReplayDacp = errors.New("There is no DACP connection when replaying")
+
+// replayConn is the connection of a replayed RTSP connection. It only has
+// the addresses of the captured connection, nothing is read or written.
+type replayConn struct {
+	local, remote net.Addr
+}
+
+func (c *replayConn) Read(b []byte) (int, error)         { return 0, io.EOF }
+func (c *replayConn) Write(b []byte) (int, error)        { return len(b), nil }
+func (c *replayConn) Close() error                       { return nil }
+func (c *replayConn) LocalAddr() net.Addr                { return c.local }
+func (c *replayConn) RemoteAddr() net.Addr               { return c.remote }
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func replayAddr(s string) net.Addr {
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		return &net.TCPAddr{}
+	}
+	p, _ := strconv.Atoi(port)
+	return &net.TCPAddr{IP: net.ParseIP(host), Port: p}
+}
+
+// A DACP which never connects to the source.
+func newReplayDacp(sink Sink) *dacp {
+	d := &dacp{}
+	d.mrc = make(chan func() error)
+	d.crc = make(chan func() error, 12)
+	d.sink = sink
+	go func() {
+		for range d.mrc {
+		}
+	}()
+	return d
+}
+
+type replayer struct {
+	i        *info
+	r        *raop
+	conns    map[uint32]*rtspSession
+	handlers map[*session]map[byte]rtpHandler
+	status   map[uint32]int // The status of the last replayed response
+}
+
+/*
+Replay feeds a capture made with Source.Capture through the RTSP and RTP
+handling of the sink without using the network. Everything is replayed
+in the order it was captured, as fast as possible. The decoded audio is
+written to audio, which may be nil, without the target latency of the
+sink. The capture must have been made with the key of the collection for
+the audio to be decrypted.
+
+An error is returned if the capture can not be read or if the status of a
+replayed response differs from the captured response.
+*/
+func (sc *SinkCollection) Replay(r io.Reader, sink Sink, audio io.Writer) error {
+	ra := &raop{}
+	ra.sink = sink
+	ra.acs = sc
+	ra.setupUdp = replaySetupUdp
+	ra.unbuffered = true
+	if si := sink.Info(); si != nil {
+		ra.hwaddr = si.HardwareAddress
+	}
+	ra.dacp = newReplayDacp(sink)
+	defer close(ra.dacp.mrc)
+	ra.vol = newVolumeHandler(sink.Info(), sink.SetVolume, func(cmd string) error {
+		return errReplayDacp
+	})
+	if audio != nil {
+		ra.newStream(context.Background(), audio, AudioStreamOptions{})
+		defer ra.closeStreams()
+	}
+
+	rp := &replayer{i: sc.i, r: ra}
+	rp.conns = make(map[uint32]*rtspSession)
+	rp.handlers = make(map[*session]map[byte]rtpHandler)
+	rp.status = make(map[uint32]int)
+	defer rp.close()
+
+	rd := bufio.NewReader(r)
+	if err := readCaptureMagic(rd); err != nil {
+		return err
+	}
+	for n := 1; ; n++ {
+		cr, err := readCaptureRecord(rd)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err = rp.replay(cr); err != nil {
+			return fmt.Errorf("Replay of record %d failed: %w", n, err)
+		}
+	}
+}
+
+// Set up a session for UDP without a network. The captured RTP packets are
+// fed to the handlers directly.
+func replaySetupUdp(s *session, req *http.Request, h http.Header, controlPort, timingPort int) error {
+	s.startSequencer()
+	h.Add("Transport", "RTP/AVP/UDP;unicast;mode=record;timing_port=0;events;control_port=0;server_port=0")
+	return nil
+}
+
+// Returns the connection with the id, creating it if necessary.
+func (rp *replayer) connection(id uint32) *rtspSession {
+	rs, ok := rp.conns[id]
+	if !ok {
+		rs = &rtspSession{i: rp.i, raop: rp.r, id: id}
+		rs.c = &replayConn{&net.TCPAddr{}, &net.TCPAddr{}}
+		rp.conns[id] = rs
+	}
+	return rs
+}
+
+// Release the session of the connection and forget the connection.
+func (rp *replayer) closeConnection(id uint32, reason error) {
+	rs := rp.conns[id]
+	if rs.s != nil {
+		rs.s.sync()
+		rp.r.release(rs.s, reason)
+		delete(rp.handlers, rs.s)
+	}
+	delete(rp.conns, id)
+}
+
+// Close all connections left open at the end of the capture.
+func (rp *replayer) close() {
+	for id := range rp.conns {
+		rp.closeConnection(id, ErrShutdown)
+	}
+}
+
+// Returns the RTP handler for the kind of packet of the session.
+func (rp *replayer) rtpHandler(s *session, kind byte) rtpHandler {
+	handlers, ok := rp.handlers[s]
+	if !ok {
+		data, _, _ := s.getDataHandler(nil)
+		control, _, _ := s.getControlHandler(nil)
+		timing, _, _ := s.getTimingHandler(nil)
+		handlers = map[byte]rtpHandler{
+			captureData:    data,
+			captureControl: control,
+			captureTiming:  timing,
+		}
+		rp.handlers[s] = handlers
+	}
+	return handlers[kind]
+}
+
+func (rp *replayer) replay(cr *captureRecord) error {
+	rs := rp.connection(cr.conn)
+	switch cr.kind {
+	case captureOpen:
+		addrs := strings.SplitN(string(cr.payload), "\n", 2)
+		if len(addrs) != 2 {
+			return errors.New("Malformed open record")
+		}
+		rs.c = &replayConn{replayAddr(addrs[0]), replayAddr(addrs[1])}
+
+	case captureRequest:
+		req, err := rs.readRequest(newRTSPReader(bytes.NewReader(cr.payload)))
+		if err != nil {
+			return err
+		}
+		if rs.s != nil {
+			// Handle all audio received before the request first
+			rs.s.sync()
+			if req.Header.Get("Session") != "" {
+				req.Header.Set("Session", rs.s.id)
+			}
+		}
+		response := bytes.NewBufferString("")
+		rw := newRtspResponseWriter(bufio.NewWriter(response))
+		rs.handle(rw, req)
+		rw.finishResponse()
+		rp.status[cr.conn] = responseStatus(response.Bytes())
+
+	case captureResponse:
+		captured := responseStatus(cr.payload)
+		if rp.status[cr.conn] != captured {
+			return fmt.Errorf("Response status %d, captured status %d", rp.status[cr.conn], captured)
+		}
+		// Use the captured nonce so the following requests authenticate
+		if params, ok := parseDigestAuthorization(responseHeader(cr.payload, "WWW-Authenticate")); ok {
+			rs.nonce = params["nonce"]
+		}
+
+	case captureData, captureControl, captureTiming:
+		if rs.s == nil || len(cr.payload) < 12 || len(cr.payload) > max_rtp_packet_size {
+			capturelog.Debug.Println("Ignoring RTP packet, length=", len(cr.payload))
+			return nil
+		}
+		pkt := makeRtpPacket()
+		pkt.content = pkt.buf[0:len(cr.payload)]
+		copy(pkt.content, cr.payload)
+		pkt.sn = decodeSeqno(pkt.content[2:4])
+		rp.rtpHandler(rs.s, cr.kind)(pkt)
+		if cr.kind == captureData {
+			// Replaying is faster than real time, wait for the audio to
+			// be written so none is dropped
+			rs.s.sync()
+		}
+
+	case captureInterleaved:
+		if len(cr.payload) < 4 || len(cr.payload) > max_rtp_packet_size+4 {
+			return errors.New("Malformed interleaved record")
+		}
+		pkt := makeRtpPacket()
+		pkt.content = pkt.buf[0 : len(cr.payload)-4]
+		copy(pkt.content, cr.payload[4:])
+		rs.handleInterleaved(cr.payload[1], pkt)
+		if rs.s != nil {
+			rs.s.sync()
+		}
+
+	case captureClose:
+		rp.closeConnection(cr.conn, ErrDisconnected)
+
+	default:
+		return fmt.Errorf("Unknown record kind %d", cr.kind)
+	}
+	return nil
+}
+
+// Returns the status code of an RTSP response or -1 if it is malformed.
+func responseStatus(response []byte) int {
+	line := strings.SplitN(string(response), "\r\n", 2)[0]
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 2 {
+		return -1
+	}
+	status, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return -1
+	}
+	return status
+}
+
+// Returns the value of a header of an RTSP response.
+func responseHeader(response []byte, name string) string {
+	lines := strings.Split(string(response), "\r\n")
+	for _, line := range lines[1:] {
+		if line == "" {
+			break
+		}
+		kv := strings.SplitN(line, ":", 2)
+		if len(kv) == 2 && strings.EqualFold(strings.TrimSpace(kv[0]), name) {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
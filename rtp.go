@@ -2,9 +2,12 @@ package raopd
 
 import (
 	"bytes"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"net"
+	"sync"
+	"time"
 )
 
 var rtplog = getLogger("raopd.rtp", "RTP Real Time Protocol")
@@ -12,14 +15,24 @@ var rtplog = getLogger("raopd.rtp", "RTP Real Time Protocol")
 const max_rtp_packet_size = 1800
 
 type rtpHandler func(pkt *rtpPacket)
-type rtpTransmitter func(conn *net.UDPConn)
+type rtpTransmitter func(conn *net.UDPConn, quit chan struct{})
 type rtpFactory func(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter, string)
 
 func (pkt *rtpPacket) payloadType() uint8 {
 	return pkt.content[1] & 0x7f
 }
 
-type rtp net.UDPConn
+// The RTP timestamp of an audio packet, the first sample of the packet.
+func (pkt *rtpPacket) rtptime() uint32 {
+	return binary.BigEndian.Uint32(pkt.content[4:8])
+}
+
+type rtp struct {
+	*net.UDPConn
+	quit      chan struct{}
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
 
 func (r *rtp) Port() int {
 	claddr := r.LocalAddr()
@@ -31,12 +44,34 @@ func (r *rtp) Teardown() {
 	r.Close()
 }
 
-func (r *raop) getDataHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter, string) {
+// Close the RTP socket and wait for the receiver and transmitter
+// go-routines to exit.
+func (r *rtp) Close() error {
+	var err error
+	r.closeOnce.Do(func() {
+		close(r.quit)
+		err = r.UDPConn.Close()
+	})
+	r.wg.Wait()
+	return err
+}
+
+func (r *rtp) closing() bool {
+	select {
+	case <-r.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *session) getDataHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter, string) {
 	prefix := fmt.Sprint("DATA:", raddr, ": ")
 	return func(pkt *rtpPacket) {
-		if pkt.payloadType() == 96 {
+		if int(pkt.payloadType()) == s.payloadType {
+			s.watchdog.data()
 			pkt.recovery = false
-			r.seqchan <- pkt
+			s.queue(pkt)
 		} else {
 			rtplog.Debug.Println(prefix, " unknown payload type ", pkt.payloadType())
 			pkt.Reclaim()
@@ -44,14 +79,12 @@ func (r *raop) getDataHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter, s
 	}, nil, "DATA"
 }
 
-func (r *raop) getControlHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter, string) {
+func (s *session) getControlHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter, string) {
 	prefix := fmt.Sprint("CONTROL:", raddr, ": ")
 	rx := func(pkt *rtpPacket) {
 		switch pkt.payloadType() {
 		case 84:
-			// Not doing time sync yet...
-			// binary.BigEndian.Uint64(pkt.content[8:16])   = NTP Time
-			// binary.BigEndian.Uint32(pkt.content[16:20])  = RTP Timestamp for next packet
+			s.clock.handleSync(pkt.content, time.Now())
 			pkt.Reclaim()
 
 		case 85:
@@ -72,7 +105,7 @@ func (r *raop) getControlHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter
 					rtplog.Info.Println(prefix, "Resend fail assertion error, zero=", zero)
 				}
 				pkt.Reclaim()
-				r.sequencer.flush()
+				s.sequencer.flush()
 			} else {
 				pkt.content = pkt.content[4:]
 				pkt.sn = decodeSeqno(pkt.content[2:4])
@@ -85,7 +118,7 @@ func (r *raop) getControlHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter
 					}
 					rtplog.Debug.Println(prefix, " Unknown Recovery Packet: ", hex.Dump(base[0:l]))
 				}
-				r.seqchan <- pkt
+				s.queue(pkt)
 			}
 
 		default:
@@ -93,14 +126,16 @@ func (r *raop) getControlHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter
 			pkt.Reclaim()
 		}
 	}
-	tx := func(conn *net.UDPConn) {
+	tx := func(conn *net.UDPConn, quit chan struct{}) {
 		buf := make([]byte, 32)
 		sn := seqno(1)
 		//		timestamp := uint32(1)
 
 		for {
 			select {
-			case rr := <-r.rrchan:
+			case <-quit:
+				return
+			case rr := <-s.rrchan:
 				rtplog.Debug.Println(prefix, "ReRequest:", sn, ", rr=", rr)
 				buf[0] = 0x80
 				buf[1] = 85 + 0x80
@@ -118,11 +153,42 @@ func (r *raop) getControlHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter
 	return rx, tx, "CONTROL"
 }
 
-func (r *raop) getTimingHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter, string) {
-	return func(pkt *rtpPacket) {
-		// Ignoring any incoming packets.
+func (s *session) getTimingHandler(raddr *net.UDPAddr) (rtpHandler, rtpTransmitter, string) {
+	prefix := fmt.Sprint("TIMING:", raddr, ": ")
+	rx := func(pkt *rtpPacket) {
+		switch pkt.payloadType() {
+		case 83:
+			s.clock.handleTimingResponse(pkt.content, time.Now())
+		case 82:
+			// The source may query our clock too but replies are not needed
+			rtplog.Debug.Println(prefix, "Ignoring timing request")
+		default:
+			rtplog.Debug.Println(prefix, "Unknown payload type ", pkt.payloadType())
+		}
 		pkt.Reclaim()
-	}, nil, "TIMING"
+	}
+	if raddr == nil {
+		return rx, nil, "TIMING"
+	}
+	tx := func(conn *net.UDPConn, quit chan struct{}) {
+		buf := make([]byte, 32)
+		sn := seqno(7)
+		ticker := time.NewTicker(timingInterval)
+		defer ticker.Stop()
+
+		for {
+			if _, err := conn.Write(encodeTimingRequest(buf, sn, time.Now())); err != nil {
+				rtplog.Debug.Println(prefix, "Timing request failed:", err)
+			}
+			sn++
+			select {
+			case <-quit:
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+	return rx, tx, "TIMING"
 }
 
 func sameUDPAddr(a, b *net.UDPAddr) bool {
@@ -148,10 +214,13 @@ func startRtp(f rtpFactory, raddr *net.UDPAddr) (*rtp, error) {
 		return nil, err
 	}
 
+	r := &rtp{UDPConn: conn, quit: make(chan struct{})}
 	handler, tx, name := f(raddr)
 	rtplog.Debug.Println("Starting RTP server ", name, " at conn local=", conn.LocalAddr(), ", remote=", conn.RemoteAddr())
 	if handler != nil {
+		r.wg.Add(1)
 		go func() {
+			defer r.wg.Done()
 			defer func() { conn.Close() }()
 			for {
 				pkt := makeRtpPacket()
@@ -160,7 +229,11 @@ func startRtp(f rtpFactory, raddr *net.UDPAddr) (*rtp, error) {
 				var err error
 				n, err = conn.Read(pkt.buf)
 				if err != nil {
-					rtplog.Info.Println("Panic err=", err)
+					if r.closing() {
+						rtplog.Debug.Println("Closed RTP server ", name)
+					} else {
+						rtplog.Info.Println("Panic err=", err)
+					}
 					return // Exit RTP server
 				}
 				pkt.content = pkt.buf[0:n]
@@ -172,8 +245,11 @@ func startRtp(f rtpFactory, raddr *net.UDPAddr) (*rtp, error) {
 		}()
 	}
 	if tx != nil {
-		go tx(conn)
-		tx = nil
+		r.wg.Add(1)
+		go func() {
+			defer r.wg.Done()
+			tx(conn, r.quit)
+		}()
 	}
-	return (*rtp)(conn), nil
+	return r, nil
 }
@@ -20,20 +20,20 @@ func checkSeqNo(t *testing.T, q chan *rtpPacket, expected int) {
 }
 
 func TestRtpDataReceive(t *testing.T) {
-	r := &raop{}
-	r.seqchan = make(chan *rtpPacket, 16)
+	s := &session{payloadType: 96}
+	s.seqchan = make(chan *rtpPacket, 16)
 
-	handler, _, _ := r.getDataHandler(nil)
+	handler, _, _ := s.getDataHandler(nil)
 
 	pkt := testPacket(66, 96)
 	handler(pkt)
 
-	checkSeqNo(t, r.seqchan, 66)
-	checkSeqNo(t, r.seqchan, -1)
+	checkSeqNo(t, s.seqchan, 66)
+	checkSeqNo(t, s.seqchan, -1)
 }
 
-func startRtpMock(r *raop, f rtpFactory) *net.UDPConn {
-	r.seqchan = make(chan *rtpPacket, 16)
+func startRtpMock(s *session, f rtpFactory) *net.UDPConn {
+	s.seqchan = make(chan *rtpPacket, 16)
 
 	rtp, err := startRtp(f, nil)
 	if err != nil {
@@ -49,21 +49,21 @@ func startRtpMock(r *raop, f rtpFactory) *net.UDPConn {
 }
 
 func TestRtpDataReceive2(t *testing.T) {
-	r := &raop{}
-	conn := startRtpMock(r, r.getDataHandler)
+	s := &session{payloadType: 96}
+	conn := startRtpMock(s, s.getDataHandler)
 
 	conn.Write(testPacket(66, 96).content)
 
-	checkSeqNo(t, r.seqchan, 66)
-	checkSeqNo(t, r.seqchan, -1)
+	checkSeqNo(t, s.seqchan, 66)
+	checkSeqNo(t, s.seqchan, -1)
 }
 
 func TestRtpControlReceive(t *testing.T) {
-	r := &raop{}
-	conn := startRtpMock(r, r.getControlHandler)
+	s := &session{}
+	conn := startRtpMock(s, s.getControlHandler)
 
 	conn.Write(testPacket(68, 86).content)
 
-	checkSeqNo(t, r.seqchan, 0) // Will rewrite the packet and therefore the sequence number
-	checkSeqNo(t, r.seqchan, -1)
+	checkSeqNo(t, s.seqchan, 0) // Will rewrite the packet and therefore the sequence number
+	checkSeqNo(t, s.seqchan, -1)
 }
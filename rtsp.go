@@ -3,16 +3,21 @@ package raopd
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"crypto/aes"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
-	"net/textproto"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var rtsplog = getLogger("raopd.rtsp", "Real Time Session Protocol")
@@ -24,12 +29,24 @@ var rtsplog = getLogger("raopd.rtsp", "Real Time Session Protocol")
 type rtspServer struct {
 	i    *info
 	raop *raop
+
+	m       sync.Mutex
+	l       net.Listener
+	conns   map[*rtspSession]bool
+	closing bool
+	wg      sync.WaitGroup // The server and all its connections
 }
 
 type rtspSession struct {
 	i    *info
 	raop *raop
 	c    net.Conn
+	s    *session // The session of the connection, nil until announced
+	id   uint32   // Identifies the connection in captures
+
+	nonce string // Digest authentication nonce
+
+	closeReason atomic.Value // Why the connection was closed by us
 }
 
 type rtspResponseWriter struct {
@@ -68,15 +85,57 @@ func makeRtspServer(i *info, raop *raop) *rtspServer {
 	r := &rtspServer{}
 	r.i = i
 	r.raop = raop
+	r.conns = make(map[*rtspSession]bool)
 	return r
 }
 
-func (r *rtspServer) Close() {
-	// TODO: Close the RTSP server and possible the RTP servers as well.
+// Start serving RTSP connections from the listener in a separate go-routine.
+func (r *rtspServer) start(l net.Listener) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	r.l = l
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		r.Serve(l)
+	}()
 }
 
-func statusMap(code int) string {
-	return "OK"
+// Close the RTSP server, all its connections and wait for them to finish.
+func (r *rtspServer) Close() error {
+	return r.Shutdown(context.Background())
+}
+
+// Shutdown closes the listener and all open connections. It waits for all
+// connections to finish or until the context is done.
+func (r *rtspServer) Shutdown(ctx context.Context) error {
+	var err error
+
+	r.m.Lock()
+	if !r.closing {
+		r.closing = true
+		if r.l != nil {
+			err = r.l.Close()
+		}
+	}
+	for rs := range r.conns {
+		rs.closeWithReason(ErrShutdown)
+	}
+	r.m.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return errors.Join(err, ctx.Err())
+	}
 }
 
 func (t *rtspResponseWriter) WriteHeader(statusCode int) {
@@ -91,6 +150,7 @@ func (t *rtspResponseWriter) WriteHeader(statusCode int) {
 			}
 		}
 		t.wr.WriteString("\r\n")
+		t.written = true
 	}
 }
 
@@ -98,12 +158,36 @@ func (r *rtspServer) Serve(l net.Listener) error {
 	for {
 		c, err := l.Accept()
 		if err != nil {
+			r.m.Lock()
+			closing := r.closing
+			r.m.Unlock()
+			if closing {
+				return nil
+			}
 			return err
 		}
-		rs := &rtspSession{r.i, r.raop, c}
-		go rs.runRtspServerSession(c)
+		rs := &rtspSession{i: r.i, raop: r.raop, c: c}
+		rs.id = atomic.AddUint32(&r.raop.connections, 1)
+
+		r.m.Lock()
+		if r.closing {
+			r.m.Unlock()
+			c.Close()
+			return nil
+		}
+		r.conns[rs] = true
+		r.wg.Add(1)
+		r.m.Unlock()
+
+		go func() {
+			defer r.wg.Done()
+			rs.runRtspServerSession(c)
+
+			r.m.Lock()
+			delete(r.conns, rs)
+			r.m.Unlock()
+		}()
 	}
-
 }
 
 func (rs *rtspSession) handleChallenge(challenge string) (string, error) {
@@ -119,297 +203,681 @@ func readToString(r io.Reader) string {
 	return b.String()
 }
 
-func scanf(s, f string, t ...interface{}) bool {
-	n, _ := fmt.Sscanf(s, f, t...)
-	return n > 0
-}
-
 func (rs *rtspSession) handle(rw http.ResponseWriter, req *http.Request) {
 	h := rw.Header()
 	h.Add("Cseq", req.Header.Get("Cseq"))
 	h.Add("Apple-Jack-Status", "connected; type=analog")
 
+	if err := rs.authenticate(req); err != nil {
+		h.Add("WWW-Authenticate", rs.digestChallenge())
+		rs.reject(rw, req, err)
+		return
+	}
+
 	dacpid := req.Header.Get("Dacp-Id")
 	activeremote := req.Header.Get("Active-Remote")
-	if dacpid != "" && activeremote != "" {
+	if dacpid != "" && activeremote != "" && rs.raop.isOwnedBy(rs) {
 		rs.raop.dacp.open(dacpid, activeremote)
 	}
 
 	rtsplog.Debug.Println("RTSP: method=", req.Method, ", client=", req.RemoteAddr)
 
+	if err := rs.checkSession(req); err != nil {
+		rs.reject(rw, req, err)
+		return
+	}
+	if rs.s != nil {
+		rs.s.watchdog.request()
+	}
+
+	if handler := rs.raop.acs.rtspHandler(req); handler != nil {
+		handler.ServeRTSP(rw, req, rs)
+		return
+	}
+
+	var err error
 	switch req.Method {
 	case "OPTIONS":
-		h.Add("Public", "ANNOUNCE, SETUP, RECORD, PAUSE, FLUSH, TEARDOWN, OPTIONS, GET_PARAMETER, SET_PARAMETER")
-		challenge := req.Header.Get("Apple-Challenge")
-		if challenge != "" {
-			response, err := rs.handleChallenge(challenge)
-			if err != nil {
-				rtsplog.Info.Println("Could not handle challenge: ", challenge, ":", err)
-				rw.WriteHeader(400)
-				return
-			}
+		err = rs.handleOptions(rw, req)
+	case "ANNOUNCE":
+		err = rs.handleAnnounce(rw, req)
+	case "SETUP":
+		err = rs.handleSetup(rw, req)
+	case "GET":
+		err = rs.handleGet(rw, req)
+	case "GET_PARAMETER":
+		err = rs.handleGetParameter(rw, req)
+	case "SET_PARAMETER":
+		err = rs.handleSetParameter(rw, req)
+	case "RECORD":
+		err = rs.handleRecord(rw, req)
+	case "PAUSE":
+		rtsplog.Debug.Println("....................... PAUSE?")
+		rs.s.watchdog.setPlaying(false)
+		rs.raop.sink.Pause()
+	case "FLUSH":
+		err = rs.handleFlush(rw, req)
+	case "TEARDOWN":
+		rs.raop.release(rs.s, ErrTeardown)
+		rs.s = nil
+	default:
+		err = newRTSPError(501, nil, "Unknown method")
+	}
+	if err != nil {
+		rs.reject(rw, req, err)
+	}
+}
 
-			h.Add("Apple-Response", response)
-		}
+// reject answers the request with the status of the error and lets the
+// sink know why the sender was rejected.
+func (rs *rtspSession) reject(rw http.ResponseWriter, req *http.Request, err error) {
+	re := toRTSPError(err)
+	re.Method = req.Method
+	if req.URL != nil {
+		re.URI = req.URL.String()
+	}
+	re.Remote = req.RemoteAddr
+	rw.WriteHeader(re.StatusCode)
+	rs.rejected(re)
+}
 
-	case "ANNOUNCE":
+// Let the sink know that a request from the sender was rejected.
+func (rs *rtspSession) rejected(re *RTSPError) {
+	rtsplog.Info.Println("Rejected request:", re)
+	if rh, ok := rs.raop.sink.(SinkRejectionHandler); ok {
+		rh.Rejected(re)
+	}
+}
 
-		var rdr io.Reader
-		cl, ok := req.Header["Content-Length"]
-		if ok {
-			clen, err := strconv.ParseInt(cl[0], 10, 32)
-			if err != nil {
-				rtsplog.Info.Println("Malformed Content-Length: ", clen, ":", err)
-				rw.WriteHeader(400)
-				return
-			}
-			rtsplog.Debug.Println("Content-Length=", clen)
-			rdr = io.LimitReader(req.Body, clen)
-		} else {
-			rdr = req.Body
-		}
-		sdp := makeSdpRecords(rdr)
-		remote := sdp["c"]
-		rtpmap := sdp["a=rtpmap"]
-		fmtp := sdp["a=fmtp"]
+// Methods which need an announced session.
+var rtspSessionMethods = map[string]bool{
+	"SETUP":    true,
+	"RECORD":   true,
+	"PAUSE":    true,
+	"FLUSH":    true,
+	"TEARDOWN": true,
+}
 
-		aeskey, err := rs.i.rsaKeyDecrypt(sdp["a=rsaaeskey"])
-		if err != nil {
-			rtsplog.Info.Println("Could not decrypt AES key, key=", sdp["a=rsaaeskey"], ", :", err)
-			rw.WriteHeader(400)
-			return
+// checkSession verifies that the request is valid for the session state of
+// the connection and that any Session header matches the session.
+func (rs *rtspSession) checkSession(req *http.Request) error {
+	if rtspSessionMethods[req.Method] && rs.s == nil {
+		return newRTSPError(455, nil, "No session has been announced")
+	}
+	if id := req.Header.Get("Session"); id != "" {
+		if rs.s == nil || sessionIdFromHeader(id) != rs.s.id {
+			return newRTSPError(454, nil, "Unknown session ", id)
 		}
-		aesiv, err := rs.i.rsaKeyParseIv(sdp["a=aesiv"])
+	}
+	return nil
+}
+
+func (rs *rtspSession) handleOptions(rw http.ResponseWriter, req *http.Request) error {
+	h := rw.Header()
+	h.Add("Public", "ANNOUNCE, SETUP, RECORD, PAUSE, FLUSH, TEARDOWN, OPTIONS, GET_PARAMETER, SET_PARAMETER")
+	challenge := req.Header.Get("Apple-Challenge")
+	if challenge != "" {
+		response, err := rs.handleChallenge(challenge)
 		if err != nil {
-			rtsplog.Info.Println("Could not parse IV, aesiv=", sdp["a=aesiv"], ", :", err)
-			rw.WriteHeader(400)
-			return
+			return newRTSPError(400, err, "Could not handle challenge ", challenge)
 		}
 
-		rtsplog.Debug.Println("AESKEY=", aeskey)
-		rtsplog.Debug.Println("AESIV=", aesiv)
-		rs.raop.aeskey, err = aes.NewCipher(aeskey)
-		rs.raop.aesiv = aesiv
+		h.Add("Apple-Response", response)
+	}
+	return nil
+}
 
+func (rs *rtspSession) handleAnnounce(rw http.ResponseWriter, req *http.Request) error {
+	sd, err := parseSDP(req.Body)
+	if err != nil {
+		return newRTSPError(400, err, "Could not parse SDP")
+	}
+	md := sd.findMedia("audio")
+	if md == nil || len(md.formats) == 0 {
+		return newRTSPError(400, nil, "No audio media in SDP")
+	}
+	pt := md.formats[0]
+	rtpmap, fmtp := md.rtpmaps[pt], md.fmtps[pt]
+	if rtpmap == nil {
+		rtpmap = staticRtpmaps[pt]
+	}
+	if rtpmap == nil {
+		return newRTSPError(415, nil, "No rtpmap for payload type ", pt)
+	}
+	remote := sd.connectionOf(md)
+	if remote == nil {
+		return newRTSPError(400, nil, "No connection in SDP")
+	}
+
+	var dec audioDecoder
+	if rsaaeskey, ok := sd.attribute(md, "rsaaeskey"); ok {
+		err = rs.initDecryption(&dec, rsaaeskey, sd, md)
 		if err != nil {
-			rtsplog.Info.Println("Could not initialize cipher, key=", rs.raop.aeskey, ", :", err)
-			rw.WriteHeader(400)
-			return
-		}
-		rtsplog.Debug.Println("RAOP AESKEY=", rs.raop.aeskey)
-		err = rs.raop.setRemote(remote)
-		if err != nil {
-			rtsplog.Info.Println("Could not set remote:", err)
-			rw.WriteHeader(500)
-			return
+			return err
 		}
-		err = rs.raop.initAlac(rtpmap, fmtp)
+	} else {
+		// et=0, the audio is not encrypted
+		rtsplog.Debug.Println("No AES key, the stream is unencrypted")
+	}
+	if si := rs.raop.sink.Info(); si != nil {
+		dec.native = si.NativeAudioFormat
+	}
+	err = dec.initCodec(rtpmap, fmtp)
+	if err != nil {
+		return newRTSPError(415, err, "Could not initialize codec, rtpmap=", rtpmap)
+	}
+
+	s, err := rs.raop.claim(rs)
+	if err != nil {
+		return err
+	}
+	rs.s = s
+	rs.raop.sessionMutex.Lock() // The format may be read by Source.StreamFormat
+	s.audioDecoder = dec
+	s.payloadType = pt
+	s.startOutput()
+	rs.raop.sessionMutex.Unlock()
+	s.remote = remote.address
+	if fh, ok := rs.raop.sink.(SinkFormatHandler); ok {
+		fh.SetStreamFormat(dec.format)
+	}
+	return nil
+}
+
+// Decrypt the AES key of the stream and set up decryption of the audio.
+func (rs *rtspSession) initDecryption(dec *audioDecoder, rsaaeskey string, sd *sessionDescription, md *mediaDescription) error {
+	aeskey, err := rs.i.rsaKeyDecrypt(rsaaeskey)
+	if err != nil {
+		return newRTSPError(400, err, "Could not decrypt AES key, key=", rsaaeskey)
+	}
+	iv, _ := sd.attribute(md, "aesiv")
+	aesiv, err := rs.i.rsaKeyParseIv(iv)
+	if err != nil {
+		return newRTSPError(400, err, "Could not parse IV, aesiv=", iv)
+	}
+	if len(aesiv) != aes.BlockSize {
+		return newRTSPError(400, nil, "Wrong IV length, aesiv=", iv)
+	}
+
+	rtsplog.Debug.Println("AESKEY=", aeskey)
+	rtsplog.Debug.Println("AESIV=", aesiv)
+	dec.aeskey, err = aes.NewCipher(aeskey)
+	dec.aesiv = aesiv
+
+	if err != nil {
+		return newRTSPError(400, err, "Could not initialize cipher")
+	}
+	rtsplog.Debug.Println("RAOP AESKEY=", dec.aeskey)
+	return nil
+}
+
+func (rs *rtspSession) handleSetup(rw http.ResponseWriter, req *http.Request) error {
+	h := rw.Header()
+	s := rs.s
+
+	s.clientUserAgent = req.Header.Get("User-Agent")
+
+	dataChannel, controlChannel, tcp, err := getInterleavedChannels(req.Header.Get("Transport"))
+	if err != nil {
+		return newRTSPError(461, err, "Could not get interleaved channels, Transport=", req.Header.Get("Transport"))
+	}
+	if tcp {
+		s.startInterleaved(dataChannel, controlChannel)
+		h.Add("Transport", fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%d-%d;mode=record", dataChannel, controlChannel))
+		h.Add("Session", s.id)
+		return nil
+	}
+
+	controlPort, timingPort, err := getPortsFromTransport(req.Header.Get("Transport"))
+	if err != nil {
+		return newRTSPError(461, err, "Could not get transport ports, Transport=", req.Header.Get("Transport"))
+	}
+	setup := rs.raop.setupUdp
+	if setup == nil {
+		setup = setupUdp
+	}
+	if err = setup(s, req, h, controlPort, timingPort); err != nil {
+		return err
+	}
+	h.Add("Session", s.id)
+	return nil
+}
+
+// Start receiving RTP over UDP from the control and timing ports of the
+// source and add the Transport with the local ports to the response.
+func setupUdp(s *session, req *http.Request, h http.Header, controlPort, timingPort int) error {
+	local := req.URL.Hostname()
+	if ii := strings.Index(local, "%"); ii >= 0 {
+		local = local[:ii] // The zone is found from the address
+	}
+	rtsplog.Debug.Println("LOCAL IS ", local)
+	zone, err := interfaceNameFromHost(local)
+	if err != nil {
+		return newRTSPError(400, err, "Could not find interface from host=", local)
+	}
+	rtsplog.Debug.Println("ZONE IS ", zone)
+	controlAddr := &net.UDPAddr{IP: s.remote, Port: controlPort, Zone: zone}
+	timingAddr := &net.UDPAddr{IP: s.remote, Port: timingPort, Zone: zone}
+
+	err = s.startRtp(controlAddr, timingAddr)
+	if err != nil {
+		h.Add("FailureCause", err.Error())
+		return newRTSPError(500, err, "Failed to start RTP")
+	}
+	transport := fmt.Sprintf("RTP/AVP/UDP;unicast;mode=record;timing_port=%d;events;control_port=%d;server_port=%d",
+		s.timing.Port(), s.control.Port(), s.data.Port())
+	h.Add("Transport", transport)
+	return nil
+}
+
+func (rs *rtspSession) handleRecord(rw http.ResponseWriter, req *http.Request) error {
+	s := rs.s
+
+	rtpinfo := req.Header.Get("RTP-Info")
+	if rtpinfo != "" {
+		sn, rtptime, err := parseRTPInfo(rtpinfo)
 		if err != nil {
-			rtsplog.Info.Println("Could not initialize ALAC:", err)
-			rw.WriteHeader(500)
-			return
+			return newRTSPError(400, err, "Malformed RTP-Info ", rtpinfo)
 		}
-	case "SETUP":
-		raop := rs.raop
+		s.record(sn, rtptime)
+	}
+	rw.Header().Add("Audio-Latency", strconv.FormatInt(s.audioLatency(), 10))
 
-		raop.clientUserAgent = req.Header.Get("User-Agent")
+	s.watchdog.setPlaying(true)
+	rs.raop.sink.Play()
+	return nil
+}
 
-		session := "DEADBEEF"
+func (rs *rtspSession) handleFlush(rw http.ResponseWriter, req *http.Request) error {
+	s := rs.s
+	s.watchdog.setPlaying(false)
 
-		controlPort, timingPort, err := getPortsFromTransport(req.Header.Get("Transport"))
+	rtpinfo := req.Header.Get("RTP-Info")
+	if rtpinfo == "" {
+		s.flush()
+	} else {
+		sn, _, err := parseRTPInfo(rtpinfo)
 		if err != nil {
-			rtsplog.Info.Println("Could not transport ports, Transport=", req.Header.Get("Transport"), ", :", err)
-			rw.WriteHeader(400)
-			return
+			return newRTSPError(400, err, "Malformed RTP-Info ", rtpinfo)
 		}
-		local := req.URL.Host
-		rtsplog.Debug.Println("LOCAL IS ", local)
-		zone, err := interfaceNameFromHost(local)
-		if err != nil {
-			rtsplog.Info.Println("Could not find interface from host=", local, ", :", err)
-			rw.WriteHeader(400)
-			return
+		s.flushTo(sn)
+	}
+
+	if fh, ok := rs.raop.sink.(SinkFlushHandler); ok {
+		fh.Flush()
+	}
+	return nil
+}
+
+// Parse an RTP-Info header, i.e. "seq=1234;rtptime=5678". Only the first
+// stream is used if there are several.
+func parseRTPInfo(h string) (sn seqno, rtptime uint32, err error) {
+	hasSeq := false
+	stream := strings.SplitN(h, ",", 2)[0]
+	for _, param := range strings.Split(stream, ";") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			continue
 		}
-		rtsplog.Debug.Println("ZONE IS ", zone)
-		controlAddr := &net.UDPAddr{IP: raop.remote, Port: controlPort, Zone: zone}
-		timingAddr := &net.UDPAddr{IP: raop.remote, Port: timingPort, Zone: zone}
-
-		err = rs.raop.startRtp(controlAddr, timingAddr)
-		if err == nil {
-			transport := fmt.Sprintf("RTP/AVP/UDP;unicast;mode=record;timing_port=%d;events;control_port=%d;server_port=%d\nSession: %s",
-				raop.timing.Port(), raop.control.Port(), raop.data.Port(), session)
-			h.Add("Transport", transport)
-		} else {
-			rtsplog.Info.Println("Failed to start RTP: ", err)
-			h.Add("FailureCause", err.Error())
-			rw.WriteHeader(http.StatusInternalServerError)
-			return
+		switch strings.ToLower(kv[0]) {
+		case "seq":
+			var v uint64
+			v, err = strconv.ParseUint(kv[1], 10, 16)
+			if err != nil {
+				return
+			}
+			sn = seqno(v)
+			hasSeq = true
+		case "rtptime":
+			var v uint64
+			v, err = strconv.ParseUint(kv[1], 10, 32)
+			if err != nil {
+				return
+			}
+			rtptime = uint32(v)
 		}
+	}
+	if !hasSeq {
+		err = errors.New("No seq in RTP-Info")
+	}
+	return
+}
 
-	case "GET_PARAMETER":
-		rtsplog.Debug.Println("GET_PARAMETER")
-		raop := rs.raop
+func (rs *rtspSession) handleGetParameter(rw http.ResponseWriter, req *http.Request) error {
+	h := rw.Header()
 
-		raop.clientUserAgent = req.Header.Get("User-Agent")
+	if rs.s != nil {
+		rs.s.clientUserAgent = req.Header.Get("User-Agent")
+	}
 
-		content := bytes.NewBufferString("")
-		raop.getParameters(req.Body, content)
-		h.Add("Content-Type", "text/parameters")
-		h.Add("Content-Length", fmt.Sprintf("%d", content.Len()))
-		io.Copy(rw, content)
+	content := bytes.NewBufferString("")
+	rs.getParameters(req.Body, content)
+	h.Add("Content-Type", "text/parameters")
+	h.Add("Content-Length", fmt.Sprintf("%d", content.Len()))
+	io.Copy(rw, content)
+	return nil
+}
 
-	case "SET_PARAMETER":
-		rtsplog.Debug.Println("SET_PARAMETER")
-		contentType := req.Header.Get("Content-Type")
-		rtsplog.Debug.Println("SET_PARAMETER: Content-Type=", contentType)
-		switch contentType {
-		case "text/parameters":
-			s := readToString(req.Body)
-			s = strings.Trim(s, " \r\n")
-			rtsplog.Debug.Println("SET_PARAMETER: text/parameters: s=", s)
-			var vol float32
-			var start, current, end int64
-			switch {
-			case scanf(s, "volume: %f", &vol):
-				rs.raop.vol.SetServiceVolume(vol)
-			case scanf(s, "progress: %d/%d/%d", &start, &current, &end):
-				err := rs.raop.setProgress(start, current, end)
-				if err != nil {
-					rtsplog.Debug.Println("Could not set progress:", start, current, end, ", error=", err)
-				}
-			}
-		case "image/jpeg", "image/png":
-			rtsplog.Debug.Println("SET_PARAMETER: image: ")
-			loadCoverArt := false
-			si := rs.raop.sink.Info()
-			if si != nil {
-				loadCoverArt = si.SupportsCoverArt
-			}
-			if loadCoverArt {
-				buf, err := ioutil.ReadAll(req.Body)
-				if err != nil {
-					rtsplog.Info.Println("Could not load coverart data:", err)
-					return
-				}
-				rs.raop.sink.SetCoverArt(contentType, bytes.NewBuffer(buf).Bytes())
-			} else {
-				io.Copy(ioutil.Discard, req.Body)
+func (rs *rtspSession) handleSetParameter(rw http.ResponseWriter, req *http.Request) error {
+	contentType := req.Header.Get("Content-Type")
+	rtsplog.Debug.Println("SET_PARAMETER: Content-Type=", contentType)
+	switch contentType {
+	case "text/parameters":
+		rtsplog.Debug.Println("SET_PARAMETER: text/parameters")
+		return rs.setParameters(req.Body)
+	case "image/jpeg", "image/png":
+		rtsplog.Debug.Println("SET_PARAMETER: image: ")
+		loadCoverArt := false
+		si := rs.raop.sink.Info()
+		if si != nil {
+			loadCoverArt = si.SupportsCoverArt
+		}
+		if loadCoverArt {
+			buf, err := ioutil.ReadAll(req.Body)
+			if err != nil {
+				return newRTSPError(400, err, "Could not load coverart data")
 			}
-		case "application/x-dmap-tagged":
-			smd := ""
-			si := rs.raop.sink.Info()
-			if si != nil {
-				smd = si.SupportsMetaData
+			rs.raop.sink.SetCoverArt(contentType, bytes.NewBuffer(buf).Bytes())
+		} else {
+			io.Copy(ioutil.Discard, req.Body)
+		}
+	case "application/x-dmap-tagged":
+		smd := ""
+		si := rs.raop.sink.Info()
+		if si != nil {
+			smd = si.SupportsMetaData
+		}
+		if smd != "" {
+			daap, err := newDmap(req.Body)
+			if err != nil {
+				return newRTSPError(400, err, "Could not load DAAP data")
 			}
-			if smd != "" {
-				daap, err := newDmap(req.Body)
-				if err != nil {
-					rtsplog.Info.Println("Could not load DAAP data:", err)
-					return
-				}
-				rtsplog.Debug.Println("daap=", daap)
-				md := daap.String(smd)
-				if md != "" {
-					rs.raop.sink.SetMetadata(bytes.NewBufferString(md).String())
-				}
-			} else {
-				io.Copy(ioutil.Discard, req.Body)
+			rtsplog.Debug.Println("daap=", daap)
+			md := daap.String(smd)
+			if md != "" {
+				rs.raop.sink.SetMetadata(bytes.NewBufferString(md).String())
 			}
-		default:
-			rtsplog.Info.Println("SET_PARAMETER: Unknown Content-Type=", contentType)
-
+		} else {
+			io.Copy(ioutil.Discard, req.Body)
 		}
-	case "RECORD":
-		rs.raop.sink.Play()
-	case "PAUSE":
-		rtsplog.Debug.Println("....................... PAUSE?")
-		rs.raop.sink.Pause()
-	case "FLUSH":
-	case "TEARDOWN":
-		rs.raop.teardown()
 	default:
-		rw.WriteHeader(404)
+		rtsplog.Info.Println("SET_PARAMETER: Unknown Content-Type=", contentType)
 	}
+	return nil
 }
 
 func (rs *rtspSession) LocalAddr() net.Addr {
 	return rs.c.LocalAddr()
 }
 
+// Close the RTSP connection.
+func (rs *rtspSession) Close() error {
+	if rs.c == nil {
+		return nil
+	}
+	return rs.c.Close()
+}
+
+// Close the RTSP connection. The reason will be used when the session
+// of the connection is torn down.
+func (rs *rtspSession) closeWithReason(reason error) error {
+	rs.closeReason.Store(reason)
+	return rs.Close()
+}
+
+// Returns why the connection ended after a read error.
+func (rs *rtspSession) endReason(err error) error {
+	if reason, ok := rs.closeReason.Load().(error); ok {
+		return reason
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrIdleTimeout
+	}
+	return ErrDisconnected
+}
+
+// Extend the read deadline of the connection if the sink has an idle timeout
+func (rs *rtspSession) setIdleDeadline() {
+	si := rs.raop.sink.Info()
+	if si != nil && si.IdleTimeout > 0 {
+		rs.c.SetReadDeadline(time.Now().Add(si.IdleTimeout))
+	}
+}
+
 func (rs *rtspSession) runRtspServerSession(c net.Conn) {
-	//	rd := bufio.NewReader(c)
+	brd := newRTSPReader(c)
 	wr := bufio.NewWriter(c)
+	rs.captureOpen()
 
 	for {
-		req, err := rs.readRequest(ioutil.NopCloser(c))
+		rs.setIdleDeadline()
+		var req *http.Request
+		b, err := brd.Peek(1)
+		if err == nil && b[0] == '$' {
+			err = rs.readInterleaved(brd)
+		} else if err == nil {
+			req, err = rs.readRequest(brd)
+		}
 		if err != nil {
-			rtsplog.Debug.Println("Ending RTSP session:", err)
+			reason := rs.endReason(err)
+			if re, ok := err.(*RTSPError); ok {
+				// The request could not be parsed, there is no way to
+				// find the next request so the connection is closed.
+				rw := newRtspResponseWriter(wr)
+				if req != nil && req.Header.Get("Cseq") != "" {
+					rw.Header().Add("Cseq", req.Header.Get("Cseq"))
+				}
+				rw.WriteHeader(re.StatusCode)
+				rw.finishResponse()
+				rs.rejected(re)
+				reason = re
+			}
+			rtsplog.Debug.Println("Ending RTSP session:", err, ", reason=", reason)
+			rs.capture(captureClose, []byte(reason.Error()))
+			if rs.s != nil {
+				rs.raop.release(rs.s, reason)
+			}
 			return
 		}
-		rw := newRtspResponseWriter(wr)
-		rs.handle(rw, req)
-		rw.finishResponse()
+		if req == nil {
+			continue
+		}
+		rs.serveRequest(wr, req)
+
+		// Skip anything the handler did not read to get to the next request
+		io.Copy(ioutil.Discard, req.Body)
+	}
+}
+
+// Read an RTP packet interleaved on the RTSP connection, see RFC 2326
+// section 10.12. The packet is framed by a '$', the channel and a 16 bit
+// length. Packets on unknown channels are discarded.
+func (rs *rtspSession) readInterleaved(brd *bufio.Reader) error {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(brd, header); err != nil {
+		return err
+	}
+	channel := header[1]
+	length := int(binary.BigEndian.Uint16(header[2:4]))
+	if length > max_rtp_packet_size {
+		rtplog.Debug.Println("Discarding interleaved packet, channel=", channel, ", length=", length)
+		_, err := brd.Discard(length)
+		return err
+	}
+
+	pkt := makeRtpPacket()
+	pkt.content = pkt.buf[0:length]
+	if _, err := io.ReadFull(brd, pkt.content); err != nil {
+		pkt.Reclaim()
+		return err
+	}
+	if c := rs.raop.capture(); c != nil {
+		c.record(rs.id, captureInterleaved, append(header, pkt.content...))
+	}
+	rs.handleInterleaved(channel, pkt)
+	return nil
+}
+
+// Pass an interleaved packet to the handler of its channel.
+func (rs *rtspSession) handleInterleaved(channel byte, pkt *rtpPacket) {
+	var handler rtpHandler
+	if rs.s != nil {
+		handler = rs.s.interleaved[channel]
+	}
+	if handler == nil || len(pkt.content) < 12 {
+		rtplog.Debug.Println("Discarding interleaved packet, channel=", channel, ", length=", len(pkt.content))
+		pkt.Reclaim()
+		return
 	}
+	pkt.sn = decodeSeqno(pkt.content[2:4])
+	handler(pkt)
+}
+
+// Limits of the requests accepted from a source. Lines longer than
+// maxRTSPLineLength will not fit in the buffer of the connection reader.
+const (
+	maxRTSPLineLength    = 8192
+	maxRTSPHeaders       = 64
+	maxRTSPContentLength = 16 * 1024 * 1024
+)
+
+// Make a reader for the requests of a connection. The same reader must be
+// used for all requests as it may have buffered the next request.
+func newRTSPReader(r io.Reader) *bufio.Reader {
+	return bufio.NewReaderSize(r, maxRTSPLineLength)
 }
 
 func parseRTSPVersion(s string) (proto string, major int, minor int, err error) {
 	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 || (parts[0] != "RTSP" && parts[0] != "HTTP") {
+		err = errors.New("Not an RTSP version")
+		return
+	}
 	proto = parts[0]
 	parts = strings.SplitN(parts[1], ".", 2)
+	if len(parts) != 2 {
+		err = errors.New("Malformed version")
+		return
+	}
 	if major, err = strconv.Atoi(parts[0]); err != nil {
 		return
 	}
-	if minor, err = strconv.Atoi(parts[0]); err != nil {
+	if minor, err = strconv.Atoi(parts[1]); err != nil {
 		return
 	}
 	return
 }
 
-func (rs *rtspSession) readRequest(rd io.ReadCloser) (req *http.Request, err error) {
-	req = &http.Request{}
-	req.Header = make(map[string][]string)
+// Parse the request URI. Some senders send IPv6 hosts without the brackets
+// required by RFC 3986, i.e. rtsp://fe80::1/1234, which are added before
+// parsing.
+func parseRequestURL(s string) (*url.URL, error) {
+	u, err := url.Parse(s)
+	if err == nil {
+		return u, nil
+	}
+	const scheme = "rtsp://"
+	if len(s) < len(scheme) || !strings.EqualFold(s[:len(scheme)], scheme) {
+		return nil, err
+	}
+	host, path := s[len(scheme):], ""
+	if ii := strings.Index(host, "/"); ii >= 0 {
+		host, path = host[:ii], host[ii:]
+	}
+	if strings.Count(host, ":") < 2 || strings.ContainsAny(host, "[]") {
+		return nil, err
+	}
+	host = strings.Replace(host, "%", "%25", 1) // Zone, i.e. fe80::1%en0
+	return url.Parse(s[:len(scheme)] + "[" + host + "]" + path)
+}
 
+// Read a line without the line ending. Returns a 400 RTSPError if the line
+// does not fit in the reader buffer.
+func readRTSPLine(brd *bufio.Reader) (string, error) {
+	line, err := brd.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", newRTSPError(400, nil, "Line too long")
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// readRequest reads the next request from the connection reader. Errors
+// in the request are returned as an RTSPError with the status code to
+// respond with, other errors are errors reading from the connection. The
+// request is returned with an RTSPError for errors after the request line,
+// with the headers read before the error.
+func (rs *rtspSession) readRequest(brd *bufio.Reader) (*http.Request, error) {
 	var s string
+	var err error
 
-	brd := bufio.NewReader(rd)
-	tp := textproto.NewReader(brd)
+	// Empty lines between requests are allowed
+	for ii := 0; s == ""; ii++ {
+		if ii > maxRTSPHeaders {
+			return nil, newRTSPError(400, nil, "No request line")
+		}
+		if s, err = readRTSPLine(brd); err != nil {
+			rtsplog.Debug.Println("READ REQUEST:H:", err)
+			return nil, err
+		}
+	}
 
-	if s, err = tp.ReadLine(); err != nil {
-		rtsplog.Debug.Println("READ REQUEST:H:", err)
-		return
+	parts := strings.Split(s, " ")
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, newRTSPError(400, nil, "Malformed request line ", strconv.Quote(s))
 	}
-	//	rtsplog.Debug.Println("RX:H:", s)
-	parts := strings.SplitN(s, " ", 3)
+	req := &http.Request{}
+	req.Header = make(map[string][]string)
 	req.Method = parts[0]
-	if req.URL, err = url.Parse(parts[1]); err != nil {
-		return
+	req.RequestURI = parts[1]
+	if req.URL, err = parseRequestURL(parts[1]); err != nil {
+		return nil, newRTSPError(400, err, "Malformed request URI")
 	}
-
 	req.Proto, req.ProtoMajor, req.ProtoMinor, err = parseRTSPVersion(parts[2])
 	if err != nil {
-		return
+		return nil, newRTSPError(400, err, "Malformed version ", strconv.Quote(parts[2]))
+	}
+	if req.ProtoMajor != 1 {
+		return nil, newRTSPError(505, nil, "Version ", parts[2])
+	}
+	if rs.c != nil {
+		req.RemoteAddr = rs.c.RemoteAddr().String()
 	}
 
 	// read headers
-	for {
-		if s, err = tp.ReadLine(); err != nil {
+	for headers := 0; ; headers++ {
+		if s, err = readRTSPLine(brd); err != nil {
 			rtsplog.Debug.Println("READ REQUEST:C:", err)
-			return
+			return nil, err
 		}
-		//		rtsplog.Debug.Println("RX:C:", s)
-		if s = strings.TrimRight(s, "\r\n"); s == "" {
+		if s == "" {
 			break
 		}
-
+		if headers == maxRTSPHeaders {
+			return req, newRTSPError(400, nil, "Too many headers")
+		}
 		parts := strings.SplitN(s, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return req, newRTSPError(400, nil, "Malformed header ", strconv.Quote(s))
+		}
 		req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
 	}
 
-	req.ContentLength, _ = strconv.ParseInt(req.Header.Get("Content-Length"), 10, 0)
+	if cl := req.Header.Get("Content-Length"); cl != "" {
+		req.ContentLength, err = strconv.ParseInt(cl, 10, 64)
+		if err != nil || req.ContentLength < 0 {
+			return req, newRTSPError(400, err, "Malformed Content-Length ", strconv.Quote(cl))
+		}
+		if req.ContentLength > maxRTSPContentLength {
+			return req, newRTSPError(413, nil, "Content-Length ", req.ContentLength)
+		}
+	}
 	if req.ContentLength > 0 {
 		req.Body = ioutil.NopCloser(io.LimitReader(brd, req.ContentLength))
 	} else {
-		req.Body = ioutil.NopCloser(brd)
+		req.Body = http.NoBody
 	}
 
 	return req, nil
@@ -0,0 +1,107 @@
+package raopd
+
+import (
+	"net"
+	"net/http"
+)
+
+/*
+Session is the RTSP connection of a source as seen by an RTSPHandler.
+*/
+type Session interface {
+	// The id of the announced session or "" if the source has not
+	// announced a stream on the connection.
+	ID() string
+
+	// The addresses of the RTSP connection
+	RemoteAddr() net.Addr
+	LocalAddr() net.Addr
+
+	// The sink the source is connected to.
+	Sink() Sink
+}
+
+/*
+RTSPHandler handles RTSP requests which are not handled by raopd, such as
+the POST /feedback or GET /info requests sent by newer senders. See
+SinkCollection.HandleRTSP.
+
+The handler should write the response status and any body to rw. If nothing
+is written the response will be 200 OK. The Cseq header has already been
+added to the response headers.
+*/
+type RTSPHandler interface {
+	ServeRTSP(rw http.ResponseWriter, req *http.Request, s Session)
+}
+
+/*
+RTSPHandlerFunc makes an ordinary function an RTSPHandler.
+*/
+type RTSPHandlerFunc func(rw http.ResponseWriter, req *http.Request, s Session)
+
+// ServeRTSP calls f(rw, req, s).
+func (f RTSPHandlerFunc) ServeRTSP(rw http.ResponseWriter, req *http.Request, s Session) {
+	f(rw, req, s)
+}
+
+type rtspRoute struct {
+	method, path string
+}
+
+/*
+HandleRTSP registers a handler for RTSP requests with the method and path
+for all sinks in the collection. If path is "" the handler will handle the
+method for any path not registered with its own handler. Handlers take
+precedence over the methods handled by raopd, so registering a handler for
+e.g. "GET_PARAMETER" with the path "" will replace the built in handling.
+Registering a nil handler removes the handler.
+*/
+func (sc *SinkCollection) HandleRTSP(method, path string, h RTSPHandler) {
+	sc.hm.Lock()
+	defer sc.hm.Unlock()
+
+	route := rtspRoute{method, path}
+	if h == nil {
+		delete(sc.handlers, route)
+		return
+	}
+	if sc.handlers == nil {
+		sc.handlers = make(map[rtspRoute]RTSPHandler)
+	}
+	sc.handlers[route] = h
+}
+
+// Returns the registered handler for the request or nil if there is none.
+func (sc *SinkCollection) rtspHandler(req *http.Request) RTSPHandler {
+	if sc == nil {
+		return nil
+	}
+	sc.hm.RLock()
+	defer sc.hm.RUnlock()
+
+	path := ""
+	if req.URL != nil {
+		path = req.URL.Path
+	}
+	if h, ok := sc.handlers[rtspRoute{req.Method, path}]; ok {
+		return h
+	}
+	return sc.handlers[rtspRoute{req.Method, ""}]
+}
+
+// rtspSession implements Session
+
+func (rs *rtspSession) ID() string {
+	if rs.s == nil {
+		return ""
+	}
+	return rs.s.id
+}
+
+func (rs *rtspSession) RemoteAddr() net.Addr {
+	return rs.c.RemoteAddr()
+}
+
+func (rs *rtspSession) Sink() Sink {
+	return rs.raop.sink
+}
@@ -0,0 +1,134 @@
+package raopd
+
+import (
+	"fmt"
+)
+
+// RTSP status codes as defined in RFC 2326 section 7.1.1. Most of them are
+// shared with HTTP, the 45x range is RTSP specific.
+var rtspStatusText = map[int]string{
+	100: "Continue",
+
+	200: "OK",
+	201: "Created",
+	250: "Low on Storage Space",
+
+	300: "Multiple Choices",
+	301: "Moved Permanently",
+	302: "Moved Temporarily",
+	303: "See Other",
+	304: "Not Modified",
+	305: "Use Proxy",
+
+	400: "Bad Request",
+	401: "Unauthorized",
+	402: "Payment Required",
+	403: "Forbidden",
+	404: "Not Found",
+	405: "Method Not Allowed",
+	406: "Not Acceptable",
+	407: "Proxy Authentication Required",
+	408: "Request Time-out",
+	410: "Gone",
+	411: "Length Required",
+	412: "Precondition Failed",
+	413: "Request Entity Too Large",
+	414: "Request-URI Too Large",
+	415: "Unsupported Media Type",
+	451: "Parameter Not Understood",
+	452: "Conference Not Found",
+	453: "Not Enough Bandwidth",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	456: "Header Field Not Valid for Resource",
+	457: "Invalid Range",
+	458: "Parameter Is Read-Only",
+	459: "Aggregate Operation Not Allowed",
+	460: "Only Aggregate Operation Allowed",
+	461: "Unsupported Transport",
+	462: "Destination Unreachable",
+
+	500: "Internal Server Error",
+	501: "Not Implemented",
+	502: "Bad Gateway",
+	503: "Service Unavailable",
+	504: "Gateway Time-out",
+	505: "RTSP Version Not Supported",
+	551: "Option Not Supported",
+}
+
+func statusMap(code int) string {
+	if text, ok := rtspStatusText[code]; ok {
+		return text
+	}
+	// Unknown codes get the reason phrase of their class, see RFC 2326 7.1.1
+	switch code / 100 {
+	case 1:
+		return "Informational"
+	case 2:
+		return "Success"
+	case 3:
+		return "Redirection"
+	case 4:
+		return "Client Error"
+	case 5:
+		return "Server Error"
+	}
+	return "Unknown"
+}
+
+/*
+RTSPError describes why an RTSP request from a sender could not be handled.
+StatusCode is the RTSP status code sent back to the sender.
+*/
+type RTSPError struct {
+	// The RTSP status code of the response
+	StatusCode int
+
+	// The method and URI of the failing request.
+	Method string
+	URI    string
+
+	// The remote address of the sender
+	Remote string
+
+	// Description of the failure
+	Reason string
+
+	// The underlying error, may be nil.
+	Err error
+}
+
+func (e *RTSPError) Error() string {
+	s := fmt.Sprintf("RTSP %d %s", e.StatusCode, statusMap(e.StatusCode))
+	if e.Method != "" {
+		s = fmt.Sprint(s, ", method=", e.Method, " ", e.URI)
+	}
+	if e.Reason != "" {
+		s = fmt.Sprint(s, ": ", e.Reason)
+	}
+	if e.Err != nil {
+		s = fmt.Sprint(s, ": ", e.Err)
+	}
+	return s
+}
+
+// Unwrap returns the underlying error.
+func (e *RTSPError) Unwrap() error {
+	return e.Err
+}
+
+// newRTSPError creates a new RTSPError with the status code and a reason
+// built from the arguments. The error err may be nil.
+func newRTSPError(code int, err error, reason ...interface{}) *RTSPError {
+	return &RTSPError{StatusCode: code, Reason: fmt.Sprint(reason...), Err: err}
+}
+
+// Convert any error into an RTSPError. Errors which are not RTSP errors
+// will be an Internal Server Error.
+func toRTSPError(err error) *RTSPError {
+	if re, ok := err.(*RTSPError); ok {
+		return re
+	}
+	return newRTSPError(500, err)
+}
@@ -1,13 +1,18 @@
 package raopd
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -16,6 +21,12 @@ type testClient struct {
 	volume   float32
 	pos, end int
 	si       *SinkInfo
+	rejected *RTSPError
+	flushed  int
+
+	m       sync.Mutex
+	stopped int
+	reason  error
 }
 
 func (tc *testClient) Info() *SinkInfo {
@@ -51,12 +62,45 @@ func (tc *testClient) Close() {
 
 func (tc *testClient) Stopped() {
 	rtsplog.Debug.Println("TEST CLIENT:", "Stopped...")
+	tc.m.Lock()
+	defer tc.m.Unlock()
+	tc.stopped++
+}
+
+func (tc *testClient) StoppedWithReason(reason error) {
+	tc.Stopped()
+	tc.m.Lock()
+	defer tc.m.Unlock()
+	tc.reason = reason
+}
+
+// Returns the number of times the client has been stopped and the last reason
+func (tc *testClient) stops() (int, error) {
+	tc.m.Lock()
+	defer tc.m.Unlock()
+	return tc.stopped, tc.reason
+}
+
+func (tc *testClient) assertStopped(t *testing.T, count int, reason error) {
+	stopped, r := tc.stops()
+	assert.Equal(t, count, stopped, "Stopped")
+	assert.Equal(t, reason, r, "Stop reason")
+}
+
+func (tc *testClient) Flush() {
+	rtsplog.Debug.Println("TEST CLIENT:", "Flush...")
+	tc.flushed++
 }
 
 func (tc *testClient) Closed() {
 	rtsplog.Debug.Println("TEST CLIENT:", "Closed...")
 }
 
+func (tc *testClient) Rejected(err *RTSPError) {
+	rtsplog.Debug.Println("TEST CLIENT:", "Rejected ", err)
+	tc.rejected = err
+}
+
 func (tc *testClient) Connected(name string) {
 	rtsplog.Debug.Println("TEST CLIENT:", "Connected to ", name)
 }
@@ -87,18 +131,36 @@ func makeTestRtspSession() *rtspSession {
 	r.dacp = &dacp{}
 	r.dacp.mrc = make(chan func() error, 10)
 	r.dacp.crc = make(chan func() error, 12)
-
-	err = r.initAlac("x", "96 352 0 16 40 10 14 2 255 0 0 44100")
-	if err != nil {
-		panic(err)
-	}
 	r.sink = makeTestClient()
 
 	r.vol = &volumeHandler{}
 	r.vol.deviceVolumeChan = make(chan float32, 8)
 	r.vol.serviceVolumeChan = make(chan float32, 8)
 
-	return &rtspSession{i, r, nil}
+	return &rtspSession{i: i, raop: r}
+}
+
+// Make a test session which has already been announced.
+func makeAnnouncedTestRtspSession() *rtspSession {
+	rs := makeTestRtspSession()
+	s, err := rs.raop.claim(rs)
+	if err != nil {
+		panic(err)
+	}
+	rtpmap, err := parseSdpRtpmap("96 AppleLossless")
+	if err != nil {
+		panic(err)
+	}
+	fmtp, err := parseSdpFmtp("96 352 0 16 40 10 14 2 255 0 0 44100")
+	if err != nil {
+		panic(err)
+	}
+	err = s.initCodec(rtpmap, fmtp)
+	if err != nil {
+		panic(err)
+	}
+	rs.s = s
+	return rs
 }
 
 func TestParseRequest1(t *testing.T) {
@@ -112,7 +174,7 @@ Active-Remote: 1986535575
 `
 	r := makeTestRtspSession()
 
-	req, err := r.readRequest(ioutil.NopCloser(bytes.NewBufferString(rs)))
+	req, err := r.readRequest(newRTSPReader(bytes.NewBufferString(rs)))
 
 	assert.Nil(t, err)
 	assert.Equal(t, "OPTIONS", req.Method)
@@ -157,7 +219,7 @@ func (t *TestResponse) WriteHeader(statusCode int) {
 
 func request(r *rtspSession, req string) (resp *http.Response, err error) {
 	tr := MakeTestResponse()
-	rr, err := r.readRequest(ioutil.NopCloser(bytes.NewBufferString(req)))
+	rr, err := r.readRequest(newRTSPReader(bytes.NewBufferString(req)))
 	if err != nil {
 		return nil, err
 	}
@@ -239,6 +301,104 @@ a=max-latency:88200
 	// Check the RTP setup and encryption key
 }
 
+func announceRequest(sdp string) string {
+	return fmt.Sprintf("ANNOUNCE rtsp://10.0.0.1/1234 RTSP/1.0\r\n"+
+		"Content-Type: application/sdp\r\n"+
+		"Content-Length: %d\r\n"+
+		"CSeq: 1\r\n\r\n%s", len(sdp), sdp)
+}
+
+const unencryptedSdp = "v=0\r\n" +
+	"o=AirTunes 1234 0 IN IP4 10.0.0.2\r\n" +
+	"s=AirTunes\r\n" +
+	"c=IN IP4 10.0.0.2\r\n" +
+	"t=0 0\r\n" +
+	"m=audio 0 RTP/AVP 96\r\n" +
+	"a=rtpmap:96 AppleLossless\r\n" +
+	"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n"
+
+func TestAnnounceUnencrypted(t *testing.T) {
+	r := makeTestRtspSession()
+	resp, err := request(r, announceRequest(unencryptedSdp))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	assert.NotNil(t, r.s)
+	assert.Nil(t, r.s.aeskey)
+	assert.Equal(t, net.ParseIP("10.0.0.2"), r.s.remote)
+
+	// The payload is decoded without decryption
+	assert.NotPanics(t, func() {
+		r.s.decode(testPacket(1, 96))
+	})
+}
+
+func TestAnnounceL16(t *testing.T) {
+	r := makeTestRtspSession()
+	sdp := strings.Replace(unencryptedSdp, "a=rtpmap:96 AppleLossless\r\n"+
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n", "a=rtpmap:96 L16/22050/1\r\n", 1)
+	resp, err := request(r, announceRequest(sdp))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	assert.Equal(t, 22050, r.s.codec.SampleRate())
+	ms, err := r.s.rtptoms(22050)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, ms)
+
+	r = makeTestRtspSession()
+	resp, err = request(r, announceRequest(strings.Replace(sdp, "L16", "x-unknown", 1)))
+	assert.Nil(t, err)
+	assert.Equal(t, 415, resp.StatusCode, "StatusCode")
+}
+
+func TestAnnounceAAC(t *testing.T) {
+	r := makeTestRtspSession()
+	sdp := strings.Replace(unencryptedSdp, "a=rtpmap:96 AppleLossless\r\n"+
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n",
+		"a=rtpmap:96 mpeg4-generic/44100/2\r\n"+
+			"a=fmtp:96 mode=AAC-main; constantDuration=1024\r\n", 1)
+	resp, err := request(r, announceRequest(sdp))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	assert.IsType(t, &aacDecoder{}, r.s.codec)
+	assert.Equal(t, 44100, r.s.codec.SampleRate())
+
+	r = makeTestRtspSession()
+	resp, err = request(r, announceRequest(strings.Replace(sdp, "AAC-main", "AAC-eld", 1)))
+	assert.Nil(t, err)
+	assert.Equal(t, 415, resp.StatusCode, "StatusCode")
+}
+
+func TestAnnounceStaticPayloadType(t *testing.T) {
+	r := makeTestRtspSession()
+	sdp := strings.Replace(unencryptedSdp, "m=audio 0 RTP/AVP 96\r\n"+
+		"a=rtpmap:96 AppleLossless\r\n"+
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n", "m=audio 0 RTP/AVP 11\r\n", 1)
+	resp, err := request(r, announceRequest(sdp))
+
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	assert.Equal(t, 1, r.s.codec.Channels())
+
+	// Only audio of the announced payload type is queued
+	r.s.seqchan = make(chan *rtpPacket, 16)
+	handler, _, _ := r.s.getDataHandler(nil)
+	handler(testPacket(1, 96))
+	handler(testPacket(2, 11))
+	checkSeqNo(t, r.s.seqchan, 2)
+	checkSeqNo(t, r.s.seqchan, -1)
+}
+
+func TestAnnounceMalformedKey(t *testing.T) {
+	r := makeTestRtspSession()
+	resp, err := request(r, announceRequest(unencryptedSdp+"a=rsaaeskey:not-base64\r\n"))
+	assert.Nil(t, err)
+	assert.Equal(t, 400, resp.StatusCode, "StatusCode")
+	assert.Nil(t, r.s)
+}
+
 func TestSetup(t *testing.T) {
 
 	ifaces, err := net.Interfaces()
@@ -257,20 +417,21 @@ User-Agent: AirPlay/267.3
 `, addr)
 	Debug("log.info/*", 1)
 	Debug("log.debug/*", 1)
-	r := makeTestRtspSession()
-	r.raop.startRtp(nil, nil)
+	r := makeAnnouncedTestRtspSession()
+	r.s.startRtp(nil, nil)
 
 	resp, err := request(r, req)
 	assert.NoError(t, err)
 
-	expected := fmt.Sprintf("RTP/AVP/UDP;unicast;mode=record;timing_port=%d;events;control_port=%d;server_port=%d\nSession: DEADBEEF",
-		r.raop.timing.Port(), r.raop.control.Port(), r.raop.data.Port())
+	expected := fmt.Sprintf("RTP/AVP/UDP;unicast;mode=record;timing_port=%d;events;control_port=%d;server_port=%d",
+		r.s.timing.Port(), r.s.control.Port(), r.s.data.Port())
 	assert.Nil(t, err)
 	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
 	ha := headerAsserter{t, resp.Header}
 	ha.assert("2", "Cseq")
 	ha.assert("connected; type=analog", "Apple-Jack-Status")
 	ha.assert(expected, "Transport")
+	ha.assert(r.s.id, "Session")
 
 	// Run the request in the thread to get the values into the dacp instance
 	fnc := <-r.raop.dacp.mrc
@@ -278,7 +439,7 @@ User-Agent: AirPlay/267.3
 
 	assert.Equal(t, "19050F2FE0FD618D", r.raop.dacp.dacpID())
 	assert.Equal(t, "84694584", r.raop.dacp.activeRemote())
-	assert.Equal(t, "AirPlay/267.3", r.raop.clientUserAgent)
+	assert.Equal(t, "AirPlay/267.3", r.s.clientUserAgent)
 }
 
 func TestGetParameter(t *testing.T) {
@@ -343,7 +504,7 @@ User-Agent: AirPlay/267.3
 
 progress: 866155144/880664705/900835976
 `
-	r := makeTestRtspSession()
+	r := makeAnnouncedTestRtspSession()
 
 	//fmtp := "96 352 0 16 40 10 14 2 255 0 0 44100"
 	//	r.raop.alacConf = alac.NewAlacConfFromFmtp(fmtp)
@@ -361,3 +522,637 @@ progress: 866155144/880664705/900835976
 	assert.Equal(t, 786413, tc.end)
 
 }
+
+func TestStatusMap(t *testing.T) {
+	assert.Equal(t, "OK", statusMap(200))
+	assert.Equal(t, "Unauthorized", statusMap(401))
+	assert.Equal(t, "Not Enough Bandwidth", statusMap(453))
+	assert.Equal(t, "Session Not Found", statusMap(454))
+	assert.Equal(t, "Method Not Valid in This State", statusMap(455))
+	assert.Equal(t, "Client Error", statusMap(499))
+}
+
+func TestResponseStatusLine(t *testing.T) {
+	b := bytes.NewBufferString("")
+	wr := bufio.NewWriter(b)
+	rw := newRtspResponseWriter(wr)
+	rw.Header().Add("Cseq", "7")
+	rw.WriteHeader(453)
+	rw.finishResponse()
+
+	assert.Equal(t, "RTSP/1.0 453 Not Enough Bandwidth\r\nCseq: 7\r\n\r\n", b.String())
+}
+
+func TestUnknownMethod(t *testing.T) {
+	req := `FOOBAR * RTSP/1.0
+CSeq: 5
+
+`
+	r := makeTestRtspSession()
+	resp, err := request(r, req)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 501, resp.StatusCode, "StatusCode")
+	ha := headerAsserter{t, resp.Header}
+	ha.assert("5", "Cseq")
+
+	tc := r.raop.sink.(*testClient)
+	assert.NotNil(t, tc.rejected)
+	assert.Equal(t, 501, tc.rejected.StatusCode)
+	assert.Equal(t, "FOOBAR", tc.rejected.Method)
+}
+
+func TestSessionRejectNew(t *testing.T) {
+	r1 := makeAnnouncedTestRtspSession()
+	r2 := &rtspSession{i: r1.i, raop: r1.raop}
+
+	s, err := r1.raop.claim(r2)
+	assert.Nil(t, s)
+	assert.Equal(t, 453, err.(*RTSPError).StatusCode)
+	assert.Equal(t, r1.s, r1.raop.activeSession())
+
+	tc := r1.raop.sink.(*testClient)
+	tc.assertStopped(t, 0, nil)
+}
+
+func TestSessionPreempt(t *testing.T) {
+	r1 := makeAnnouncedTestRtspSession()
+	r2 := &rtspSession{i: r1.i, raop: r1.raop}
+	tc := r1.raop.sink.(*testClient)
+	tc.si.SessionPolicy = PreemptSession
+
+	s, err := r1.raop.claim(r2)
+	assert.NoError(t, err)
+	assert.NotNil(t, s)
+	assert.NotEqual(t, r1.s.id, s.id)
+	assert.Equal(t, s, r1.raop.activeSession())
+	tc.assertStopped(t, 1, ErrPreempted)
+
+	// Releasing the preempted session again should not stop the sink twice
+	r1.raop.release(r1.s, ErrDisconnected)
+	assert.Equal(t, s, r1.raop.activeSession())
+	tc.assertStopped(t, 1, ErrPreempted)
+}
+
+func TestSessionReannounce(t *testing.T) {
+	r := makeAnnouncedTestRtspSession()
+	tc := r.raop.sink.(*testClient)
+	old := r.s
+
+	s, err := r.raop.claim(r)
+	assert.NoError(t, err)
+	assert.NotEqual(t, old.id, s.id)
+	assert.Equal(t, s, r.raop.activeSession())
+	tc.assertStopped(t, 1, ErrReannounced)
+}
+
+func TestSessionState(t *testing.T) {
+	r := makeTestRtspSession()
+	resp, err := request(r, `RECORD rtsp://127.0.0.1/9953613529495192746 RTSP/1.0
+CSeq: 6
+
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, 455, resp.StatusCode, "StatusCode")
+
+	r = makeAnnouncedTestRtspSession()
+	resp, err = request(r, `RECORD rtsp://127.0.0.1/9953613529495192746 RTSP/1.0
+CSeq: 7
+Session: DEADBEEF
+
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, 454, resp.StatusCode, "StatusCode")
+
+	resp, err = request(r, fmt.Sprintf(`RECORD rtsp://127.0.0.1/9953613529495192746 RTSP/1.0
+CSeq: 8
+Session: %s
+
+`, r.s.id))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+}
+
+func TestRtspServerShutdown(t *testing.T) {
+	r := makeAnnouncedTestRtspSession()
+	err := r.s.startRtp(nil, nil)
+	assert.NoError(t, err)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	s := makeRtspServer(r.i, r.raop)
+	r.raop.rtsp = s
+	s.start(l)
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	assert.NoError(t, err)
+	cr := bufio.NewReader(conn)
+	cw := bufio.NewWriter(conn)
+	resp := raopTxRx(cw, cr, "OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n")
+	assert.Equal(t, "RTSP/1.0 200 OK\r\n", resp[:17])
+
+	// A stream with a writer which does not return
+	slow := &gatedWriter{gate: make(chan struct{})}
+	as := r.raop.newStream(context.Background(), slow, AudioStreamOptions{})
+	r.raop.writeToStreams(streamTestFrame(1), time.Millisecond)
+	r.raop.writeToStreams(streamTestFrame(2), time.Millisecond)
+	waitForWriting(as)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err = r.raop.shutdown(ctx)
+	assert.NoError(t, err)
+
+	// The stream is closed without writing the queued audio
+	assert.Empty(t, r.raop.streams)
+	assert.Equal(t, ErrShutdown, as.Err())
+	close(slow.gate)
+	<-as.done
+	assert.Equal(t, []byte{1}, slow.bytes())
+
+	// The connection and the listener should both be closed
+	_, err = cr.ReadByte()
+	assert.Equal(t, io.EOF, err)
+	_, err = net.Dial("tcp", l.Addr().String())
+	assert.Error(t, err)
+
+	// The session should have been torn down
+	assert.Nil(t, r.raop.activeSession())
+	tc := r.raop.sink.(*testClient)
+	tc.assertStopped(t, 1, ErrShutdown)
+}
+
+// Run an announced session on one end of a pipe and return the other end
+func startPipeSession(tc *testClient) (*rtspSession, net.Conn) {
+	r := makeTestRtspSession()
+	r.raop.sink = tc
+	client, server := net.Pipe()
+	r.c = server
+	var err error
+	r.s, err = r.raop.claim(r)
+	if err != nil {
+		panic(err)
+	}
+	go r.runRtspServerSession(server)
+	return r, client
+}
+
+func waitForStop(r *rtspSession) {
+	for ii := 0; ii < 100 && r.raop.activeSession() != nil; ii++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestKeepaliveTimeout(t *testing.T) {
+	tc := makeTestClient().(*testClient)
+	tc.si.KeepaliveTimeout = 100 * time.Millisecond
+	r, client := startPipeSession(tc)
+	defer client.Close()
+
+	cr := bufio.NewReader(client)
+	cw := bufio.NewWriter(client)
+	for ii := 0; ii < 4; ii++ {
+		time.Sleep(50 * time.Millisecond)
+		raopTxRx(cw, cr, "OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n")
+	}
+	tc.assertStopped(t, 0, nil)
+
+	waitForStop(r)
+	assert.Nil(t, r.raop.activeSession())
+	tc.assertStopped(t, 1, ErrKeepaliveTimeout)
+}
+
+func TestDataTimeout(t *testing.T) {
+	tc := makeTestClient().(*testClient)
+	tc.si.DataTimeout = 100 * time.Millisecond
+	r, client := startPipeSession(tc)
+	defer client.Close()
+
+	// Not playing so there should be no timeout
+	time.Sleep(200 * time.Millisecond)
+	tc.assertStopped(t, 0, nil)
+
+	r.s.watchdog.setPlaying(true)
+	waitForStop(r)
+	tc.assertStopped(t, 1, ErrDataTimeout)
+}
+
+func TestWatchdogPreempted(t *testing.T) {
+	tc := makeTestClient().(*testClient)
+	tc.si.KeepaliveTimeout = time.Hour
+	tc.si.SessionPolicy = PreemptSession
+	r := makeTestRtspSession()
+	r.raop.sink = tc
+
+	// The watchdog runs as soon as the session is active and stops when
+	// it is preempted
+	s, err := r.raop.claim(r)
+	assert.NoError(t, err)
+	assert.NotNil(t, s.watchdog.done)
+	other := makeTestRtspSession()
+	other.raop = r.raop
+	_, err = r.raop.claim(other)
+	assert.NoError(t, err)
+	select {
+	case <-s.watchdog.done:
+	default:
+		t.Fatal("The watchdog of the preempted session is running")
+	}
+	tc.assertStopped(t, 1, ErrPreempted)
+}
+
+func TestIdleTimeout(t *testing.T) {
+	tc := makeTestClient().(*testClient)
+	tc.si.IdleTimeout = 100 * time.Millisecond
+	r, client := startPipeSession(tc)
+	defer client.Close()
+
+	waitForStop(r)
+	tc.assertStopped(t, 1, ErrIdleTimeout)
+}
+
+func TestParseRTPInfo(t *testing.T) {
+	sn, rtptime, err := parseRTPInfo("seq=12345;rtptime=3405691582")
+	assert.NoError(t, err)
+	assert.Equal(t, seqno(12345), sn)
+	assert.Equal(t, uint32(3405691582), rtptime)
+
+	sn, rtptime, err = parseRTPInfo("url=rtsp://10.0.0.1/1234;seq=7; rtptime=11025")
+	assert.NoError(t, err)
+	assert.Equal(t, seqno(7), sn)
+	assert.Equal(t, uint32(11025), rtptime)
+
+	_, _, err = parseRTPInfo("rtptime=11025")
+	assert.Error(t, err)
+	_, _, err = parseRTPInfo("seq=70000;rtptime=11025")
+	assert.Error(t, err)
+}
+
+func TestFlush(t *testing.T) {
+	r := makeAnnouncedTestRtspSession()
+	err := r.s.startRtp(nil, nil)
+	assert.NoError(t, err)
+	defer r.raop.release(r.s, ErrTeardown)
+	tc := r.raop.sink.(*testClient)
+
+	resp, err := request(r, fmt.Sprintf(`FLUSH rtsp://127.0.0.1/9953613529495192746 RTSP/1.0
+CSeq: 9
+Session: %s
+RTP-Info: seq=4711;rtptime=1234567
+
+`, r.s.id))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	assert.Equal(t, 1, tc.flushed)
+
+	resp, err = request(r, fmt.Sprintf(`FLUSH rtsp://127.0.0.1/9953613529495192746 RTSP/1.0
+CSeq: 10
+Session: %s
+RTP-Info: seq=x;rtptime=1234567
+
+`, r.s.id))
+	assert.Nil(t, err)
+	assert.Equal(t, 400, resp.StatusCode, "StatusCode")
+	assert.Equal(t, 1, tc.flushed)
+}
+
+func TestRecord(t *testing.T) {
+	r := makeAnnouncedTestRtspSession()
+	err := r.s.startRtp(nil, nil)
+	assert.NoError(t, err)
+	defer r.raop.release(r.s, ErrTeardown)
+
+	resp, err := request(r, fmt.Sprintf(`RECORD rtsp://127.0.0.1/9953613529495192746 RTSP/1.0
+CSeq: 7
+Session: %s
+Range: npt=0-
+RTP-Info: seq=19485;rtptime=3306162512
+
+`, r.s.id))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	ha := headerAsserter{t, resp.Header}
+	ha.assert("11025", "Audio-Latency")
+
+	tc := r.raop.sink.(*testClient)
+	tc.si.AudioLatency = 500 * time.Millisecond
+	resp, err = request(r, fmt.Sprintf(`RECORD rtsp://127.0.0.1/9953613529495192746 RTSP/1.0
+CSeq: 8
+Session: %s
+
+`, r.s.id))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	ha = headerAsserter{t, resp.Header}
+	ha.assert("22050", "Audio-Latency")
+
+	// The audio is held by the jitter buffer for the target latency
+	tc.si.TargetLatency = 100 * time.Millisecond
+	resp, err = request(r, fmt.Sprintf(`RECORD rtsp://127.0.0.1/9953613529495192746 RTSP/1.0
+CSeq: 9
+Session: %s
+
+`, r.s.id))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	ha = headerAsserter{t, resp.Header}
+	ha.assert("26460", "Audio-Latency")
+}
+
+func TestRTSPHandler(t *testing.T) {
+	r := makeAnnouncedTestRtspSession()
+	sc := &SinkCollection{}
+	r.raop.acs = sc
+
+	var session Session
+	sc.HandleRTSP("POST", "/feedback", RTSPHandlerFunc(func(rw http.ResponseWriter, req *http.Request, s Session) {
+		session = s
+	}))
+	sc.HandleRTSP("GET", "", RTSPHandlerFunc(func(rw http.ResponseWriter, req *http.Request, s Session) {
+		rw.Header().Add("Content-Type", "text/plain")
+		rw.WriteHeader(404)
+	}))
+
+	resp, err := request(r, `POST /feedback RTSP/1.0
+CSeq: 11
+
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	assert.NotNil(t, session)
+	assert.Equal(t, r.s.id, session.ID())
+	assert.Equal(t, r.raop.sink, session.Sink())
+
+	resp, err = request(r, `GET /info RTSP/1.0
+CSeq: 12
+
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, 404, resp.StatusCode, "StatusCode")
+	ha := headerAsserter{t, resp.Header}
+	ha.assert("12", "Cseq")
+	ha.assert("text/plain", "Content-Type")
+
+	sc.HandleRTSP("POST", "/feedback", nil)
+	resp, err = request(r, `POST /feedback RTSP/1.0
+CSeq: 13
+
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, 501, resp.StatusCode, "StatusCode")
+}
+
+func TestGetInfo(t *testing.T) {
+	r := makeTestRtspSession()
+	r.raop.hwaddr = r.raop.sink.Info().HardwareAddress
+	r.raop.sink.Info().Name = "Kitchen"
+
+	info := r.raop.receiverInfo()
+	assert.Equal(t, "Kitchen", info["name"])
+	assert.Equal(t, "11:22:33:13:37:17", info["deviceID"])
+	assert.Equal(t, int64(featureAudio|featureAudioRedundant|featureMetadataProgress), info["features"])
+	assert.Equal(t, []interface{}{"PCM", "ALAC", "AAC"}, info["codecs"])
+	assert.Equal(t, int64(44100), info["sampleRate"])
+
+	r.raop.sink.Info().AudioLatency = 200 * time.Millisecond
+	r.raop.sink.Info().TargetLatency = 100 * time.Millisecond
+	latencies := r.raop.receiverInfo()["audioLatencies"].([]interface{})
+	assert.Equal(t, int64(300000), latencies[0].(map[string]interface{})["outputLatencyMicros"])
+
+	resp, err := request(r, `GET /info RTSP/1.0
+CSeq: 1
+
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+	ha := headerAsserter{t, resp.Header}
+	ha.assert("application/x-apple-binary-plist", "Content-Type")
+	body := readToString(resp.Body)
+	assert.Equal(t, "bplist00", body[:8])
+
+	resp, err = request(r, `GET /info RTSP/1.0
+CSeq: 2
+Accept: application/x-apple-plist+xml
+
+`)
+	assert.Nil(t, err)
+	ha = headerAsserter{t, resp.Header}
+	ha.assert("text/x-apple-plist+xml", "Content-Type")
+	assert.Contains(t, readToString(resp.Body), "<string>Kitchen</string>")
+
+	resp, err = request(r, `GET /unknown RTSP/1.0
+CSeq: 3
+
+`)
+	assert.Nil(t, err)
+	assert.Equal(t, 404, resp.StatusCode, "StatusCode")
+}
+
+func TestGetInfoWithoutSinkInfo(t *testing.T) {
+	r := makeTestRtspSession()
+	r.raop.sink.(*testClient).si = nil
+
+	info := r.raop.receiverInfo()
+	assert.Equal(t, "", info["name"])
+	assert.Equal(t, int64(featureAudio|featureAudioRedundant|featureMetadataProgress), info["features"])
+}
+
+func TestParsePipelined(t *testing.T) {
+	rs := "SET_PARAMETER rtsp://10.0.0.1/1234 RTSP/1.0\r\n" +
+		"CSeq: 1\r\n" +
+		"Content-Type: text/parameters\r\n" +
+		"Content-Length: 12\r\n" +
+		"\r\n" +
+		"volume: -5.0" +
+		"OPTIONS * RTSP/1.0\r\n" +
+		"CSeq: 2\r\n" +
+		"\r\n"
+	r := &rtspSession{}
+	brd := newRTSPReader(bytes.NewBufferString(rs))
+
+	req, err := r.readRequest(brd)
+	assert.NoError(t, err)
+	assert.Equal(t, "SET_PARAMETER", req.Method)
+	assert.Equal(t, "volume: -5.0", readToString(req.Body))
+
+	req, err = r.readRequest(brd)
+	assert.NoError(t, err)
+	assert.Equal(t, "OPTIONS", req.Method)
+	assert.Equal(t, "2", req.Header.Get("CSeq"))
+	assert.Equal(t, "", readToString(req.Body))
+
+	_, err = r.readRequest(brd)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestParseMalformed(t *testing.T) {
+	tooManyHeaders := "OPTIONS * RTSP/1.0\r\n"
+	for ii := 0; ii <= maxRTSPHeaders; ii++ {
+		tooManyHeaders += fmt.Sprintf("X-Header-%d: %d\r\n", ii, ii)
+	}
+	tests := []struct {
+		req    string
+		status int
+	}{
+		{"OPTIONS\r\n\r\n", 400},
+		{"OPTIONS *\r\n\r\n", 400},
+		{" * RTSP/1.0\r\n\r\n", 400},
+		{"OPTIONS * RTSP\r\n\r\n", 400},
+		{"OPTIONS * RTSP/x.0\r\n\r\n", 400},
+		{"OPTIONS * FOO/1.0\r\n\r\n", 400},
+		{"OPTIONS * RTSP/2.0\r\n\r\n", 505},
+		{"OPTIONS %zz RTSP/1.0\r\n\r\n", 400},
+		{"OPTIONS * RTSP/1.0\r\nNoColon\r\n\r\n", 400},
+		{"OPTIONS * RTSP/1.0\r\nContent-Length: -1\r\n\r\n", 400},
+		{"OPTIONS * RTSP/1.0\r\nContent-Length: 99999999999\r\n\r\n", 413},
+		{"OPTIONS * RTSP/1.0\r\nX-Long: " + strings.Repeat("x", maxRTSPLineLength) + "\r\n\r\n", 400},
+		{tooManyHeaders + "\r\n", 400},
+	}
+	r := &rtspSession{}
+	for _, test := range tests {
+		_, err := r.readRequest(newRTSPReader(bytes.NewBufferString(test.req)))
+		if assert.IsType(t, &RTSPError{}, err, test.req) {
+			assert.Equal(t, test.status, err.(*RTSPError).StatusCode, test.req)
+		}
+	}
+}
+
+func TestParseRTSPVersion(t *testing.T) {
+	proto, major, minor, err := parseRTSPVersion("RTSP/1.0")
+	assert.NoError(t, err)
+	assert.Equal(t, "RTSP", proto)
+	assert.Equal(t, 1, major)
+	assert.Equal(t, 0, minor)
+
+	proto, major, minor, err = parseRTSPVersion("HTTP/1.1")
+	assert.NoError(t, err)
+	assert.Equal(t, "HTTP", proto)
+	assert.Equal(t, 1, major)
+	assert.Equal(t, 1, minor)
+}
+
+func TestParseRequestURL(t *testing.T) {
+	u, err := parseRequestURL("rtsp://fe80::461e:a1ff:fece:f4a9/9953613529495192746")
+	assert.NoError(t, err)
+	assert.Equal(t, "fe80::461e:a1ff:fece:f4a9", u.Hostname())
+	assert.Equal(t, "/9953613529495192746", u.Path)
+
+	u, err = parseRequestURL("rtsp://fe80::1%en0/1234")
+	assert.NoError(t, err)
+	assert.Equal(t, "fe80::1%en0", u.Hostname())
+
+	u, err = parseRequestURL("rtsp://10.0.0.1:5000/1234")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", u.Hostname())
+
+	u, err = parseRequestURL("*")
+	assert.NoError(t, err)
+	assert.Equal(t, "*", u.Path)
+}
+
+func TestMalformedRequest(t *testing.T) {
+	tc := makeTestClient().(*testClient)
+	r, client := startPipeSession(tc)
+	defer client.Close()
+
+	go client.Write([]byte("GARBAGE\r\n\r\n"))
+	resp, err := bufio.NewReader(client).ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "RTSP/1.0 400 Bad Request\r\n", resp)
+
+	waitForStop(r)
+	stopped, reason := tc.stops()
+	assert.Equal(t, 1, stopped)
+	assert.IsType(t, &RTSPError{}, reason)
+	assert.NotNil(t, tc.rejected)
+}
+
+func TestMalformedRequestCseq(t *testing.T) {
+	tc := makeTestClient().(*testClient)
+	r, client := startPipeSession(tc)
+	defer client.Close()
+
+	cr := bufio.NewReader(client)
+	cw := bufio.NewWriter(client)
+	resp := raopTxRx(cw, cr, "OPTIONS * RTSP/1.0\r\nCSeq: 5\r\nNoColon\r\n\r\n")
+	assert.Contains(t, resp, "RTSP/1.0 400 Bad Request\r\n")
+	assert.Contains(t, resp, "Cseq: 5\r\n")
+	waitForStop(r)
+}
+
+func FuzzReadRequest(f *testing.F) {
+	f.Add([]byte("OPTIONS * RTSP/1.0\r\nCSeq: 1\r\n\r\n"))
+	f.Add([]byte("SET_PARAMETER rtsp://fe80::1/1 RTSP/1.0\r\nContent-Length: 4\r\n\r\nabcdGET /info RTSP/1.0\r\n\r\n"))
+	f.Add([]byte("\r\n\r\nRECORD rtsp://10.0.0.1/1 RTSP/1.0\r\nRTP-Info: seq=1;rtptime=2\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := &rtspSession{}
+		brd := newRTSPReader(bytes.NewReader(data))
+		for {
+			req, err := r.readRequest(brd)
+			if err != nil {
+				if _, ok := err.(*RTSPError); !ok && err != io.EOF {
+					t.Fatalf("Unexpected error %v", err)
+				}
+				return
+			}
+			if req.Method == "" || req.URL == nil || req.ProtoMajor != 1 {
+				t.Fatalf("Invalid request %v", req)
+			}
+			io.Copy(ioutil.Discard, req.Body)
+		}
+	})
+}
+
+func interleavedFrame(channel byte, content []byte) []byte {
+	return append([]byte{'$', channel, byte(len(content) >> 8), byte(len(content))}, content...)
+}
+
+func TestReadInterleaved(t *testing.T) {
+	var received []seqno
+	capture := func(pkt *rtpPacket) {
+		received = append(received, pkt.sn)
+		pkt.Reclaim()
+	}
+	r := &rtspSession{raop: &raop{}, s: &session{}}
+	r.s.interleaved = map[byte]rtpHandler{0: capture}
+
+	b := bytes.NewBuffer(nil)
+	b.Write(interleavedFrame(0, testPacket(4711, 96).content))
+	b.Write(interleavedFrame(7, testPacket(4712, 96).content)) // Unknown channel
+	b.Write(interleavedFrame(0, []byte{1, 2, 3}))              // Too short
+	b.Write(interleavedFrame(0, testPacket(4713, 96).content))
+	b.WriteString("OPTIONS * RTSP/1.0\r\nCSeq: 3\r\n\r\n")
+	brd := newRTSPReader(b)
+
+	for ii := 0; ii < 4; ii++ {
+		assert.NoError(t, r.readInterleaved(brd))
+	}
+	assert.Equal(t, []seqno{4711, 4713}, received)
+
+	req, err := r.readRequest(brd)
+	assert.NoError(t, err)
+	assert.Equal(t, "OPTIONS", req.Method)
+}
+
+func TestSetupInterleaved(t *testing.T) {
+	tc := makeTestClient().(*testClient)
+	r, client := startPipeSession(tc)
+	defer client.Close()
+
+	cr := bufio.NewReader(client)
+	cw := bufio.NewWriter(client)
+	resp := raopTxRx(cw, cr, fmt.Sprintf("SETUP rtsp://10.0.0.1/1234 RTSP/1.0\r\n"+
+		"Transport: RTP/AVP/TCP;unicast;interleaved=0-1;mode=record\r\n"+
+		"CSeq: 2\r\n"+
+		"Session: %s\r\n\r\n", r.s.id))
+	assert.Contains(t, resp, "RTSP/1.0 200 OK\r\n")
+	assert.Contains(t, resp, "Transport: RTP/AVP/TCP;unicast;interleaved=0-1;mode=record\r\n")
+	assert.Contains(t, resp, "Session: "+r.s.id+"\r\n")
+
+	// A sync packet on the control channel followed by an RTSP request on
+	// the same connection
+	sync := interleavedFrame(1, testPacket(7, 84).content[:20])
+	resp = raopTxRx(cw, cr, string(sync)+"OPTIONS * RTSP/1.0\r\nCSeq: 3\r\n\r\n")
+	assert.Contains(t, resp, "RTSP/1.0 200 OK\r\n")
+	assert.Contains(t, resp, "Cseq: 3\r\n")
+}
@@ -2,32 +2,396 @@ package raopd
 
 import (
 	"bufio"
+	"fmt"
 	"io"
+	"net"
+	"strconv"
 	"strings"
 )
 
-type sdp map[string]string
+// Session Description Protocol, RFC 4566, as sent by sources in the body
+// of ANNOUNCE. Only the parts needed by RAOP are interpreted, other lines
+// are kept as they are.
 
-func makeSdpRecords(r io.Reader) sdp {
-	s := make(map[string]string)
+// A session description with its media descriptions.
+type sessionDescription struct {
+	version    int
+	origin     string         // o=
+	name       string         // s=
+	info       string         // i=
+	connection *sdpConnection // c=, may be overridden by the media
+	timing     string         // t=
+	attributes []sdpAttribute // a= before the first m=
+	media      []*mediaDescription
+}
+
+// A media description started by an m= line.
+type mediaDescription struct {
+	media      string // "audio"
+	port       int
+	proto      string // "RTP/AVP"
+	formats    []int  // RTP payload types
+	info       string
+	connection *sdpConnection
+	attributes []sdpAttribute
+	rtpmaps    map[int]*sdpRtpmap
+	fmtps      map[int]*sdpFmtp
+}
+
+// The connection data of a c= line, e.g. "IN IP4 10.0.0.17"
+type sdpConnection struct {
+	netType  string
+	addrType string
+	address  net.IP
+}
+
+// An attribute of an a= line, flags have an empty value.
+type sdpAttribute struct {
+	name  string
+	value string
+}
+
+// An a=rtpmap attribute, e.g. "96 L16/44100/2". AirPlay sources send
+// "96 AppleLossless" without a clock rate.
+type sdpRtpmap struct {
+	payloadType int
+	encoding    string
+	clockRate   int // 0 if not given
+	channels    int // 0 if not given
+}
+
+// The rtpmaps of the static audio payload types of RFC 3551 which may be
+// announced without an rtpmap attribute.
+var staticRtpmaps = map[int]*sdpRtpmap{
+	10: {10, "L16", 44100, 2},
+	11: {11, "L16", 44100, 1},
+}
+
+// An a=fmtp attribute, the parameters are format specific. They are either
+// separated by white space, as for ALAC, or key=value pairs separated by
+// ';', e.g. "mode=AAC-hbr; config=1210".
+type sdpFmtp struct {
+	payloadType int
+	params      string            // The parameters as given
+	fields      []string          // The parameters separated by white space
+	parameters  map[string]string // The key=value parameters by lower case key
+}
+
+// sdpError describes a malformed session description.
+type sdpError struct {
+	line   int // 0 if the error is not on a particular line
+	reason string
+}
+
+func (e *sdpError) Error() string {
+	if e.line == 0 {
+		return "Malformed SDP: " + e.reason
+	}
+	return fmt.Sprintf("Malformed SDP line %d: %s", e.line, e.reason)
+}
+
+func parseSdpConnection(value string) (*sdpConnection, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 3 || fields[0] != "IN" || (fields[1] != "IP4" && fields[1] != "IP6") {
+		return nil, fmt.Errorf("Unknown connection '%s'", value)
+	}
+	// Multicast addresses may have a TTL and count after the address
+	address := net.ParseIP(strings.SplitN(fields[2], "/", 2)[0])
+	if address == nil {
+		return nil, fmt.Errorf("Unparsable address '%s'", fields[2])
+	}
+	return &sdpConnection{fields[0], fields[1], address}, nil
+}
+
+func (c *sdpConnection) String() string {
+	return fmt.Sprint(c.netType, " ", c.addrType, " ", c.address)
+}
+
+func parseSdpRtpmap(value string) (*sdpRtpmap, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("Malformed rtpmap '%s'", value)
+	}
+	pt, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed rtpmap payload type '%s'", fields[0])
+	}
+	rm := &sdpRtpmap{payloadType: pt}
+	parts := strings.Split(fields[1], "/")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("Malformed rtpmap encoding '%s'", fields[1])
+	}
+	rm.encoding = parts[0]
+	if len(parts) > 1 {
+		if rm.clockRate, err = strconv.Atoi(parts[1]); err != nil {
+			return nil, fmt.Errorf("Malformed rtpmap clock rate '%s'", parts[1])
+		}
+	}
+	if len(parts) > 2 {
+		if rm.channels, err = strconv.Atoi(parts[2]); err != nil {
+			return nil, fmt.Errorf("Malformed rtpmap channels '%s'", parts[2])
+		}
+	}
+	return rm, nil
+}
+
+func (rm *sdpRtpmap) String() string {
+	s := fmt.Sprint(rm.payloadType, " ", rm.encoding)
+	if rm.clockRate != 0 {
+		s += fmt.Sprint("/", rm.clockRate)
+		if rm.channels != 0 {
+			s += fmt.Sprint("/", rm.channels)
+		}
+	}
+	return s
+}
+
+func parseSdpFmtp(value string) (*sdpFmtp, error) {
+	kv := strings.SplitN(strings.TrimSpace(value), " ", 2)
+	pt, err := strconv.Atoi(kv[0])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed fmtp payload type '%s'", kv[0])
+	}
+	f := &sdpFmtp{payloadType: pt}
+	if len(kv) == 2 {
+		f.params = strings.TrimSpace(kv[1])
+	}
+	f.fields = strings.Fields(f.params)
+	for _, param := range strings.Split(f.params, ";") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if f.parameters == nil {
+			f.parameters = make(map[string]string)
+		}
+		f.parameters[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+	}
+	return f, nil
+}
+
+// Returns the value of a key=value parameter of the fmtp, which may be nil.
+// Keys are not case sensitive.
+func (f *sdpFmtp) parameter(key string) (string, bool) {
+	if f == nil {
+		return "", false
+	}
+	value, ok := f.parameters[strings.ToLower(key)]
+	return value, ok
+}
+
+// The fmtp as the value of the a=fmtp attribute
+func (f *sdpFmtp) String() string {
+	return fmt.Sprint(f.payloadType, " ", f.params)
+}
 
-	br := bufio.NewReader(r)
-	for {
-		line, err := br.ReadString('\n')
+func parseSdpAttribute(value string) sdpAttribute {
+	kv := strings.SplitN(value, ":", 2)
+	if len(kv) == 1 {
+		return sdpAttribute{name: kv[0]}
+	}
+	return sdpAttribute{kv[0], kv[1]}
+}
+
+func parseSdpMedia(value string) (*mediaDescription, error) {
+	fields := strings.Fields(value)
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("Malformed media '%s'", value)
+	}
+	md := &mediaDescription{media: fields[0], proto: fields[2]}
+	var err error
+	// The port may have a number of ports after it
+	if md.port, err = strconv.Atoi(strings.SplitN(fields[1], "/", 2)[0]); err != nil {
+		return nil, fmt.Errorf("Malformed media port '%s'", fields[1])
+	}
+	for _, f := range fields[3:] {
+		pt, err := strconv.Atoi(f)
 		if err != nil {
-			break
+			return nil, fmt.Errorf("Malformed media format '%s'", f)
 		}
-		line = strings.Trim(line, " \r\n")
+		md.formats = append(md.formats, pt)
+	}
+	md.rtpmaps = make(map[int]*sdpRtpmap)
+	md.fmtps = make(map[int]*sdpFmtp)
+	return md, nil
+}
+
+// Add an attribute to the media, rtpmap and fmtp are parsed.
+func (md *mediaDescription) addAttribute(a sdpAttribute) error {
+	switch a.name {
+	case "rtpmap":
+		rm, err := parseSdpRtpmap(a.value)
+		if err != nil {
+			return err
+		}
+		md.rtpmaps[rm.payloadType] = rm
+	case "fmtp":
+		f, err := parseSdpFmtp(a.value)
+		if err != nil {
+			return err
+		}
+		md.fmtps[f.payloadType] = f
+	}
+	md.attributes = append(md.attributes, a)
+	return nil
+}
+
+/*
+Parse a session description. The description must start with "v=0" and
+every line must be of the form <type>=<value>. Unknown types are ignored.
+*/
+func parseSDP(r io.Reader) (*sessionDescription, error) {
+	sd := &sessionDescription{version: -1}
+	var md *mediaDescription
+
+	scanner := bufio.NewScanner(r)
+	for ln := 1; scanner.Scan(); ln++ {
+		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
 			continue
 		}
-		kv := strings.SplitN(line, "=", 2)
-		if kv[0] == "a" {
-			kv = strings.SplitN(line, ":", 2)
-			s[kv[0]] = kv[1]
+		if len(line) < 2 || line[1] != '=' {
+			return nil, &sdpError{ln, fmt.Sprintf("Expected <type>=<value>, got '%s'", line)}
+		}
+		typ, value := line[0], line[2:]
+		if sd.version < 0 && typ != 'v' {
+			return nil, &sdpError{ln, "The description must start with v="}
+		}
+
+		var err error
+		switch typ {
+		case 'v':
+			if sd.version >= 0 {
+				return nil, &sdpError{ln, "Repeated v="}
+			}
+			if value != "0" {
+				return nil, &sdpError{ln, fmt.Sprintf("Unknown version '%s'", value)}
+			}
+			sd.version = 0
+		case 'o':
+			sd.origin = value
+		case 's':
+			sd.name = value
+		case 't':
+			sd.timing = value
+		case 'i':
+			if md != nil {
+				md.info = value
+			} else {
+				sd.info = value
+			}
+		case 'c':
+			var c *sdpConnection
+			c, err = parseSdpConnection(value)
+			if md != nil {
+				md.connection = c
+			} else {
+				sd.connection = c
+			}
+		case 'm':
+			md, err = parseSdpMedia(value)
+			if err == nil {
+				sd.media = append(sd.media, md)
+			}
+		case 'a':
+			a := parseSdpAttribute(value)
+			if md != nil {
+				err = md.addAttribute(a)
+			} else {
+				sd.attributes = append(sd.attributes, a)
+			}
+		}
+		if err != nil {
+			return nil, &sdpError{ln, err.Error()}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if sd.version < 0 {
+		return nil, &sdpError{0, "Empty description"}
+	}
+	return sd, nil
+}
+
+// Returns the first media description of the kind, e.g. "audio", or nil.
+func (sd *sessionDescription) findMedia(media string) *mediaDescription {
+	for _, md := range sd.media {
+		if md.media == media {
+			return md
+		}
+	}
+	return nil
+}
+
+// Returns the connection of the media, or of the session if the media has
+// none.
+func (sd *sessionDescription) connectionOf(md *mediaDescription) *sdpConnection {
+	if md != nil && md.connection != nil {
+		return md.connection
+	}
+	return sd.connection
+}
+
+// Returns the value of the first attribute with the name of the media or,
+// if the media does not have the attribute, of the session.
+func (sd *sessionDescription) attribute(md *mediaDescription, name string) (string, bool) {
+	if md != nil {
+		for _, a := range md.attributes {
+			if a.name == name {
+				return a.value, true
+			}
+		}
+	}
+	for _, a := range sd.attributes {
+		if a.name == name {
+			return a.value, true
+		}
+	}
+	return "", false
+}
+
+func writeSdpAttributes(w io.Writer, attributes []sdpAttribute) {
+	for _, a := range attributes {
+		if a.value == "" {
+			fmt.Fprintf(w, "a=%s\r\n", a.name)
 		} else {
-			s[kv[0]] = kv[1]
+			fmt.Fprintf(w, "a=%s:%s\r\n", a.name, a.value)
 		}
 	}
-	return s
+}
+
+// Write the session description in the SDP format.
+func (sd *sessionDescription) marshal(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "v=%d\r\n", sd.version)
+	if sd.origin != "" {
+		fmt.Fprintf(bw, "o=%s\r\n", sd.origin)
+	}
+	fmt.Fprintf(bw, "s=%s\r\n", sd.name)
+	if sd.info != "" {
+		fmt.Fprintf(bw, "i=%s\r\n", sd.info)
+	}
+	if sd.connection != nil {
+		fmt.Fprintf(bw, "c=%s\r\n", sd.connection)
+	}
+	if sd.timing != "" {
+		fmt.Fprintf(bw, "t=%s\r\n", sd.timing)
+	}
+	writeSdpAttributes(bw, sd.attributes)
+	for _, md := range sd.media {
+		fmt.Fprintf(bw, "m=%s %d %s", md.media, md.port, md.proto)
+		for _, pt := range md.formats {
+			fmt.Fprintf(bw, " %d", pt)
+		}
+		bw.WriteString("\r\n")
+		if md.info != "" {
+			fmt.Fprintf(bw, "i=%s\r\n", md.info)
+		}
+		if md.connection != nil {
+			fmt.Fprintf(bw, "c=%s\r\n", md.connection)
+		}
+		writeSdpAttributes(bw, md.attributes)
+	}
+	return bw.Flush()
 }
@@ -2,8 +2,11 @@ package raopd
 
 import (
 	"bytes"
-	"github.com/stretchr/testify/assert"
+	"net"
+	"strings"
 	"testing"
+
+	"github.com/stretchr/testify/assert"
 )
 
 func TestSdp(t *testing.T) {
@@ -22,8 +25,133 @@ a=min-latency:11025
 a=max-latency:88200
 `
 
-	sdp := makeSdpRecords(bytes.NewBufferString(sdpdata))
+	sdp, err := parseSDP(bytes.NewBufferString(sdpdata))
 
+	assert.NoError(t, err)
 	assert.NotNil(t, sdp)
-	assert.Equal(t, "AirTunes", sdp["s"])
+	assert.Equal(t, "AirTunes", sdp.name)
+	assert.Equal(t, "Magnus iPhone", sdp.info)
+	assert.Equal(t, net.ParseIP("fe80::495:eb8c:ffb8:8083"), sdp.connection.address)
+
+	md := sdp.findMedia("audio")
+	assert.NotNil(t, md)
+	assert.Equal(t, "RTP/AVP", md.proto)
+	assert.Equal(t, []int{96}, md.formats)
+	assert.Equal(t, &sdpRtpmap{payloadType: 96, encoding: "AppleLossless"}, md.rtpmaps[96])
+	assert.Equal(t, "352 0 16 40 10 14 2 255 0 0 44100", md.fmtps[96].params)
+	assert.Equal(t, "96 352 0 16 40 10 14 2 255 0 0 44100", md.fmtps[96].String())
+	assert.Equal(t, []string{"352", "0", "16", "40", "10", "14", "2", "255", "0", "0", "44100"}, md.fmtps[96].fields)
+	assert.Nil(t, md.fmtps[96].parameters)
+	iv, ok := sdp.attribute(md, "aesiv")
+	assert.True(t, ok)
+	assert.Equal(t, "ts4b86KgrpXPdjvEkPOQdg==", iv)
+	_, ok = sdp.attribute(md, "unknown")
+	assert.False(t, ok)
+	assert.Equal(t, sdp.connection, sdp.connectionOf(md))
+}
+
+func TestSdpMedia(t *testing.T) {
+	sdpdata := "v=0\r\n" +
+		"s=AirTunes\r\n" +
+		"c=IN IP4 10.0.0.1\r\n" +
+		"a=tool:test\r\n" +
+		"m=video 0 RTP/AVP 97\r\n" +
+		"m=audio 6000 RTP/AVP 96 97\r\n" +
+		"c=IN IP4 10.0.0.2\r\n" +
+		"a=rtpmap:96 L16/44100/2\r\n" +
+		"a=rtpmap:97 mpeg4-generic/44100\r\n" +
+		"a=fmtp:97 mode=AAC-hbr\r\n" +
+		"a=recvonly\r\n"
+
+	sdp, err := parseSDP(bytes.NewBufferString(sdpdata))
+	assert.NoError(t, err)
+	assert.Len(t, sdp.media, 2)
+
+	md := sdp.findMedia("audio")
+	assert.Equal(t, 6000, md.port)
+	assert.Equal(t, []int{96, 97}, md.formats)
+	assert.Equal(t, &sdpRtpmap{96, "L16", 44100, 2}, md.rtpmaps[96])
+	assert.Equal(t, &sdpRtpmap{97, "mpeg4-generic", 44100, 0}, md.rtpmaps[97])
+	assert.Equal(t, "mode=AAC-hbr", md.fmtps[97].params)
+	assert.Nil(t, md.fmtps[96])
+	mode, ok := md.fmtps[97].parameter("Mode")
+	assert.True(t, ok)
+	assert.Equal(t, "AAC-hbr", mode)
+	_, ok = md.fmtps[96].parameter("mode")
+	assert.False(t, ok)
+	assert.Equal(t, net.ParseIP("10.0.0.2"), sdp.connectionOf(md).address)
+
+	_, ok = sdp.attribute(md, "recvonly")
+	assert.True(t, ok)
+	tool, ok := sdp.attribute(md, "tool")
+	assert.True(t, ok, "Session attributes apply to the media")
+	assert.Equal(t, "test", tool)
+
+	// Marshal and parse again
+	b := bytes.NewBufferString("")
+	assert.NoError(t, sdp.marshal(b))
+	assert.Equal(t, sdpdata, b.String())
+	again, err := parseSDP(b)
+	assert.NoError(t, err)
+	assert.Equal(t, sdp, again)
+}
+
+func TestSdpFmtpParameters(t *testing.T) {
+	f, err := parseSdpFmtp("96 streamtype=5; profile-level-id=1;mode=AAC-hbr; sizeLength=13;config=1210")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"streamtype": "5", "profile-level-id": "1",
+		"mode": "AAC-hbr", "sizelength": "13", "config": "1210"}, f.parameters)
+	sizeLength, ok := f.parameter("SizeLength")
+	assert.True(t, ok)
+	assert.Equal(t, "13", sizeLength)
+	_, ok = f.parameter("indexlength")
+	assert.False(t, ok)
+}
+
+func TestSdpConnection(t *testing.T) {
+	c, err := parseSdpConnection("IN IP6 fe80::1c14:b58a:3cb8:868b")
+	assert.Nil(t, err)
+	assert.Equal(t, net.ParseIP("fe80::1c14:b58a:3cb8:868b"), c.address)
+	assert.Equal(t, "IP6", c.addrType)
+
+	c, err = parseSdpConnection("IN IP4 194.128.55.78")
+	assert.Nil(t, err)
+	assert.Equal(t, net.ParseIP("194.128.55.78"), c.address)
+	assert.Equal(t, "IN IP4 194.128.55.78", c.String())
+
+	// Multicast with a TTL
+	c, err = parseSdpConnection("IN IP4 224.2.1.1/127")
+	assert.Nil(t, err)
+	assert.Equal(t, net.ParseIP("224.2.1.1"), c.address)
+
+	_, err = parseSdpConnection("IN IP8 194.128.55.78")
+	assert.NotNil(t, err)
+
+	_, err = parseSdpConnection("IN IP4 194.128,55.78")
+	assert.NotNil(t, err)
+}
+
+func TestSdpMalformed(t *testing.T) {
+	for _, sdpdata := range []string{
+		"",
+		"s=AirTunes\n",
+		"v=1\n",
+		"v=0\nv=0\n",
+		"v=0\ns\n",
+		"v=0\nc=IN IP4 10.0.0\n",
+		"v=0\nc=IN IP8 10.0.0.1\n",
+		"v=0\nm=audio\n",
+		"v=0\nm=audio x RTP/AVP 96\n",
+		"v=0\nm=audio 0 RTP/AVP AppleLossless\n",
+		"v=0\nm=audio 0 RTP/AVP 96\na=rtpmap:96\n",
+		"v=0\nm=audio 0 RTP/AVP 96\na=rtpmap:x AppleLossless\n",
+		"v=0\nm=audio 0 RTP/AVP 96\na=rtpmap:96 L16/x\n",
+		"v=0\nm=audio 0 RTP/AVP 96\na=fmtp:x 1 2 3\n",
+	} {
+		_, err := parseSDP(strings.NewReader(sdpdata))
+		assert.Error(t, err, sdpdata)
+		if err != nil {
+			assert.Contains(t, err.Error(), "Malformed SDP", sdpdata)
+		}
+	}
 }
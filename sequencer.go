@@ -12,8 +12,10 @@ var debugSequenceLogFlag bool
 
 type sequencer struct {
 	// Control channel
-	control chan int
+	control chan sequencerCommand
+	done    chan struct{} // Closed when the sequencer go-routine exits
 	ref     string
+	lostf   func(start, count seqno) // Called when packets are given up on, may be nil
 
 	// Internally used
 	low     seqno
@@ -32,14 +34,56 @@ func (rr *rerequest) String() string {
 	return fmt.Sprintf("ReRequest{first=%d, count=%d}", rr.first, rr.count)
 }
 
+const (
+	sequencerRestart = iota
+	sequencerClose
+	sequencerFlush
+	sequencerSync
+)
+
+type sequencerCommand struct {
+	cmd    int
+	sn     seqno         // The new low seqno for sequencerFlush
+	synced chan struct{} // Closed when sequencerSync is done
+}
+
 // Restart the sequencer. Empty all internal caches
 func (s *sequencer) flush() {
-	s.control <- 0
+	s.command(sequencerCommand{cmd: sequencerRestart})
+}
+
+// Drop all queued and cached packets older than sn and continue the
+// sequence from sn.
+func (s *sequencer) flushTo(sn seqno) {
+	s.command(sequencerCommand{cmd: sequencerFlush, sn: sn})
+}
+
+// Send a command to the sequencer unless it has been closed.
+func (s *sequencer) command(cmd sequencerCommand) {
+	select {
+	case s.control <- cmd:
+	case <-s.done:
+	}
+}
+
+// Wait until all packets queued before the call have been handled.
+func (s *sequencer) sync() {
+	synced := make(chan struct{})
+	select {
+	case s.control <- sequencerCommand{cmd: sequencerSync, synced: synced}:
+	case <-s.done:
+		return // Already closed
+	}
+	select {
+	case <-synced:
+	case <-s.done:
+	}
 }
 
-// Close the sequencer completely.
+// Close the sequencer completely and wait for it to finish.
 func (s *sequencer) close() {
-	s.control <- 1
+	s.control <- sequencerCommand{cmd: sequencerClose}
+	<-s.done
 }
 
 // Internal functions
@@ -58,6 +102,22 @@ func (s *sequencer) restartSequencer() {
 	s.packets = make(map[seqno]*rtpPacket)
 }
 
+// Drop all cached packets older than sn and make sn the next packet
+// to output. Packets still queued which are older than sn will be
+// discarded by handle when they arrive.
+func (s *sequencer) flushBefore(sn seqno, outf func(pkt *rtpPacket)) {
+	for psn, pkt := range s.packets {
+		if seqnoDelta(psn, sn) < 0 {
+			s.sl.note("Flushed cached packet ", psn)
+			delete(s.packets, psn)
+			pkt.Reclaim()
+		}
+	}
+	s.retries = make(map[seqno]int)
+	s.lowd = true
+	s.flushCached(sn, outf)
+}
+
 // flush packet cache from seqno and onwards and set low to
 // first gap in the cache.
 func (s *sequencer) flushCached(sn seqno, outf func(pkt *rtpPacket)) {
@@ -154,7 +214,11 @@ func (s *sequencer) sendReRequests(request chan rerequest) {
 			case 3, 11, 23: // Send rerequest at 30ms, 110ms, and 230ms
 				rr := &rerequest{start, count}
 				s.sl.reRequest(rr, retry)
-				request <- *rr
+				select {
+				case request <- *rr:
+				default:
+					// Nobody is sending rerequests, don't block the sequencer
+				}
 			case 37: // Well I don't think we'll get any packets after 370 ms
 				s.remove(start, count)
 			}
@@ -210,7 +274,7 @@ func (s *sequencer) printState() {
 }
 
 // Remove all retries and packets starting with start and count entries
-// low will be set to the new start
+// low will be set to the new start. The packets are reported as lost.
 func (s *sequencer) remove(start, count seqno) {
 	s.sl.removePackets(start, count)
 	for ii := count; ii > 0; ii-- {
@@ -219,13 +283,18 @@ func (s *sequencer) remove(start, count seqno) {
 		start++
 	}
 	s.low = start
+	if s.lostf != nil {
+		s.lostf(start-count, count)
+	}
 }
 
 // Start a sequence in a goroutine.
-func startSequencer(ref string, data chan *rtpPacket, outf func(pkt *rtpPacket), request chan rerequest) *sequencer {
+func startSequencer(ref string, data chan *rtpPacket, outf func(pkt *rtpPacket), lostf func(start, count seqno), request chan rerequest) *sequencer {
 
 	s := &sequencer{}
-	s.control = make(chan int, 0)
+	s.lostf = lostf
+	s.control = make(chan sequencerCommand, 0)
+	s.done = make(chan struct{})
 	s.restartSequencer()
 	s.ref = ref
 	s.sl = &sequencelog{}
@@ -233,9 +302,10 @@ func startSequencer(ref string, data chan *rtpPacket, outf func(pkt *rtpPacket),
 	timeout := time.Duration(10 * time.Millisecond) // 10 mS
 	timer := time.NewTimer(timeout)
 
-	var cmd int
+	var cmd sequencerCommand
 
 	go func() {
+		defer close(s.done)
 	normal:
 		for {
 			// Normal operation
@@ -271,11 +341,25 @@ func startSequencer(ref string, data chan *rtpPacket, outf func(pkt *rtpPacket),
 			continue normal
 
 		command:
-			switch cmd {
-			case 0:
+			switch cmd.cmd {
+			case sequencerRestart:
 				s.sl.note("Restarting Sequencer")
 				s.restartSequencer()
-			case 1:
+			case sequencerFlush:
+				s.sl.note("Flushing Sequencer to seqno=", cmd.sn)
+				s.flushBefore(cmd.sn, outf)
+			case sequencerSync:
+			drain:
+				for {
+					select {
+					case pkt := <-data:
+						s.handle(pkt, outf)
+					default:
+						break drain
+					}
+				}
+				close(cmd.synced)
+			case sequencerClose:
 				s.sl.note("Shutting down Sequencer")
 				return
 			}
@@ -91,7 +91,7 @@ func TestSequenceConsecutive(t *testing.T) {
 	of := func(pkt *rtpPacket) {
 		out <- pkt
 	}
-	s := startSequencer("test", in, of, request)
+	s := startSequencer("test", in, of, nil, request)
 
 	in <- testPacket(4, 0)
 	in <- testPacket(5, 0)
@@ -117,7 +117,7 @@ func TestSequenceSingleGap(t *testing.T) {
 	of := func(pkt *rtpPacket) {
 		out <- pkt
 	}
-	s := startSequencer("test", in, of, request)
+	s := startSequencer("test", in, of, nil, request)
 
 	in <- testPacket(4, 0)
 	in <- testPacket(6, 0)
@@ -143,7 +143,7 @@ func TestSequenceDoubleGap(t *testing.T) {
 	of := func(pkt *rtpPacket) {
 		out <- pkt
 	}
-	s := startSequencer("test", in, of, request)
+	s := startSequencer("test", in, of, nil, request)
 
 	in <- testPacket(4, 0)
 	in <- testPacket(7, 0)
@@ -169,7 +169,7 @@ func TestSequenceWideGap(t *testing.T) {
 	of := func(pkt *rtpPacket) {
 		out <- pkt
 	}
-	s := startSequencer("test", in, of, request)
+	s := startSequencer("test", in, of, nil, request)
 
 	s.inSeqs(in, []int{46542, 46544})               // 46542..46544
 	s.inSeqs(in, 46554, 46549, []int{46555, 46559}) // 46542..46544 46549 46554..46559
@@ -210,7 +210,7 @@ func TestSequenceReReRequest(t *testing.T) {
 	of := func(pkt *rtpPacket) {
 		out <- pkt
 	}
-	s := startSequencer("test", in, of, request)
+	s := startSequencer("test", in, of, nil, request)
 
 	s.inSeqs(in, []int{46542, 46544})
 	// gap 46545..46553
@@ -259,7 +259,7 @@ func TestSequenceSlowResponse(t *testing.T) {
 	of := func(pkt *rtpPacket) {
 		out <- pkt
 	}
-	s := startSequencer("test", in, of, request)
+	s := startSequencer("test", in, of, nil, request)
 
 	s.inSeqs(in, []int{46542, 46544})
 	s.inSeqs(in, []int{46547, 46554})
@@ -288,7 +288,7 @@ func TestSequenceMissingRecoveryPacket(t *testing.T) {
 	of := func(pkt *rtpPacket) {
 		out <- pkt
 	}
-	s := startSequencer("test", in, of, request)
+	s := startSequencer("test", in, of, nil, request)
 
 	s.inSeqs(in, []int{46542, 46544})
 	s.inSeqs(in, []int{46547, 46554})
@@ -317,7 +317,7 @@ func TestSequenceGiveUp(t *testing.T) {
 	of := func(pkt *rtpPacket) {
 		out <- pkt
 	}
-	s := startSequencer("test", in, of, request)
+	s := startSequencer("test", in, of, nil, request)
 
 	s.inSeqs(in, []int{46542, 46544}) // 46542..46544
 	s.inSeqs(in, []int{46547, 46554}) // 46542..46544  46547..46554
@@ -382,6 +382,61 @@ func TestSequencerRemove(t *testing.T) {
 	s.checkReq(t, rrc, -1, 0)
 }
 
+func TestSequenceFlushTo(t *testing.T) {
+	in := make(chan *rtpPacket, 10)
+	out := make(chan *rtpPacket, 10)
+	request := make(chan rerequest, 10)
+
+	of := func(pkt *rtpPacket) {
+		out <- pkt
+	}
+	s := startSequencer("test", in, of, nil, request)
+
+	s.inSeqs(in, []int{100, 102})
+	s.inSeqs(in, []int{105, 106}) // Cached waiting for 103
+	s.checkSeqNos(t, out, 100, 102)
+
+	// Seek: 105 and 106 are older than the flush point and must be dropped
+	s.flushTo(200)
+	s.inSeqs(in, 104) // Late packet from before the flush
+	s.inSeqs(in, []int{200, 202})
+	s.checkSeqNos(t, out, 200, 202)
+	s.checkReq(t, request, -1, 0)
+
+	s.close()
+}
+
+func TestSequenceFlushClosed(t *testing.T) {
+	in := make(chan *rtpPacket, 10)
+	s := startSequencer("test", in, func(pkt *rtpPacket) {}, nil, make(chan rerequest, 10))
+	s.close()
+
+	// Flushing a closed sequencer must not block
+	s.flush()
+	s.flushTo(200)
+	s.sync()
+}
+
+func TestSequenceFlushToCached(t *testing.T) {
+	s := &sequencer{}
+	s.restartSequencer()
+	var output []seqno
+	outf := func(pkt *rtpPacket) {
+		output = append(output, pkt.sn)
+	}
+	s.lowd = true
+	s.low = 10
+	s.handle(testPacket(12, 0), outf)
+	s.handle(testPacket(20, 0), outf)
+	s.handle(testPacket(21, 0), outf)
+
+	// Packets from the flush point onwards are kept and output
+	s.flushBefore(20, outf)
+	assert.Equal(t, []seqno{20, 21}, output)
+	assert.Equal(t, seqno(22), s.low)
+	assert.False(t, s.inRecovery())
+}
+
 func TestSequenceSeqNo(t *testing.T) {
 	assert.Equal(t, 0, seqnoDelta(4711, 4711))
 	assert.Equal(t, 1, seqnoDelta(4712, 4711))
@@ -2,6 +2,8 @@ package raopd
 
 import (
 	"context"
+	"crypto/rsa"
+	"errors"
 	"io"
 	"sync"
 )
@@ -11,6 +13,10 @@ type SinkCollection struct {
 	i       *info // actually only crypto stuff
 	sources map[Sink]*Source
 	m       sync.Mutex
+
+	// Custom RTSP handlers, see HandleRTSP
+	hm       sync.RWMutex
+	handlers map[rtspRoute]RTSPHandler
 }
 
 // AirplaySource can be used by the audio output to
@@ -23,36 +29,73 @@ type Source struct {
 NewAirplaySinkCollection creates a new collection to register services.
 */
 func NewSinkCollection(keyfilename string) (*SinkCollection, error) {
-	rf := &SinkCollection{}
-	var err error
-	rf.i, err = makeInfo(keyfilename)
+	i, err := makeInfo(keyfilename)
 	if err != nil {
 		return nil, err
 	}
-	rf.sources = make(map[Sink]*Source)
-
-	return rf, nil
+	return newSinkCollection(i), nil
 }
 
 /*
-Close all services created in this registry
+NewSinkCollectionWithKey creates a new collection using the RSA private key
+to authenticate the sinks to the sources.
 */
-func (sc *SinkCollection) Close() {
-	var s map[Sink]*Source
+func NewSinkCollectionWithKey(key *rsa.PrivateKey) (*SinkCollection, error) {
+	i, err := makeInfoFromKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return newSinkCollection(i), nil
+}
 
-	{
-		sc.m.Lock()
-		defer sc.m.Unlock()
-		s = sc.sources
-		sc.sources = make(map[Sink]*Source)
+/*
+NewSinkCollectionFromPEM creates a new collection using the first RSA private
+key of the PEM data. The key may be PKCS#1 or PKCS#8. An encrypted PKCS#8
+key, as written by OpenSSL 3, or a key encrypted with the legacy PEM
+encryption is decrypted with the password, which should be nil if the key
+is not encrypted.
+*/
+func NewSinkCollectionFromPEM(data, password []byte) (*SinkCollection, error) {
+	key, err := parseRSAPrivateKeyPEM(data, password)
+	if err != nil {
+		return nil, err
 	}
+	return NewSinkCollectionWithKey(key)
+}
 
-	for sink, source := range s {
-		zeroconf().Unpublish(source.br)
-		sink.Closed()
+func newSinkCollection(i *info) *SinkCollection {
+	rf := &SinkCollection{}
+	rf.i = i
+	rf.sources = make(map[Sink]*Source)
+	return rf
+}
+
+/*
+Close all services created in this registry. Waits for all connections
+and sessions to finish and returns any errors encountered.
+*/
+func (sc *SinkCollection) Close() error {
+	return sc.Shutdown(context.Background())
+}
+
+/*
+Shutdown closes all services created in this registry. It waits for all
+connections and sessions to finish or until the context is done, whichever
+comes first.
+*/
+func (sc *SinkCollection) Shutdown(ctx context.Context) error {
+	sc.m.Lock()
+	s := sc.sources
+	sc.sources = make(map[Sink]*Source)
+	sc.m.Unlock()
+
+	var errs []error
+	for _, source := range s {
+		errs = append(errs, source.shutdown(ctx))
 	}
 
 	zeroconf().zeroconfCleanUp() // TODO: will cleanup too much
+	return errors.Join(errs...)
 }
 
 /*
@@ -73,12 +116,17 @@ func (sc *SinkCollection) Register(sink Sink) (*Source, error) {
 
 	source.raop.sink = sink
 	source.raop.acs = sc
-	source.raop.startRtspProcess()
+	err := source.raop.startRtspProcess()
+	if err != nil {
+		delete(sc.sources, sink)
+		return nil, err
+	}
 
 	source.raop.br = makeAPBonjourRecord(&source.raop)
-	err := publish(source.raop.br)
+	err = publish(source.raop.br)
 	if err != nil {
-		source.raop.close()
+		source.raop.shutdown(context.Background())
+		delete(sc.sources, sink)
 		return nil, err
 	}
 
@@ -86,21 +134,28 @@ func (sc *SinkCollection) Register(sink Sink) (*Source, error) {
 }
 
 /*
-Register will create and publish a new Airplay output.
+Unregister will unpublish and close the Airplay output of the sink. Waits
+for all connections and sessions of the sink to finish.
 */
-func (sc *SinkCollection) Unregister(sink Sink) {
-	var source *Source
-	{
-		sc.m.Lock()
-		defer sc.m.Unlock()
-
-		source = sc.sources[sink]
-		delete(sc.sources, sink)
+func (sc *SinkCollection) Unregister(sink Sink) error {
+	sc.m.Lock()
+	source, ok := sc.sources[sink]
+	delete(sc.sources, sink)
+	sc.m.Unlock()
+
+	if !ok {
+		return errors.New("Sink is not registered")
 	}
-
 	netlog.Debug.Println("Service Close")
-	zeroconf().Unpublish(source.br)
-	sink.Closed()
+	return source.shutdown(context.Background())
+}
+
+// Unpublish and shut down the source
+func (source *Source) shutdown(ctx context.Context) error {
+	err := zeroconf().Unpublish(source.br)
+	err = errors.Join(err, source.raop.shutdown(ctx))
+	source.raop.sink.Closed()
+	return err
 }
 
 /*
@@ -176,10 +231,22 @@ func (source *Source) VolumeMode(absolute bool) {
 }
 
 // NewAudioStream will start a new audio output stream for the source.
-// Only raw PCM with two channel
-// 16-bit depth at 44100 samples/second is currently supported. The parameter
+// The audio is raw PCM with two channel
+// 16-bit depth at 44100 samples/second, all streams
+// are converted to this format whatever the codec of the source, unless
+// NativeAudioFormat is set in the SinkInfo. See StreamFormat. The parameter
 // ctx is a context used to close the audio output. The streamed data
-// is sent to the writer w.
-func (source *Source) NewAudioStream(ctx context.Context, w io.Writer) {
-	source.raop.newStream(ctx, w)
+// is sent to the writer w, or to WriteFrame with the time each frame
+// should be heard if w is a TimedWriter. The audio is buffered for the
+// writer, see NewAudioStreamWithOptions for the default options. The
+// stream is closed when the sink is unregistered.
+func (source *Source) NewAudioStream(ctx context.Context, w io.Writer) *AudioStream {
+	return source.raop.newStream(ctx, w, AudioStreamOptions{})
+}
+
+// NewAudioStreamWithOptions will start a new audio output stream for the
+// source like NewAudioStream, with the size of the buffer of the writer and
+// what to do when it is full given by the options.
+func (source *Source) NewAudioStreamWithOptions(ctx context.Context, w io.Writer, opts AudioStreamOptions) *AudioStream {
+	return source.raop.newStream(ctx, w, opts)
 }
@@ -0,0 +1,375 @@
+package raopd
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// A session holds the state of a single source streaming to a sink. It is
+// created when the source announces a stream and lives until the source
+// tears it down, disconnects or is preempted by another source.
+type session struct {
+	id   string
+	raop *raop
+	rs   *rtspSession // The RTSP connection owning the session
+	audioDecoder
+
+	clientUserAgent       string
+	data, control, timing *rtp
+	remote                net.IP
+
+	// The RTP payload type of the audio announced in the SDP
+	payloadType int
+
+	seqchan   chan *rtpPacket
+	rrchan    chan rerequest
+	sequencer *sequencer
+
+	// Handlers for RTP interleaved on the RTSP connection by channel
+	interleaved map[byte]rtpHandler
+
+	// Relates the RTP timestamps to the local clock
+	clock clockSync
+
+	// Holds the audio until it is played, nil if not buffered
+	jitter *jitterBuffer
+
+	// Hands the audio to the audio streams if it is not buffered
+	outq *outputQueue
+
+	// Fills the gaps of lost packets
+	concealer *concealer
+
+	watchdog     watchdog
+	teardownOnce sync.Once
+	done         chan struct{} // Closed when the session is torn down
+}
+
+var sessionlog = getLogger("raopd.session", "RAOP Session Handling")
+
+// The Audio-Latency reported if the sink has no AudioLatency, in samples.
+const defaultAudioLatency = 11025
+
+func newSessionId() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		panic(err)
+	}
+	return fmt.Sprintf("%X", b)
+}
+
+func newSession(r *raop, rs *rtspSession) *session {
+	s := &session{}
+	s.id = newSessionId()
+	s.raop = r
+	s.rs = rs
+	s.done = make(chan struct{})
+	return s
+}
+
+func (s *session) String() string {
+	return fmt.Sprint("Session{id=", s.id, ", ", s.raop, "}")
+}
+
+func (s *session) startSequencer() {
+	if s.seqchan == nil {
+		s.seqchan = make(chan *rtpPacket, 256)
+		s.rrchan = make(chan rerequest, 128)
+		s.sequencer = startSequencer(s.raop.hwaddr.String(), s.seqchan, s.handleAudioPacket, s.lostPackets, s.rrchan)
+	}
+}
+
+// Queue a packet for the sequencer. The packet is dropped if the session
+// has been torn down.
+func (s *session) queue(pkt *rtpPacket) {
+	select {
+	case s.seqchan <- pkt:
+	case <-s.done:
+		pkt.Reclaim()
+	}
+}
+
+func (s *session) startRtp(controlAddr, timingAddr *net.UDPAddr) (err error) {
+	sessionlog.Debug.Println("startRtp...")
+	s.startSequencer()
+	if s.control == nil {
+		s.control, err = startRtp(s.capturing(captureControl, s.getControlHandler), controlAddr)
+		if err == nil {
+			s.data, err = startRtp(s.capturing(captureData, s.getDataHandler), nil)
+			if err == nil {
+				s.timing, err = startRtp(s.capturing(captureTiming, s.getTimingHandler), timingAddr)
+			}
+		}
+	}
+	if err != nil {
+		for _, r := range []*rtp{s.data, s.control, s.timing} {
+			if r != nil {
+				r.Close()
+			}
+		}
+		s.data, s.control, s.timing = nil, nil, nil
+		s.sequencer.close()
+		s.sequencer = nil
+		s.seqchan = nil
+		sessionlog.Debug.Println("Failed to start RTP:", err)
+	}
+	return
+}
+
+// Receive RTP data and control packets interleaved on the RTSP connection
+// instead of UDP. There is no timing channel and resends are never needed.
+func (s *session) startInterleaved(dataChannel, controlChannel byte) {
+	sessionlog.Debug.Println("startInterleaved data=", dataChannel, ", control=", controlChannel)
+	s.startSequencer()
+	data, _, _ := s.getDataHandler(nil)
+	control, _, _ := s.getControlHandler(nil)
+	s.interleaved = map[byte]rtpHandler{
+		dataChannel:    data,
+		controlChannel: control,
+	}
+}
+
+func (s *session) handleAudioPacket(pkt *rtpPacket) {
+	frame := AudioFrame{RtpTime: pkt.rtptime()}
+	if frame.Audio = s.decode(pkt); len(frame.Audio) > 0 {
+		if s.concealer != nil {
+			for _, cf := range s.concealer.conceal(frame) {
+				s.output(cf)
+			}
+		}
+		s.output(frame)
+	}
+}
+
+// Write a decoded frame to the jitter buffer or the audio streams.
+func (s *session) output(frame AudioFrame) {
+	rate := s.codec.SampleRate()
+	if s.jitter != nil {
+		sent, _ := s.clock.sendTime(frame.RtpTime, rate)
+		s.jitter.push(frame, sent)
+		return
+	}
+	frame.PresentationTime, _ = s.clock.localTime(frame.RtpTime, rate)
+	s.outq.push(frame, s.format.duration(frame.Audio))
+}
+
+// Called by the sequencer when it gives up on packets.
+func (s *session) lostPackets(start, count seqno) {
+	sessionlog.Debug.Println("Lost ", count, " packets from seqno=", start)
+	if s.concealer != nil {
+		s.concealer.lostPackets(int(count))
+	}
+}
+
+// Start the loss concealment, and the jitter buffer if the sink has a
+// target latency and the audio is buffered or else the output queue. The
+// codec must have been initialized.
+func (s *session) startOutput() {
+	mode := ConcealSilence
+	si := s.raop.sink.Info()
+	if si != nil {
+		mode = si.LossConcealment
+	}
+	s.concealer = newConcealer(mode, s.format, s.codec.SampleRate())
+	if si == nil || si.TargetLatency <= 0 || s.raop.unbuffered {
+		s.outq = startOutputQueue(s.raop.writeToStreams)
+		return
+	}
+	s.jitter = startJitterBuffer(si.TargetLatency, s.format, s.codec.SampleRate(), s.raop.writeToStreams)
+}
+
+func (s *session) setProgress(start, current, end int64) error {
+	position, err := s.rtptoms(current - start)
+	if err != nil {
+		return err
+	}
+	duration, err := s.rtptoms(end - start)
+	if err != nil {
+		return err
+	}
+
+	s.raop.sink.SetProgress(position, duration)
+	return nil
+}
+
+// Start streaming from the sequence number and RTP timestamp given in RECORD.
+func (s *session) record(sn seqno, rtptime uint32) {
+	sessionlog.Debug.Println("Record ", s, " from seqno=", sn, ", rtptime=", rtptime)
+	if s.sequencer != nil {
+		s.sequencer.flushTo(sn)
+	}
+}
+
+// Returns the audio latency of the sink in samples, including the target
+// latency of the jitter buffer.
+func (s *session) audioLatency() int64 {
+	si := s.raop.sink.Info()
+	if si == nil {
+		return defaultAudioLatency
+	}
+	latency := int64(defaultAudioLatency)
+	if si.AudioLatency > 0 {
+		if l, err := s.durationtortp(si.AudioLatency); err == nil {
+			latency = l
+		}
+	}
+	if si.TargetLatency > 0 {
+		if l, err := s.durationtortp(si.TargetLatency); err == nil {
+			latency += l
+		}
+	}
+	return latency
+}
+
+// Drop all audio which has not been output yet.
+func (s *session) flush() {
+	if s.sequencer != nil {
+		s.sequencer.flush()
+	}
+	if s.concealer != nil {
+		s.concealer.reset()
+	}
+	if s.jitter != nil {
+		s.jitter.flush()
+	}
+	if s.outq != nil {
+		s.outq.flush()
+	}
+	s.raop.flushStreams()
+}
+
+// Drop all audio older than sn which has not been output yet. Audio will
+// continue from sn.
+func (s *session) flushTo(sn seqno) {
+	if s.sequencer != nil {
+		s.sequencer.flushTo(sn)
+	}
+	if s.concealer != nil {
+		s.concealer.reset()
+	}
+	if s.jitter != nil {
+		s.jitter.flush()
+	}
+	if s.outq != nil {
+		s.outq.flush()
+	}
+	s.raop.flushStreams()
+}
+
+// Wait until all queued audio has been handled and written to the audio
+// streams.
+func (s *session) sync() {
+	if s.sequencer != nil {
+		s.sequencer.sync()
+	}
+	if s.outq != nil {
+		s.outq.sync()
+	}
+	s.raop.syncStreams()
+}
+
+// Stop all processing of the session and tell the sink that the stream
+// has stopped and why. Only the first call will have any effect.
+func (s *session) teardown(reason error) {
+	s.teardownOnce.Do(func() {
+		sessionlog.Debug.Println("Teardown ", s, ": ", reason)
+		close(s.done)
+		s.watchdog.stop()
+		// Close the RTP sockets before the sequencer as the receivers
+		// may be waiting for the sequencer to accept a packet.
+		for _, r := range []*rtp{s.data, s.control, s.timing} {
+			if r != nil {
+				r.Close()
+			}
+		}
+		if s.sequencer != nil {
+			s.sequencer.close()
+		}
+		if s.jitter != nil {
+			s.jitter.close()
+		}
+		if s.outq != nil {
+			s.outq.close()
+		}
+		s.raop.idleStreams()
+		if sh, ok := s.raop.sink.(SinkStopHandler); ok {
+			sh.StoppedWithReason(reason)
+		} else {
+			s.raop.sink.Stopped()
+		}
+	})
+}
+
+// Returns the session policy of the sink.
+func (r *raop) sessionPolicy() SessionPolicy {
+	si := r.sink.Info()
+	if si == nil {
+		return RejectNewSession
+	}
+	return si.SessionPolicy
+}
+
+// claim makes a new session for the RTSP connection the active session of
+// the sink. If another connection has an active session the session policy
+// decides if the new connection is rejected or the old session preempted.
+func (r *raop) claim(rs *rtspSession) (*session, error) {
+	s := newSession(r, rs)
+
+	r.sessionMutex.Lock()
+	old := r.active
+	if old != nil && old.rs != rs && r.sessionPolicy() == RejectNewSession {
+		r.sessionMutex.Unlock()
+		return nil, newRTSPError(453, nil, "Sink is busy with ", old)
+	}
+	s.startWatchdog()
+	r.active = s
+	r.sessionMutex.Unlock()
+
+	if old != nil {
+		if old.rs != rs {
+			sessionlog.Info.Println("Preempting ", old, " by ", s)
+			old.rs.closeWithReason(ErrPreempted)
+			old.teardown(ErrPreempted)
+		} else {
+			old.teardown(ErrReannounced)
+		}
+	}
+	return s, nil
+}
+
+// release tears down the session and removes it as the active session
+// of the sink. The reason is passed on to the sink.
+func (r *raop) release(s *session, reason error) {
+	s.teardown(reason)
+
+	r.sessionMutex.Lock()
+	if r.active == s {
+		r.active = nil
+	}
+	r.sessionMutex.Unlock()
+}
+
+// Returns true if the RTSP connection owns the active session of the sink
+// or no session is active.
+func (r *raop) isOwnedBy(rs *rtspSession) bool {
+	r.sessionMutex.Lock()
+	defer r.sessionMutex.Unlock()
+
+	return r.active == nil || r.active.rs == rs
+}
+
+func (r *raop) activeSession() *session {
+	r.sessionMutex.Lock()
+	defer r.sessionMutex.Unlock()
+
+	return r.active
+}
+
+// The session header may have parameters, i.e. "Session: 1234;timeout=60"
+func sessionIdFromHeader(h string) string {
+	return strings.TrimSpace(strings.SplitN(h, ";", 2)[0])
+}
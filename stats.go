@@ -0,0 +1,56 @@
+package raopd
+
+import "time"
+
+/*
+StreamStats are the statistics of the stream currently sent by a source.
+*/
+type StreamStats struct {
+	// The target latency of the jitter buffer, zero if the audio is not
+	// buffered. See SinkInfo.
+	TargetLatency time.Duration
+
+	// The audio held by the jitter buffer waiting to be played
+	BufferDepth time.Duration
+
+	// The number of times the jitter buffer ran empty and the silence
+	// written until audio arrived
+	Underruns int
+	Silence   time.Duration
+
+	// Frames dropped as they arrived after their play time
+	LateFrames int
+
+	// Frames written in place of packets lost in the network, see
+	// Concealment
+	ConcealedFrames int
+
+	// Frames dropped as an audio stream with the policy OverflowBlock
+	// fell too far behind
+	DroppedFrames int
+}
+
+/*
+StreamStats returns the statistics of the stream currently sent by the
+source. It returns false if the source is not streaming.
+*/
+func (source *Source) StreamStats() (StreamStats, bool) {
+	r := &source.raop
+	r.sessionMutex.Lock()
+	defer r.sessionMutex.Unlock()
+
+	var stats StreamStats
+	if r.active == nil || r.active.codec == nil {
+		return stats, false
+	}
+	if r.active.jitter != nil {
+		r.active.jitter.stats(&stats)
+	}
+	if r.active.concealer != nil {
+		stats.ConcealedFrames = r.active.concealer.concealedFrames()
+	}
+	if r.active.outq != nil {
+		stats.DroppedFrames = r.active.outq.droppedFrames()
+	}
+	return stats, true
+}
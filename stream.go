@@ -0,0 +1,381 @@
+package raopd
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+OverflowPolicy decides what happens when the audio arrives faster than an
+audio stream writes it and its buffer is full.
+*/
+type OverflowPolicy int
+
+const (
+	// Drop the oldest audio in the buffer to make room. This is the
+	// default.
+	OverflowDropOldest OverflowPolicy = iota
+
+	// Wait until the writer has made room in the buffer. The audio of all
+	// streams of the source is delayed, and audio is dropped for all of
+	// them if the writer falls too far behind.
+	OverflowBlock
+
+	// Close the audio stream.
+	OverflowDisconnect
+)
+
+// The number of frames buffered by an audio stream by default, about 1
+// second of ALAC audio.
+const defaultStreamFrames = 128
+
+// A frame arriving this long after the audio written before it has been
+// played is an underrun.
+const underrunTolerance = 20 * time.Millisecond
+
+var errStreamOverflow = errors.New("The audio stream buffer overflowed")
+
+/*
+AudioStreamOptions configures an audio stream, see NewAudioStreamWithOptions.
+*/
+type AudioStreamOptions struct {
+	// The number of frames, i.e. audio packets, buffered for the writer.
+	// Zero buffers 128 frames.
+	Frames int
+
+	// What to do when the buffer is full.
+	Overflow OverflowPolicy
+}
+
+/*
+AudioStreamStats are the statistics of an audio stream.
+*/
+type AudioStreamStats struct {
+	// Frames waiting to be written
+	Buffered int
+
+	// The number of times a frame arrived after the audio written before
+	// it had been played, so the output would have run dry
+	Underruns int
+
+	// The number of frames which arrived when the buffer was full
+	Overruns int
+}
+
+type streamFrame struct {
+	frame    AudioFrame
+	audio    []byte // The copied audio of the frame
+	duration time.Duration
+	resume   bool // The first frame after a pause
+}
+
+/*
+AudioStream is an audio output of a source. The audio is written to the
+writer from a go-routine of its own through a bounded ring buffer, so a
+slow writer does not delay the other audio streams unless the policy is
+OverflowBlock.
+*/
+type AudioStream struct {
+	audioWriter io.Writer
+	timed       TimedWriter // nil if the writer is not a TimedWriter
+	ctx         context.Context
+	overflow    OverflowPolicy
+
+	m        sync.Mutex
+	c        *sync.Cond // Signalled when the ring or the state changes
+	ring     []streamFrame
+	head     int
+	count    int
+	writing  bool
+	draining bool // Close when the ring is empty
+	closed   bool
+	err      error
+
+	deadline  time.Time // When the audio written has been played
+	idle      bool      // The stream has paused, the next frame resumes it
+	underruns int
+	overruns  int
+
+	done chan struct{} // Closed when the writer go-routine exits
+}
+
+// The audio output streams of a sink. These are kept between sessions.
+type audioStreams struct {
+	streamsMutex sync.Mutex
+	streams      []*AudioStream
+}
+
+func (r *audioStreams) newStream(ctx context.Context, w io.Writer, opts AudioStreamOptions) *AudioStream {
+	audiolog.Debug.Println("audioStreams:newStream w=", w, ", options=", opts)
+	frames := opts.Frames
+	if frames <= 0 {
+		frames = defaultStreamFrames
+	}
+	as := &AudioStream{audioWriter: w, ctx: ctx, overflow: opts.Overflow}
+	if tw, ok := w.(TimedWriter); ok {
+		as.timed = tw
+	}
+	as.c = sync.NewCond(&as.m)
+	as.ring = make([]streamFrame, frames)
+	as.done = make(chan struct{})
+	go as.run()
+	go func() {
+		select {
+		case <-ctx.Done():
+			audiolog.Debug.Println("Context closed audio output ", as.audioWriter)
+			as.close(ctx.Err())
+		case <-as.done:
+		}
+	}()
+
+	r.streamsMutex.Lock()
+	defer r.streamsMutex.Unlock()
+
+	r.streams = append(r.streams, as)
+	return as
+}
+
+// Queue a frame of the duration to all streams. Closed streams are removed.
+// Waits for room in the full streams with the policy OverflowBlock.
+func (r *audioStreams) writeToStreams(frame AudioFrame, duration time.Duration) {
+	var blocked []*AudioStream
+	r.streamsMutex.Lock()
+	jj := 0
+	for ii, as := range r.streams {
+		open, full := as.push(frame, duration)
+		if open {
+			r.streams[jj] = r.streams[ii]
+			jj++
+		} else {
+			audiolog.Debug.Println("Closing audio output ", as.audioWriter, ", err=", as.Err())
+		}
+		if full {
+			blocked = append(blocked, as)
+		}
+	}
+	r.streams = r.streams[0:jj]
+	r.streamsMutex.Unlock()
+
+	// Wait without the lock so the streams can be changed meanwhile
+	for _, as := range blocked {
+		as.pushWait(frame, duration)
+	}
+}
+
+// Wait until all queued audio has been written.
+func (r *audioStreams) syncStreams() {
+	r.streamsMutex.Lock()
+	streams := append([]*AudioStream(nil), r.streams...)
+	r.streamsMutex.Unlock()
+
+	for _, as := range streams {
+		as.sync()
+	}
+}
+
+// Mark the streams as paused, the next audio does not continue the audio
+// written before and is not an underrun.
+func (r *audioStreams) idleStreams() {
+	r.streamsMutex.Lock()
+	defer r.streamsMutex.Unlock()
+
+	for _, as := range r.streams {
+		as.m.Lock()
+		as.idle = true
+		as.m.Unlock()
+	}
+}
+
+// Drop the queued audio of all streams. The next audio does not continue
+// the audio written before and is not an underrun.
+func (r *audioStreams) flushStreams() {
+	r.streamsMutex.Lock()
+	defer r.streamsMutex.Unlock()
+
+	for _, as := range r.streams {
+		as.m.Lock()
+		as.head = 0
+		as.count = 0
+		as.idle = true
+		as.c.Broadcast()
+		as.m.Unlock()
+	}
+}
+
+// Write all queued audio and close the streams.
+func (r *audioStreams) closeStreams() {
+	r.streamsMutex.Lock()
+	streams := r.streams
+	r.streams = nil
+	r.streamsMutex.Unlock()
+
+	for _, as := range streams {
+		as.m.Lock()
+		as.draining = true
+		as.c.Broadcast()
+		as.m.Unlock()
+		<-as.done
+	}
+}
+
+// Close the streams for the reason without writing the queued audio. A
+// write in progress is not waited for.
+func (r *audioStreams) stopStreams(reason error) {
+	r.streamsMutex.Lock()
+	streams := r.streams
+	r.streams = nil
+	r.streamsMutex.Unlock()
+
+	for _, as := range streams {
+		as.close(reason)
+	}
+}
+
+// Stats returns the statistics of the audio stream.
+func (as *AudioStream) Stats() AudioStreamStats {
+	as.m.Lock()
+	defer as.m.Unlock()
+	return AudioStreamStats{as.count, as.underruns, as.overruns}
+}
+
+// Err returns why the audio stream was closed, or nil if it is open.
+func (as *AudioStream) Err() error {
+	as.m.Lock()
+	defer as.m.Unlock()
+	return as.err
+}
+
+// Close the stream for the reason. Must be called with the lock held.
+func (as *AudioStream) closeLocked(reason error) {
+	if !as.closed {
+		as.closed = true
+		as.err = reason
+		as.c.Broadcast()
+	}
+}
+
+func (as *AudioStream) close(reason error) {
+	as.m.Lock()
+	defer as.m.Unlock()
+	as.closeLocked(reason)
+}
+
+// Queue a frame without waiting. Returns false if the stream is closed.
+// If the buffer is full and the policy is OverflowBlock the frame is not
+// queued and full is true, see pushWait.
+func (as *AudioStream) push(frame AudioFrame, duration time.Duration) (open, full bool) {
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	if as.closed {
+		return false, false
+	}
+	if as.count == len(as.ring) {
+		as.overruns++
+		switch as.overflow {
+		case OverflowBlock:
+			return true, true
+		case OverflowDisconnect:
+			as.closeLocked(errStreamOverflow)
+			return false, false
+		default:
+			as.head = (as.head + 1) % len(as.ring)
+			as.count--
+		}
+	}
+	as.queueLocked(frame, duration)
+	return true, false
+}
+
+// Wait until there is room in the buffer and queue the frame, unless the
+// stream is closed meanwhile.
+func (as *AudioStream) pushWait(frame AudioFrame, duration time.Duration) {
+	as.m.Lock()
+	defer as.m.Unlock()
+
+	for as.count == len(as.ring) && !as.closed {
+		as.c.Wait()
+	}
+	if !as.closed {
+		as.queueLocked(frame, duration)
+	}
+}
+
+// Queue a frame in the buffer, which must have room for it. Must be called
+// with the lock held.
+func (as *AudioStream) queueLocked(frame AudioFrame, duration time.Duration) {
+	sf := &as.ring[(as.head+as.count)%len(as.ring)]
+	sf.frame = frame
+	sf.audio = append(sf.audio[:0], frame.Audio...)
+	sf.duration = duration
+	sf.resume = as.idle
+	as.idle = false
+	as.count++
+	as.c.Broadcast()
+}
+
+// Wait until all queued audio has been written or the stream is closed.
+func (as *AudioStream) sync() {
+	as.m.Lock()
+	defer as.m.Unlock()
+	for (as.count > 0 || as.writing) && !as.closed {
+		as.c.Wait()
+	}
+}
+
+// Count an underrun if a frame is taken after the audio written before it
+// has been played. Must be called with the lock held.
+func (as *AudioStream) played(now time.Time, sf *streamFrame) {
+	if as.deadline.IsZero() || sf.resume || now.After(as.deadline.Add(underrunTolerance)) {
+		if !as.deadline.IsZero() && !sf.resume {
+			as.underruns++
+		}
+		as.deadline = now
+	}
+	as.deadline = as.deadline.Add(sf.duration)
+}
+
+func (as *AudioStream) run() {
+	defer close(as.done)
+	var buf []byte
+	for {
+		as.m.Lock()
+		for as.count == 0 && !as.closed && !as.draining {
+			as.c.Wait()
+		}
+		if as.closed || as.count == 0 {
+			as.closeLocked(nil)
+			as.m.Unlock()
+			return
+		}
+		sf := &as.ring[as.head]
+		frame := sf.frame
+		buf = append(buf[:0], sf.audio...)
+		frame.Audio = buf
+		as.head = (as.head + 1) % len(as.ring)
+		as.count--
+		as.writing = true
+		as.played(time.Now(), sf)
+		as.c.Broadcast()
+		as.m.Unlock()
+
+		var err error
+		if as.timed != nil {
+			err = as.timed.WriteFrame(frame)
+		} else {
+			_, err = as.audioWriter.Write(frame.Audio)
+		}
+
+		as.m.Lock()
+		as.writing = false
+		if err != nil {
+			audiolog.Debug.Println("Closing audio output ", as.audioWriter, ", on error=", err)
+			as.closeLocked(err)
+		}
+		as.c.Broadcast()
+		as.m.Unlock()
+	}
+}
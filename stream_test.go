@@ -0,0 +1,194 @@
+package raopd
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A writer which waits for the gate to open before each write.
+type gatedWriter struct {
+	gate chan struct{}
+	m    sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (gw *gatedWriter) Write(b []byte) (int, error) {
+	<-gw.gate
+	gw.m.Lock()
+	defer gw.m.Unlock()
+	return gw.buf.Write(b)
+}
+
+func (gw *gatedWriter) bytes() []byte {
+	gw.m.Lock()
+	defer gw.m.Unlock()
+	return append([]byte(nil), gw.buf.Bytes()...)
+}
+
+// Wait until the writer of the stream is writing a frame.
+func waitForWriting(as *AudioStream) {
+	for {
+		as.m.Lock()
+		writing := as.writing
+		as.m.Unlock()
+		if writing {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func streamTestFrame(b byte) AudioFrame {
+	return AudioFrame{Audio: []byte{b}, RtpTime: uint32(b)}
+}
+
+func TestStreamDropOldest(t *testing.T) {
+	var r audioStreams
+	slow := &gatedWriter{gate: make(chan struct{})}
+	fast := &gatedWriter{gate: make(chan struct{})}
+	close(fast.gate)
+	sas := r.newStream(context.Background(), slow, AudioStreamOptions{Frames: 2, Overflow: OverflowDropOldest})
+	fas := r.newStream(context.Background(), fast, AudioStreamOptions{})
+
+	r.writeToStreams(streamTestFrame(1), time.Millisecond)
+	waitForWriting(sas)
+	for b := byte(2); b <= 5; b++ {
+		r.writeToStreams(streamTestFrame(b), time.Millisecond)
+	}
+	fas.sync()
+	assert.Equal(t, []byte{1, 2, 3, 4, 5}, fast.bytes())
+
+	// The slow writer is writing the first frame, the others are dropped
+	// but the last two
+	assert.Equal(t, AudioStreamStats{Buffered: 2, Overruns: 2}, sas.Stats())
+	close(slow.gate)
+	sas.sync()
+	assert.Equal(t, []byte{1, 4, 5}, slow.bytes())
+	assert.Nil(t, sas.Err())
+	r.closeStreams()
+}
+
+func TestStreamDisconnect(t *testing.T) {
+	var r audioStreams
+	slow := &gatedWriter{gate: make(chan struct{})}
+	as := r.newStream(context.Background(), slow, AudioStreamOptions{Frames: 1, Overflow: OverflowDisconnect})
+
+	r.writeToStreams(streamTestFrame(1), time.Millisecond)
+	waitForWriting(as)
+	for b := byte(2); b <= 3; b++ {
+		r.writeToStreams(streamTestFrame(b), time.Millisecond)
+	}
+	assert.Equal(t, errStreamOverflow, as.Err())
+	assert.Equal(t, 1, as.Stats().Overruns)
+	assert.Empty(t, r.streams)
+	close(slow.gate)
+}
+
+func TestStreamBlock(t *testing.T) {
+	var r audioStreams
+	slow := &gatedWriter{gate: make(chan struct{})}
+	as := r.newStream(context.Background(), slow, AudioStreamOptions{Frames: 1, Overflow: OverflowBlock})
+
+	r.writeToStreams(streamTestFrame(1), time.Millisecond)
+	waitForWriting(as)
+	written := make(chan struct{})
+	go func() {
+		for b := byte(2); b <= 3; b++ {
+			r.writeToStreams(streamTestFrame(b), time.Millisecond)
+		}
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("The frames should not fit the buffer")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// The streams are not locked while waiting
+	fast := &gatedWriter{gate: make(chan struct{})}
+	close(fast.gate)
+	fas := r.newStream(context.Background(), fast, AudioStreamOptions{})
+	r.idleStreams()
+	close(slow.gate)
+	<-written
+	as.sync()
+	r.writeToStreams(streamTestFrame(4), time.Millisecond)
+	as.sync()
+	fas.sync()
+	assert.Equal(t, []byte{1, 2, 3, 4}, slow.bytes())
+	assert.Equal(t, 1, as.Stats().Overruns)
+	assert.Equal(t, []byte{4}, fast.bytes())
+	r.closeStreams()
+}
+
+func TestStreamFlush(t *testing.T) {
+	var r audioStreams
+	w := &gatedWriter{gate: make(chan struct{})}
+	as := r.newStream(context.Background(), w, AudioStreamOptions{Overflow: OverflowDropOldest})
+
+	r.writeToStreams(streamTestFrame(1), time.Millisecond)
+	waitForWriting(as)
+	r.writeToStreams(streamTestFrame(2), time.Millisecond)
+	r.writeToStreams(streamTestFrame(3), time.Millisecond)
+
+	// The queued frames are dropped, the frame being written is not
+	r.flushStreams()
+	assert.Equal(t, 0, as.Stats().Buffered)
+	r.writeToStreams(streamTestFrame(4), time.Millisecond)
+	close(w.gate)
+	as.sync()
+	assert.Equal(t, []byte{1, 4}, w.bytes())
+	r.closeStreams()
+}
+
+func TestStreamUnderrun(t *testing.T) {
+	var r audioStreams
+	w := &gatedWriter{gate: make(chan struct{})}
+	close(w.gate)
+	as := r.newStream(context.Background(), w, AudioStreamOptions{})
+
+	// Frames arriving in time
+	r.writeToStreams(streamTestFrame(1), 100*time.Millisecond)
+	r.writeToStreams(streamTestFrame(2), 100*time.Millisecond)
+	as.sync()
+	assert.Equal(t, 0, as.Stats().Underruns)
+
+	// A frame arriving after the audio has been played
+	r.writeToStreams(streamTestFrame(3), time.Millisecond)
+	as.sync()
+	time.Sleep(250*time.Millisecond + underrunTolerance)
+	r.writeToStreams(streamTestFrame(4), time.Millisecond)
+	as.sync()
+	assert.Equal(t, 1, as.Stats().Underruns)
+
+	// Not after a pause
+	time.Sleep(10*time.Millisecond + underrunTolerance)
+	r.idleStreams()
+	r.writeToStreams(streamTestFrame(5), time.Millisecond)
+	as.sync()
+	assert.Equal(t, 1, as.Stats().Underruns)
+	r.closeStreams()
+	assert.Equal(t, []byte{1, 2, 3, 4, 5}, w.bytes())
+}
+
+func TestStreamContext(t *testing.T) {
+	var r audioStreams
+	w := &gatedWriter{gate: make(chan struct{})}
+	close(w.gate)
+	ctx, cancel := context.WithCancel(context.Background())
+	as := r.newStream(ctx, w, AudioStreamOptions{})
+
+	r.writeToStreams(streamTestFrame(1), time.Millisecond)
+	as.sync()
+	cancel()
+	<-as.done
+	assert.Equal(t, context.Canceled, as.Err())
+	r.writeToStreams(streamTestFrame(2), time.Millisecond)
+	assert.Empty(t, r.streams)
+	assert.Equal(t, []byte{1}, w.bytes())
+}
@@ -0,0 +1,35 @@
+package raopd
+
+import "time"
+
+/*
+AudioFrame is a block of decoded audio, the audio of one RTP packet, in the
+format given by StreamFormat.
+*/
+type AudioFrame struct {
+	// The audio. It must not be retained after WriteFrame returns.
+	Audio []byte
+
+	// The RTP timestamp of the first sample of the audio. It counts samples
+	// at the sample rate of the stream sent by the source, which may differ
+	// from the sample rate of the audio unless NativeAudioFormat is set.
+	RtpTime uint32
+
+	// The local time at which the first sample should be heard, derived
+	// from the sync packets and timing exchanges with the source. It has a
+	// monotonic clock reading so it can be compared with time.Now. It is
+	// the zero time if the source has not sent a sync packet yet. If the
+	// sink has a TargetLatency it is the time the jitter buffer writes
+	// the frame.
+	PresentationTime time.Time
+}
+
+/*
+TimedWriter may be implemented by the writers given to NewAudioStream. The
+audio is then given to WriteFrame together with the time it should be heard
+instead of being written to Write, so a sink with its own hardware clock can
+schedule the playback precisely. An error closes the audio stream.
+*/
+type TimedWriter interface {
+	WriteFrame(frame AudioFrame) error
+}
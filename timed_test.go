@@ -0,0 +1,73 @@
+package raopd
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type timedTestWriter struct {
+	bytes.Buffer // Written if the frames are not
+	frames       []AudioFrame
+	err          error
+}
+
+func (tw *timedTestWriter) WriteFrame(frame AudioFrame) error {
+	frame.Audio = append([]byte(nil), frame.Audio...)
+	tw.frames = append(tw.frames, frame)
+	return tw.err
+}
+
+func audioTestPacket(sn seqno, rtptime uint32, audio ...byte) *rtpPacket {
+	pkt := testPacket(sn, 96)
+	binary.BigEndian.PutUint32(pkt.content[4:8], rtptime)
+	pkt.content = append(pkt.content[:12], audio...)
+	return pkt
+}
+
+func TestTimedWriter(t *testing.T) {
+	source, rs, fc := makeFormatTestSource()
+	fc.si.NativeAudioFormat = true
+
+	sdp := strings.Replace(unencryptedSdp, "a=rtpmap:96 AppleLossless\r\n"+
+		"a=fmtp:96 352 0 16 40 10 14 2 255 0 0 44100\r\n", "a=rtpmap:96 L16/44100/2\r\n", 1)
+	resp, err := request(rs, announceRequest(sdp))
+	assert.Nil(t, err)
+	assert.Equal(t, 200, resp.StatusCode, "StatusCode")
+
+	tw := &timedTestWriter{}
+	plain := &bytes.Buffer{}
+	source.NewAudioStream(context.Background(), tw)
+	source.NewAudioStream(context.Background(), plain)
+
+	// No presentation time before the first sync packet
+	rs.s.handleAudioPacket(audioTestPacket(1, 1000, 0x01, 0x02, 0x03, 0x04))
+	rs.s.sync()
+	assert.Equal(t, []AudioFrame{{[]byte{0x02, 0x01, 0x04, 0x03}, 1000, time.Time{}}}, tw.frames)
+	assert.Equal(t, []byte{0x02, 0x01, 0x04, 0x03}, plain.Bytes())
+	assert.Equal(t, 0, tw.Len())
+
+	now := time.Now()
+	rs.s.clock.handleSync(syncPacket(1000+352, 0, toNtpTime(now)), now)
+	rs.s.handleAudioPacket(audioTestPacket(2, 1000+352+44100, 0x05, 0x06, 0x07, 0x08))
+	rs.s.sync()
+	assert.Len(t, tw.frames, 2)
+	assert.Equal(t, uint32(1000+352+44100), tw.frames[1].RtpTime)
+	assert.Equal(t, now.Add(time.Second), tw.frames[1].PresentationTime)
+
+	// An error closes the stream
+	tw.err = errors.New("Closed")
+	rs.s.handleAudioPacket(audioTestPacket(3, 1000+2*352, 0x09, 0x0a, 0x0b, 0x0c))
+	rs.s.sync()
+	rs.s.handleAudioPacket(audioTestPacket(4, 1000+3*352, 0x0d, 0x0e, 0x0f, 0x10))
+	rs.s.sync()
+	assert.Len(t, tw.frames, 3)
+	assert.Equal(t, []byte{0x02, 0x01, 0x04, 0x03, 0x06, 0x05, 0x08, 0x07,
+		0x0a, 0x09, 0x0c, 0x0b, 0x0e, 0x0d, 0x10, 0x0f}, plain.Bytes())
+}
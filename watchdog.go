@@ -0,0 +1,131 @@
+package raopd
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// Reasons given to SinkStopHandler for why a stream was stopped.
+var (
+	// The source sent a TEARDOWN request.
+	ErrTeardown = errors.New("Source tore down the session")
+
+	// Another source took over the sink, see PreemptSession.
+	ErrPreempted = errors.New("Session was preempted by another source")
+
+	// The source announced a new session on the connection of the session.
+	ErrReannounced = errors.New("Source announced a new session")
+
+	// The RTSP connection to the source was closed.
+	ErrDisconnected = errors.New("Source disconnected")
+
+	// The sink was unregistered or the collection closed.
+	ErrShutdown = errors.New("Sink was shut down")
+
+	// No audio data was received within SinkInfo.DataTimeout while playing.
+	ErrDataTimeout = errors.New("No audio data received from source")
+
+	// No RTSP request was received within SinkInfo.KeepaliveTimeout.
+	ErrKeepaliveTimeout = errors.New("No keepalive received from source")
+
+	// The RTSP connection was idle longer than SinkInfo.IdleTimeout.
+	ErrIdleTimeout = errors.New("RTSP connection was idle")
+)
+
+// The watchdog keeps track of when the source was last heard from. If a
+// timeout is exceeded the RTSP connection of the session is closed with
+// the timeout as the reason, which will tear down the session.
+type watchdog struct {
+	lastData    int64 // Unix nano time of the last audio packet
+	lastRequest int64 // Unix nano time of the last RTSP request
+	playing     int32 // Set to 1 between RECORD and PAUSE/FLUSH
+
+	done chan struct{} // Closed when the watchdog has stopped, nil if not started
+}
+
+func unixNano() int64 {
+	return time.Now().UnixNano()
+}
+
+// Record that an RTSP request was received
+func (w *watchdog) request() {
+	atomic.StoreInt64(&w.lastRequest, unixNano())
+}
+
+// Record that an audio packet was received
+func (w *watchdog) data() {
+	atomic.StoreInt64(&w.lastData, unixNano())
+}
+
+func (w *watchdog) setPlaying(playing bool) {
+	if playing {
+		w.data()
+		atomic.StoreInt32(&w.playing, 1)
+	} else {
+		atomic.StoreInt32(&w.playing, 0)
+	}
+}
+
+func pollInterval(timeouts ...time.Duration) time.Duration {
+	interval := time.Duration(0)
+	for _, t := range timeouts {
+		if t > 0 && (interval == 0 || t < interval) {
+			interval = t
+		}
+	}
+	return interval / 4
+}
+
+// Start watching the session until it is torn down. Nothing is started if
+// no timeouts are set. Must be called before the session is published as
+// the active session so a teardown can not race with the start.
+func (s *session) startWatchdog() {
+	si := s.raop.sink.Info()
+	if si == nil {
+		return
+	}
+	dataTimeout := si.DataTimeout
+	keepaliveTimeout := si.KeepaliveTimeout
+	interval := pollInterval(dataTimeout, keepaliveTimeout)
+	if interval == 0 {
+		return
+	}
+
+	w := &s.watchdog
+	w.request()
+	w.done = make(chan struct{})
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-ticker.C:
+			}
+			t := unixNano()
+			var reason error
+			switch {
+			case keepaliveTimeout > 0 && t-atomic.LoadInt64(&w.lastRequest) > int64(keepaliveTimeout):
+				reason = ErrKeepaliveTimeout
+			case dataTimeout > 0 && atomic.LoadInt32(&w.playing) == 1 &&
+				t-atomic.LoadInt64(&w.lastData) > int64(dataTimeout):
+				reason = ErrDataTimeout
+			}
+			if reason != nil {
+				sessionlog.Info.Println("Closing ", s, ": ", reason)
+				s.rs.closeWithReason(reason)
+				return
+			}
+		}
+	}()
+}
+
+// Wait for the watchdog to finish. The session must have been torn down.
+func (w *watchdog) stop() {
+	if w.done != nil {
+		<-w.done
+	}
+}
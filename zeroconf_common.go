@@ -106,26 +106,37 @@ func makeAPBonjourRecord(raop *raop) *zeroconfRecord {
 	r.serviceHost = hostname  // shost
 	r.Port = port
 
+	r.appendText(raopTxtValues(raop)...)
+
+	return r
+}
+
+// The key=value strings of the TXT record of the RAOP service. These are
+// also reported in the GET /info response.
+func raopTxtValues(raop *raop) []string {
 	version := "0.1" // Get from RAOP or caller.
-	r.appendText(
+	pw := "pw=false"
+	if si := raop.sink.Info(); si != nil && si.Password != "" {
+		pw = "pw=true"
+	}
+	return []string{
 		"txtvers=1",
-		"ch=2",     // 2 channels
-		"cn=0,1",   // PCM,ALAC
-		"et=0,1",   // Encryption, none,RSA
-		"sv=false", //
-		"da=true",  //
+		"ch=2",              // 2 channels
+		"cn=" + txtCodecs(), // PCM,ALAC,AAC, AAC-ELD only with a registered decoder
+		"et=0,1",            // Encryption, none,RSA
+		"sv=false",          //
+		"da=true",           //
 		"am=Squareplay",
-		"sr=44100",    // Sample Rate
-		"ss=16",       // Sample Size
-		"pw=false",    // No password
-		"vn=3",        //
-		"tp=UDP",      // Transports: UDP
-		"md=0,1,2",    // Metadata: text, artwork, progress
-		"vs="+version, // Version
-		"sm=false",    //
-		"ek=1")        //
-
-	return r
+		"sr=44100",      // Sample Rate
+		"ss=16",         // Sample Size
+		pw,              // Password required
+		"vn=3",          //
+		"tp=TCP,UDP",    // Transports: TCP interleaved and UDP
+		"md=0,1,2",      // Metadata: text, artwork, progress
+		"vs=" + version, // Version
+		"sm=false",      //
+		"ek=1",          //
+	}
 }
 
 // -------------------------- resolve ---------------------------------------------------------------